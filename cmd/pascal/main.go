@@ -0,0 +1,308 @@
+// Command pascal runs and inspects Pascal programs with the calc5 interpreter.
+//
+// Usage:
+//
+//	pascal run [-scope] [-checked] [-vm] [-O] file.pas|file.pco
+//	pascal compile [-O] [-o file.pco] file.pas
+//	pascal disasm [-O] file.pas|file.pco
+//	pascal tokens file.pas
+//	pascal ast file.pas
+//	pascal symbols file.pas
+//	pascal check file.pas
+//
+// compile writes the bytecode of a program to an object file, by default the
+// source file name with the extension .pco, which run and disasm accept in
+// place of the source.
+//
+// The exit status tells which stage failed: 1 for usage or I/O errors, 2 for
+// lexer, 3 for parser, 4 for semantic and 5 for runtime errors.
+package main
+
+import (
+	"bytes"
+	"context"
+	stderrors "errors"
+	"flag"
+	"fmt"
+	"github.com/IngvarListard/pascal-go-intepreter/pkg/calc5"
+	"github.com/IngvarListard/pascal-go-intepreter/pkg/calc5/errors"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	exitOK = iota
+	exitUsage
+	exitLexer
+	exitParser
+	exitSemantic
+	exitRuntime
+)
+
+var commands = map[string]func(args []string) error{
+	"run":     run,
+	"compile": compile,
+	"disasm":  disasm,
+	"tokens":  tokens,
+	"ast":     ast,
+	"symbols": symbols,
+	"check":   check,
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: pascal <run|compile|disasm|tokens|ast|symbols|check> [flags] file.pas")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(exitUsage)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(exitUsage)
+	}
+	if err := cmd(os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitCode(err))
+	}
+}
+
+// exitCode maps an error to the exit status of the stage that produced it.
+func exitCode(err error) int {
+	var e *errors.Error
+	if !stderrors.As(err, &e) {
+		return exitUsage
+	}
+	switch e.Type() {
+	case errors.LexerError:
+		return exitLexer
+	case errors.ParserError:
+		return exitParser
+	case errors.SemanticError:
+		return exitSemantic
+	case errors.RuntimeError:
+		return exitRuntime
+	default:
+		return exitUsage
+	}
+}
+
+// sourceFile parses the flags of a subcommand and returns its single file argument.
+func sourceFile(fs *flag.FlagSet, args []string) (string, error) {
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	if fs.NArg() != 1 {
+		return "", fmt.Errorf("%s: expected exactly one source file", fs.Name())
+	}
+	return fs.Arg(0), nil
+}
+
+func readSource(fs *flag.FlagSet, args []string) (string, error) {
+	text, err := readFile(fs, args)
+	return string(text), err
+}
+
+// readFile is readSource for commands that also take object files.
+func readFile(fs *flag.FlagSet, args []string) ([]byte, error) {
+	name, err := sourceFile(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(name)
+}
+
+// object returns text as an object file, compiling it first if it is source.
+func object(text []byte, opts ...calc5.Option) ([]byte, error) {
+	if calc5.IsObject(text) {
+		return text, nil
+	}
+	i, err := calc5.New(bytes.NewReader(text), opts...)
+	if err != nil {
+		return nil, err
+	}
+	var obj bytes.Buffer
+	if err := i.Compile(&obj); err != nil {
+		return nil, err
+	}
+	return obj.Bytes(), nil
+}
+
+func parse(text string) (calc5.Node, error) {
+	return calc5.NewParser(calc5.NewLexer(text)).Parse()
+}
+
+const optimizeUsage = "fold constant expressions and drop dead branches before running or compiling"
+
+// optimization returns the options that turn the optimizer on when it is asked for.
+func optimization(on bool) []calc5.Option {
+	if on {
+		return []calc5.Option{calc5.WithOptimization()}
+	}
+	return nil
+}
+
+func run(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	scope := fs.Bool("scope", false, "print the global scope after the program finishes")
+	checked := fs.Bool("checked", false, "fail on reads of inactive variant record fields")
+	vm := fs.Bool("vm", false, "compile the program to bytecode and run it on the stack machine")
+	optimize := fs.Bool("O", false, optimizeUsage)
+	text, err := readFile(fs, args)
+	if err != nil {
+		return err
+	}
+
+	opts := []calc5.Option{calc5.WithOutput(os.Stdout), calc5.WithInput(os.Stdin)}
+	if *checked {
+		opts = append(opts, calc5.WithVariantChecks())
+	}
+	if *vm {
+		opts = append(opts, calc5.WithBytecode())
+	}
+	opts = append(opts, optimization(*optimize)...)
+	var i *calc5.Interpreter
+	if calc5.IsObject(text) {
+		i, err = calc5.Load(bytes.NewReader(text), opts...)
+	} else {
+		i, err = calc5.New(bytes.NewReader(text), opts...)
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	globals, err := i.Run(ctx)
+	if err != nil {
+		return err
+	}
+	if *scope {
+		names := make([]string, 0, len(globals))
+		for name := range globals {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			v := globals[name]
+			// chars come back as runes, which %v prints as numbers
+			if c, ok := v.(rune); ok {
+				v = string(c)
+			}
+			fmt.Printf("%s = %v\n", name, v)
+		}
+	}
+	return nil
+}
+
+func compile(args []string) error {
+	fs := flag.NewFlagSet("compile", flag.ContinueOnError)
+	out := fs.String("o", "", "object file to write, file.pco by default")
+	optimize := fs.Bool("O", false, optimizeUsage)
+	name, err := sourceFile(fs, args)
+	if err != nil {
+		return err
+	}
+	text, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	obj, err := object(text, optimization(*optimize)...)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		*out = strings.TrimSuffix(name, filepath.Ext(name)) + ".pco"
+	}
+	return ioutil.WriteFile(*out, obj, 0644)
+}
+
+func disasm(args []string) error {
+	fs := flag.NewFlagSet("disasm", flag.ContinueOnError)
+	optimize := fs.Bool("O", false, optimizeUsage)
+	text, err := readFile(fs, args)
+	if err != nil {
+		return err
+	}
+	obj, err := object(text, optimization(*optimize)...)
+	if err != nil {
+		return err
+	}
+	return calc5.Disassemble(os.Stdout, bytes.NewReader(obj))
+}
+
+func tokens(args []string) error {
+	text, err := readSource(flag.NewFlagSet("tokens", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+	lexer := calc5.NewLexer(text)
+	for {
+		token, err := lexer.NextToken()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\t%s\n", token.Pos(), token)
+		if token.Type() == calc5.EOF {
+			return nil
+		}
+	}
+}
+
+func ast(args []string) error {
+	text, err := readSource(flag.NewFlagSet("ast", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+	node, err := parse(text)
+	if err != nil {
+		return err
+	}
+	return calc5.FprintAST(os.Stdout, node)
+}
+
+func symbols(args []string) error {
+	text, err := readSource(flag.NewFlagSet("symbols", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+	node, err := parse(text)
+	if err != nil {
+		return err
+	}
+	analyzer := calc5.NewSemanticAnalyzer()
+	err = analyzer.Analyze(node)
+	for _, scope := range analyzer.Scopes() {
+		fmt.Println(scope)
+	}
+	return err
+}
+
+func check(args []string) error {
+	text, err := readSource(flag.NewFlagSet("check", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+	node, err := parse(text)
+	if err != nil {
+		return err
+	}
+	return calc5.NewSemanticAnalyzer().Analyze(node)
+}
@@ -2,53 +2,131 @@ package calc5
 
 import (
 	"fmt"
+	"github.com/IngvarListard/pascal-go-intepreter/pkg/calc5/errors"
 )
 
 type TokenTyp int
 
+func (t TokenTyp) String() string {
+	if int(t) < len(TokenTypes) && TokenTypes[t] != "" {
+		return TokenTypes[t]
+	}
+	return fmt.Sprintf("TokenTyp(%d)", int(t))
+}
+
+// Position is a 1-based line and column in the source text.
+type Position struct {
+	Line   int
+	Column int
+}
+
+func (p Position) String() string { return fmt.Sprintf("%d:%d", p.Line, p.Column) }
+
+// Span is the source range covered by a token or a node. End points just past
+// the last rune.
+type Span struct {
+	Start Position
+	End   Position
+}
+
+func (s Span) String() string { return fmt.Sprintf("%s-%s", s.Start, s.End) }
+
+// spanOf covers everything from the start of first to the end of last.
+func spanOf(first, last Node) Span {
+	return Span{Start: first.Pos().Start, End: last.Pos().End}
+}
+
 type Token struct {
-	typ    TokenTyp
-	value  interface{}
-	lineno int
-	column int
+	typ       TokenTyp
+	value     interface{}
+	lineno    int
+	column    int
+	endLineno int
+	endColumn int
 }
 
 func (t *Token) String() string {
-	return fmt.Sprintf("Token{ %v, %v, position=%v: %v", t.typ, t.value, t.lineno, t.column)
+	value := t.value
+	if r, ok := value.(rune); ok && r != NullRune {
+		value = string(r)
+	}
+	return fmt.Sprintf("Token{%v, %v, position=%v:%v}", t.typ, value, t.lineno, t.column)
+}
+
+// Type returns the kind of the token.
+func (t *Token) Type() TokenTyp { return t.typ }
+
+// Pos returns the source range of the token.
+func (t *Token) Pos() Span {
+	return Span{
+		Start: Position{Line: t.lineno, Column: t.column},
+		End:   Position{Line: t.endLineno, Column: t.endColumn},
+	}
+}
+
+// at attaches token and its position to an error.
+func at(token *Token) errors.Option {
+	return func(e *errors.Error) {
+		errors.Token(token)(e)
+		errors.Pos(token.lineno, token.column)(e)
+	}
+}
+
+// atNode attaches the start of node's source range to an error.
+func atNode(node Node) errors.Option {
+	return func(e *errors.Error) {
+		start := node.Pos().Start
+		errors.Token(node.Token())(e)
+		errors.Pos(start.Line, start.Column)(e)
+	}
 }
 
 type Node interface {
 	Token() *Token
 	Value() (interface{}, error)
+	Pos() Span
 }
 
 type BinOp struct {
 	left  Node
 	right Node
 	op    *Token
+	typ   Symbol // result type, set by the semantic analyzer
 }
 
 func (b *BinOp) Token() *Token { return b.op }
 
+func (b *BinOp) Pos() Span { return spanOf(b.left, b.right) }
+
+// Value folds an operation on literal operands. Operands that are not
+// literals have no value and make it fail.
 func (b *BinOp) Value() (interface{}, error) {
-	lVal, _ := b.left.Value()
-	lInt := lVal.(int)
-	rVal, _ := b.right.Value()
-	rInt := rVal.(int)
-	switch b.op.typ {
-	case Mul:
-		return lInt * rInt, nil
-	case FloatDiv:
-		return float64(lInt) / float64(rInt), nil
-	case IntegerDiv:
-		return lInt / rInt, nil
-	case Plus:
-		return lInt + rInt, nil
-	case Minus:
-		return lInt - rInt, nil
-	default:
-		return nil, fmt.Errorf("unexpected token type %v", b.op.typ)
+	left, err := operand(b.left)
+	if err != nil {
+		return nil, err
 	}
+	right, err := operand(b.right)
+	if err != nil {
+		return nil, err
+	}
+	v, err := binary(b.op.typ, left, right)
+	if err != nil {
+		return nil, err
+	}
+	return v.Interface(), nil
+}
+
+// operand returns the value of a literal expression.
+func operand(node Node) (Value, error) {
+	x, err := node.Value()
+	if err != nil {
+		return Value{}, err
+	}
+	v, ok := valueOf(x)
+	if !ok {
+		return Value{}, fmt.Errorf("%T has no constant value", node)
+	}
+	return v, nil
 }
 
 type Num struct {
@@ -58,30 +136,71 @@ type Num struct {
 
 func (n *Num) Token() *Token { return n.token }
 
+func (n *Num) Pos() Span { return n.token.Pos() }
+
 func (n *Num) Value() (interface{}, error) { return n.value, nil }
 
+type boolConst struct {
+	token *Token
+	value bool
+}
+
+func (b *boolConst) Token() *Token { return b.token }
+
+func (b *boolConst) Pos() Span { return b.token.Pos() }
+
+func (b *boolConst) Value() (interface{}, error) { return b.value, nil }
+
+// strConst is a quoted literal. A literal of exactly one character is a char
+// constant, any other is a string.
+type strConst struct {
+	token *Token
+	value string
+}
+
+func (s *strConst) Token() *Token { return s.token }
+
+func (s *strConst) Pos() Span { return s.token.Pos() }
+
+func (s *strConst) Value() (interface{}, error) {
+	if runes := []rune(s.value); len(runes) == 1 {
+		return runes[0], nil
+	}
+	return s.value, nil
+}
+
 type UnaryOp struct {
 	expr Node
 	op   *Token
+	typ  Symbol // result type, set by the semantic analyzer
 }
 
 func (u *UnaryOp) Token() *Token { return u.op }
 
+func (u *UnaryOp) Pos() Span { return Span{Start: u.op.Pos().Start, End: u.expr.Pos().End} }
+
 func (u *UnaryOp) Value() (interface{}, error) {
-	return u.expr.Value()
+	v, err := operand(u.expr)
+	if err != nil {
+		return nil, err
+	}
+	if v, err = unary(u.op.typ, v); err != nil {
+		return nil, err
+	}
+	return v.Interface(), nil
 }
 
 type Compound struct {
 	children []Node
+	begin    *Token
+	end      *Token
 }
 
-func (c *Compound) Token() *Token {
-	panic("implement me")
-}
+func (c *Compound) Token() *Token { return c.begin }
 
-func (c *Compound) Value() (interface{}, error) {
-	panic("implement me")
-}
+func (c *Compound) Pos() Span { return Span{Start: c.begin.Pos().Start, End: c.end.Pos().End} }
+
+func (c *Compound) Value() (interface{}, error) { return nil, nil }
 
 type assign struct {
 	left  Node
@@ -89,49 +208,101 @@ type assign struct {
 	op    *Token
 }
 
-func (a *assign) Token() *Token {
-	panic("implement me")
-}
+func (a *assign) Token() *Token { return a.op }
 
-func (a *assign) Value() (interface{}, error) {
-	panic("implement me")
-}
+func (a *assign) Pos() Span { return spanOf(a.left, a.right) }
+
+func (a *assign) Value() (interface{}, error) { return nil, nil }
 
 type Var struct {
-	token *Token
-	value interface{}
+	token    *Token
+	value    interface{}
+	symbol   *varSymbol   // resolved by the semantic analyzer
+	call     *funcCall    // set instead of symbol when the name calls a parameterless function
+	constant *constSymbol // set instead of symbol when the name is a constant
+	with     *fieldVar    // set instead of symbol when the name is a field opened by a with statement
 }
 
 func (v *Var) Token() *Token {
 	return v.token
 }
 
+func (v *Var) Pos() Span { return v.token.Pos() }
+
 func (v *Var) Value() (interface{}, error) {
 	return v.value, nil
 }
 
-type NoOp struct{}
+// indexedVar selects an element of an array: a[i] or, for arrays of arrays,
+// a[i, j].
+type indexedVar struct {
+	array   Node
+	indices []Node
+	token   *Token // "["
+	end     *Token // "]"
+	typ     Symbol // element type, set by the semantic analyzer
+}
 
-func (n *NoOp) Token() *Token {
-	panic("implement me")
+func (v *indexedVar) Token() *Token { return v.token }
+
+func (v *indexedVar) Pos() Span { return Span{Start: v.array.Pos().Start, End: v.end.Pos().End} }
+
+func (v *indexedVar) Value() (interface{}, error) { return nil, nil }
+
+// fieldVar selects a field of a record: r.x.
+type fieldVar struct {
+	record Node
+	field  *Token
+	typ    Symbol // field type, set by the semantic analyzer
 }
 
-func (n *NoOp) Value() (interface{}, error) {
-	panic("implement me")
+func (v *fieldVar) Token() *Token { return v.field }
+
+func (v *fieldVar) Pos() Span { return Span{Start: v.record.Pos().Start, End: v.field.Pos().End} }
+
+func (v *fieldVar) Value() (interface{}, error) { return nil, nil }
+
+// rootVar returns the variable a selector chain such as a[i].x starts from,
+// or nil when it starts from something else.
+func rootVar(node Node) *Var {
+	for {
+		switch v := node.(type) {
+		case *Var:
+			return v
+		case *indexedVar:
+			node = v.array
+		case *fieldVar:
+			node = v.record
+		default:
+			return nil
+		}
+	}
+}
+
+// NoOp is an empty statement. It occupies no source text, so its span is empty
+// and sits where the statement would have started.
+type NoOp struct {
+	pos Position
 }
 
+func (n *NoOp) Token() *Token { return nil }
+
+func (n *NoOp) Pos() Span { return Span{Start: n.pos, End: n.pos} }
+
+func (n *NoOp) Value() (interface{}, error) { return nil, nil }
+
 type program struct {
 	name  string
 	block *block
+	token *Token // "program" keyword
+	end   *Token // final "."
 }
 
-func (p *program) Token() *Token {
-	panic("implement me")
-}
+func (p *program) Token() *Token { return p.token }
 
-func (p *program) Value() (interface{}, error) {
-	panic("implement me")
-}
+func (p *program) Pos() Span { return Span{Start: p.token.Pos().Start, End: p.end.Pos().End} }
+
+func (p *program) Value() (interface{}, error) { return nil, nil }
 
 type block struct {
 	declarations      []Node
@@ -139,26 +310,56 @@ type block struct {
 }
 
 func (b *block) Token() *Token {
-	panic("implement me")
+	if len(b.declarations) > 0 {
+		return b.declarations[0].Token()
+	}
+	return b.compoundStatement.Token()
 }
 
-func (b *block) Value() (interface{}, error) {
-	panic("implement me")
+func (b *block) Pos() Span {
+	if len(b.declarations) > 0 {
+		return spanOf(b.declarations[0], b.compoundStatement)
+	}
+	return b.compoundStatement.Pos()
 }
 
+func (b *block) Value() (interface{}, error) { return nil, nil }
+
 type varDecl struct {
 	varNode  Node
 	typeNode Node
 }
 
-func (v *varDecl) Token() *Token {
-	panic("implement me")
+func (v *varDecl) Token() *Token { return v.varNode.Token() }
+
+func (v *varDecl) Pos() Span { return spanOf(v.varNode, v.typeNode) }
+
+func (v *varDecl) Value() (interface{}, error) { return nil, nil }
+
+type constDecl struct {
+	name *Token
+	expr Node
 }
 
-func (v *varDecl) Value() (interface{}, error) {
-	panic("implement me")
+func (c *constDecl) Token() *Token { return c.name }
+
+func (c *constDecl) Pos() Span { return Span{Start: c.name.Pos().Start, End: c.expr.Pos().End} }
+
+func (c *constDecl) Value() (interface{}, error) { return nil, nil }
+
+type typeDecl struct {
+	name     *Token
+	typeNode Node
 }
 
+func (t *typeDecl) Token() *Token { return t.name }
+
+func (t *typeDecl) Pos() Span { return Span{Start: t.name.Pos().Start, End: t.typeNode.Pos().End} }
+
+func (t *typeDecl) Value() (interface{}, error) { return nil, nil }
+
+// typeNode names a type: one of the builtin type keywords or an identifier
+// declared in a type section.
 type typeNode struct {
 	token *Token
 	value interface{}
@@ -168,37 +369,292 @@ func (t *typeNode) Token() *Token {
 	return t.token
 }
 
+func (t *typeNode) Pos() Span { return t.token.Pos() }
+
 func (t *typeNode) Value() (interface{}, error) {
 	return t.value, nil
 }
 
-type procDecl struct {
-	procName string
-	params   []*param
-	block    *block
+// enumType is an enumerated type such as (Red, Green, Blue).
+type enumType struct {
+	names  []*Token
+	token  *Token      // "("
+	end    *Token      // ")"
+	symbol *enumSymbol // resolved by the semantic analyzer
+}
+
+func (e *enumType) Token() *Token { return e.token }
+
+func (e *enumType) Pos() Span { return Span{Start: e.token.Pos().Start, End: e.end.Pos().End} }
+
+func (e *enumType) Value() (interface{}, error) { return nil, nil }
+
+// subrangeType is a lo..hi range of constants of an ordinal type.
+type subrangeType struct {
+	lo, hi Node
+	symbol *subrangeSymbol // resolved by the semantic analyzer
+}
+
+func (s *subrangeType) Token() *Token { return s.lo.Token() }
+
+func (s *subrangeType) Pos() Span { return spanOf(s.lo, s.hi) }
+
+func (s *subrangeType) Value() (interface{}, error) { return nil, nil }
+
+// arrayType is array[lo..hi, ...] of elem, or array of elem for a dynamic
+// array whose length is set at runtime.
+type arrayType struct {
+	indices []Node // empty for a dynamic array
+	elem    Node
+	token   *Token // "array" keyword
+	symbol  *arraySymbol
 }
 
-func (p *procDecl) Token() *Token { panic("implement me") }
+func (a *arrayType) Token() *Token { return a.token }
+
+func (a *arrayType) Pos() Span { return Span{Start: a.token.Pos().Start, End: a.elem.Pos().End} }
 
-func (p *procDecl) Value() (interface{}, error) {
-	panic("implement me")
+func (a *arrayType) Value() (interface{}, error) { return nil, nil }
+
+// recordType is record field declarations end. The fixed fields may be
+// followed by a variant part.
+type recordType struct {
+	fields  []Node // *varDecl
+	variant *variantPart
+	token   *Token // "record" keyword
+	end     *Token // "end" keyword
+	symbol  *recordSymbol
 }
 
+func (r *recordType) Token() *Token { return r.token }
+
+func (r *recordType) Pos() Span { return Span{Start: r.token.Pos().Start, End: r.end.Pos().End} }
+
+func (r *recordType) Value() (interface{}, error) { return nil, nil }
+
+// variantPart is case tag : Kind of ... at the end of a record's field list.
+type variantPart struct {
+	tag      *Token // nil when the variant part has no tag field
+	tagType  *typeNode
+	variants []*variant
+	token    *Token // "case" keyword
+}
+
+func (v *variantPart) Token() *Token { return v.token }
+
+func (v *variantPart) Pos() Span {
+	return Span{Start: v.token.Pos().Start, End: v.variants[len(v.variants)-1].end.Pos().End}
+}
+
+func (v *variantPart) Value() (interface{}, error) { return nil, nil }
+
+// variant is one labels: (fields) arm of a variant part.
+type variant struct {
+	labels  []*caseLabel
+	fields  []Node       // *varDecl
+	variant *variantPart // nested variant part, nil if there is none
+	end     *Token       // ")"
+}
+
+func (v *variant) Token() *Token { return v.labels[0].Token() }
+
+func (v *variant) Pos() Span { return Span{Start: v.labels[0].Pos().Start, End: v.end.Pos().End} }
+
+func (v *variant) Value() (interface{}, error) { return nil, nil }
+
+type procDecl struct {
+	procName   string
+	params     []*param
+	returnType *typeNode // nil for procedures
+	block      *block    // nil for a forward declaration
+	token      *Token    // "procedure" or "function" keyword
+	name       *Token
+	end        *Token // terminating ";"
+}
+
+func (p *procDecl) Token() *Token { return p.token }
+
+func (p *procDecl) Pos() Span { return Span{Start: p.token.Pos().Start, End: p.end.Pos().End} }
+
+func (p *procDecl) Value() (interface{}, error) { return nil, nil }
+
 type param struct {
 	varNode  *Var
 	typeNode *typeNode
+	mode     paramMode
+}
+
+func (p *param) Token() *Token { return p.varNode.Token() }
+
+func (p *param) Pos() Span { return spanOf(p.varNode, p.typeNode) }
+
+func (p *param) Value() (interface{}, error) { return nil, nil }
+
+type procCall struct {
+	procName     string
+	actualParams []Node
+	token        *Token
+	end          *Token           // closing ")" or the name itself when there are no arguments
+	procSymbol   *procedureSymbol // resolved by the semantic analyzer
+	builtin      *builtinSymbol   // set instead of procSymbol for a predeclared routine
+	typ          Symbol           // result type of a builtin function call
+	argTypes     []Symbol         // argument types of read, readln, write and writeln
+}
+
+func (p *procCall) Token() *Token { return p.token }
+
+func (p *procCall) Pos() Span { return Span{Start: p.token.Pos().Start, End: p.end.Pos().End} }
+
+func (p *procCall) Value() (interface{}, error) { return nil, nil }
+
+// formatArg is an argument of write or writeln with a field width and, for
+// reals, the number of decimals, as in x:8:2.
+type formatArg struct {
+	expr      Node
+	width     Node
+	precision Node // nil when only the width is given
+	colon     *Token
+}
+
+func (f *formatArg) Token() *Token { return f.expr.Token() }
+
+func (f *formatArg) Pos() Span {
+	last := f.width
+	if f.precision != nil {
+		last = f.precision
+	}
+	return Span{Start: f.expr.Pos().Start, End: last.Pos().End}
+}
+
+func (f *formatArg) Value() (interface{}, error) { return nil, nil }
+
+// resultType returns the type of the value the call yields, nil for procedures.
+func (p *procCall) resultType() Symbol {
+	if p.builtin != nil {
+		return p.typ
+	}
+	return p.procSymbol.Type()
+}
+
+// funcCall is a call that appears inside an expression and yields the
+// function's result.
+type funcCall struct {
+	procCall
+}
+
+type ifStmt struct {
+	cond     Node
+	then     Node
+	elseStmt Node // nil without an else branch
+	token    *Token
 }
 
-func (p *param) Token() *Token { panic("implement me") }
+func (i *ifStmt) Token() *Token { return i.token }
+
+func (i *ifStmt) Pos() Span {
+	last := i.then
+	if i.elseStmt != nil {
+		last = i.elseStmt
+	}
+	return Span{Start: i.token.Pos().Start, End: last.Pos().End}
+}
 
-func (p *param) Value() (interface{}, error) { panic("implement me") }
+func (i *ifStmt) Value() (interface{}, error) { return nil, nil }
 
-type procedureDecl struct {
-	procName  string
-	params    []*param
-	blockNode *block
+type whileStmt struct {
+	cond  Node
+	body  Node
+	token *Token
 }
 
-func (p *procedureDecl) Token() *Token { panic("implement me") }
+func (w *whileStmt) Token() *Token { return w.token }
+
+func (w *whileStmt) Pos() Span { return Span{Start: w.token.Pos().Start, End: w.body.Pos().End} }
+
+func (w *whileStmt) Value() (interface{}, error) { return nil, nil }
+
+type repeatStmt struct {
+	body  []Node
+	cond  Node
+	token *Token
+}
+
+func (r *repeatStmt) Token() *Token { return r.token }
+
+func (r *repeatStmt) Pos() Span { return Span{Start: r.token.Pos().Start, End: r.cond.Pos().End} }
+
+func (r *repeatStmt) Value() (interface{}, error) { return nil, nil }
+
+type forStmt struct {
+	variable *Var
+	start    Node
+	end      Node
+	downto   bool
+	body     Node
+	token    *Token
+}
+
+func (f *forStmt) Token() *Token { return f.token }
+
+func (f *forStmt) Pos() Span { return Span{Start: f.token.Pos().Start, End: f.body.Pos().End} }
+
+func (f *forStmt) Value() (interface{}, error) { return nil, nil }
+
+// withStmt is with r1, r2 do body. The fields of each record can be named
+// directly inside the body.
+type withStmt struct {
+	records []Node
+	body    Node
+	token   *Token
+	vars    []*varSymbol // hidden variables holding the records, set by the semantic analyzer
+}
+
+func (w *withStmt) Token() *Token { return w.token }
+
+func (w *withStmt) Pos() Span { return Span{Start: w.token.Pos().Start, End: w.body.Pos().End} }
+
+func (w *withStmt) Value() (interface{}, error) { return nil, nil }
+
+// caseLabel is a single constant or a lo..hi range of constants. The semantic
+// analyzer fills in the ordinal bounds.
+type caseLabel struct {
+	lo, hi Node // hi is nil for a single constant
+	low    int
+	high   int
+}
+
+func (c *caseLabel) Token() *Token { return c.lo.Token() }
+
+func (c *caseLabel) Pos() Span {
+	if c.hi != nil {
+		return spanOf(c.lo, c.hi)
+	}
+	return c.lo.Pos()
+}
+
+func (c *caseLabel) Value() (interface{}, error) { return nil, nil }
+
+type caseBranch struct {
+	labels []*caseLabel
+	body   Node
+}
+
+func (c *caseBranch) Token() *Token { return c.labels[0].Token() }
+
+func (c *caseBranch) Pos() Span { return Span{Start: c.labels[0].Pos().Start, End: c.body.Pos().End} }
+
+func (c *caseBranch) Value() (interface{}, error) { return nil, nil }
+
+type caseStmt struct {
+	selector Node
+	branches []*caseBranch
+	elseBody []Node // nil without an else part
+	token    *Token
+	end      *Token
+}
+
+func (c *caseStmt) Token() *Token { return c.token }
+
+func (c *caseStmt) Pos() Span { return Span{Start: c.token.Pos().Start, End: c.end.Pos().End} }
 
-func (p *procedureDecl) Value() (interface{}, error) { panic("implement me") }
+func (c *caseStmt) Value() (interface{}, error) { return nil, nil }
@@ -0,0 +1,283 @@
+package calc5
+
+import (
+	"fmt"
+	"github.com/IngvarListard/pascal-go-intepreter/pkg/calc5/errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// builtinSymbol is a predeclared procedure or function implemented in Go. A
+// program may declare its own routine with the same name, which then hides
+// the builtin.
+type builtinSymbol struct {
+	name string
+}
+
+func (b *builtinSymbol) Name() string { return b.name }
+
+func (b *builtinSymbol) Type() Symbol { return nil }
+
+func (b *builtinSymbol) String() string { return fmt.Sprintf("<builtin %s>", b.name) }
+
+var builtins = map[string]*builtinSymbol{
+	"chr":       {name: "chr"},
+	"concat":    {name: "concat"},
+	"copy":      {name: "copy"},
+	"delete":    {name: "delete"},
+	"insert":    {name: "insert"},
+	"length":    {name: "length"},
+	"ord":       {name: "ord"},
+	"pos":       {name: "pos"},
+	"read":      {name: "read"},
+	"readln":    {name: "readln"},
+	"setlength": {name: "setlength"},
+	"upcase":    {name: "upcase"},
+	"write":     {name: "write"},
+	"writeln":   {name: "writeln"},
+}
+
+func isInteger(typ Symbol) bool {
+	typ = baseType(typ)
+	return typ != nil && typ.Name() == "integer"
+}
+
+func isReal(typ Symbol) bool {
+	typ = baseType(typ)
+	return typ != nil && typ.Name() == "real"
+}
+
+func isDynamicArray(typ Symbol) bool {
+	arr, ok := typ.(*arraySymbol)
+	return ok && arr.index == nil
+}
+
+// hasLength reports whether length accepts a value of type typ.
+func hasLength(typ Symbol) bool {
+	_, ok := typ.(*arraySymbol)
+	return ok || isText(typ)
+}
+
+// visitBuiltinCall checks the arguments of a call to a builtin routine and
+// records the result type of builtin functions.
+func (sb *SemanticAnalyzer) visitBuiltinCall(node *procCall, builtin *builtinSymbol) error {
+	node.builtin = builtin
+	switch builtin.name {
+	case "write", "writeln":
+		return sb.visitWriteCall(node)
+	case "read", "readln":
+		return sb.visitReadCall(node)
+	}
+	args := make([]Symbol, len(node.actualParams))
+	for i, arg := range node.actualParams {
+		if err := sb.VisitNode(arg); err != nil {
+			return err
+		}
+		args[i] = sb.exprType(arg)
+	}
+
+	var err error
+	switch builtin.name {
+	case "length":
+		err = sb.checkArgs(node, args, hasLength)
+		node.typ = sb.lookup("integer", false)
+	case "setlength":
+		err = sb.checkArgs(node, args, isDynamicArray, isInteger)
+		if err == nil {
+			err = sb.visitTarget(node.actualParams[0])
+		}
+	case "copy":
+		err = sb.checkArgs(node, args, isText, isInteger, isInteger)
+		node.typ = sb.lookup("string", false)
+	case "pos":
+		err = sb.checkArgs(node, args, isText, isText)
+		node.typ = sb.lookup("integer", false)
+	case "concat":
+		checks := []func(Symbol) bool{isText}
+		for len(checks) < len(args) {
+			checks = append(checks, isText)
+		}
+		err = sb.checkArgs(node, args, checks...)
+		node.typ = sb.lookup("string", false)
+	case "insert":
+		err = sb.checkArgs(node, args, isText, isString, isInteger)
+		if err == nil {
+			err = sb.visitTarget(node.actualParams[1])
+		}
+	case "delete":
+		err = sb.checkArgs(node, args, isString, isInteger, isInteger)
+		if err == nil {
+			err = sb.visitTarget(node.actualParams[0])
+		}
+	case "upcase":
+		err = sb.checkArgs(node, args, isText)
+		node.typ = sb.lookup("char", false)
+		if err == nil && isString(args[0]) {
+			node.typ = sb.lookup("string", false)
+		}
+	case "ord":
+		err = sb.checkArgs(node, args, isOrdinal)
+		node.typ = sb.lookup("integer", false)
+	case "chr":
+		err = sb.checkArgs(node, args, isInteger)
+		node.typ = sb.lookup("char", false)
+	}
+	return err
+}
+
+// checkArgs reports a wrong number of arguments or the first argument whose
+// type fails its check.
+func (sb *SemanticAnalyzer) checkArgs(node *procCall, args []Symbol, checks ...func(Symbol) bool) error {
+	if len(args) != len(checks) {
+		return sb.error(errors.WrongParamsNum, node.token, "checkArgs")
+	}
+	for i, check := range checks {
+		if !check(args[i]) {
+			return sb.error(errors.IncompatibleTypes, node.actualParams[i].Token(), "checkArgs")
+		}
+	}
+	return nil
+}
+
+// callBuiltin runs a builtin routine and returns its result, or an undefined
+// value for procedures. Routines that modify an argument store the new value
+// back into the variable passed.
+func (i *Interpreter) callBuiltin(node *procCall) (Value, error) {
+	switch node.builtin.name {
+	case "write", "writeln":
+		return Value{}, i.write(node)
+	case "read", "readln":
+		return Value{}, i.read(node)
+	}
+	args := make([]Value, len(node.actualParams))
+	for idx, arg := range node.actualParams {
+		v, err := i.VisitNode(arg)
+		if err != nil {
+			return Value{}, err
+		}
+		args[idx] = v
+	}
+	v, err := applyBuiltin(node.builtin.name, args)
+	if err != nil {
+		return Value{}, positioned(err, atNode(builtinErrorNode(node)))
+	}
+	if n := modifiedArg(node.builtin.name); n >= 0 {
+		return Value{}, i.assignTo(node.actualParams[n], v, node.token)
+	}
+	return v, nil
+}
+
+// modifiedArg returns the index of the argument a builtin procedure stores
+// its result into, or -1 when it has none.
+func modifiedArg(name string) int {
+	switch name {
+	case "insert":
+		return 1
+	case "delete":
+		return 0
+	}
+	return -1
+}
+
+// builtinErrorNode returns the node a failed call is reported at: the
+// argument that is out of range, or the call itself.
+func builtinErrorNode(node *procCall) Node {
+	switch node.builtin.name {
+	case "setlength":
+		return node.actualParams[1]
+	case "chr":
+		return node.actualParams[0]
+	}
+	return node
+}
+
+// applyBuiltin computes a builtin function from its evaluated arguments. For
+// insert and delete it returns the new string to store, and errors carry no
+// position.
+func applyBuiltin(name string, args []Value) (Value, error) {
+	switch name {
+	case "length":
+		if args[0].kind == kindArray {
+			return intVal(len(args[0].array().elems)), nil
+		}
+		s, _ := args[0].text()
+		return intVal(utf8.RuneCountInString(s)), nil
+	case "setlength":
+		n := args[1].Int()
+		if n < 0 {
+			return Value{}, errors.NewRuntimeError(fmt.Sprintf("negative array length %d", n), "applyBuiltin",
+				errors.ErrorCode(errors.OutOfRange),
+			)
+		}
+		return Value{}, args[0].array().resize(n)
+	case "copy":
+		s, _ := args[0].text()
+		runes := []rune(s)
+		from, to := clamp(args[1].Int(), args[2].Int(), len(runes))
+		return strVal(string(runes[from:to])), nil
+	case "pos":
+		sub, _ := args[0].text()
+		s, _ := args[1].text()
+		idx := strings.Index(s, sub)
+		if sub == "" || idx < 0 {
+			return intVal(0), nil
+		}
+		return intVal(utf8.RuneCountInString(s[:idx]) + 1), nil
+	case "concat":
+		var b strings.Builder
+		for _, arg := range args {
+			s, _ := arg.text()
+			b.WriteString(s)
+		}
+		return strVal(b.String()), nil
+	case "insert":
+		source, _ := args[0].text()
+		runes := []rune(args[1].Str())
+		at, _ := clamp(args[2].Int(), 0, len(runes))
+		s := string(runes[:at]) + source + string(runes[at:])
+		return strVal(s), nil
+	case "delete":
+		runes := []rune(args[0].Str())
+		from, to := clamp(args[1].Int(), args[2].Int(), len(runes))
+		s := string(runes[:from]) + string(runes[to:])
+		return strVal(s), nil
+	case "upcase":
+		if args[0].kind == kindChar {
+			return charVal(unicode.ToUpper(args[0].Char())), nil
+		}
+		return strVal(strings.ToUpper(args[0].Str())), nil
+	case "ord":
+		return intVal(ordinal(args[0])), nil
+	case "chr":
+		n := args[0].Int()
+		if n < 0 || n > unicode.MaxRune {
+			return Value{}, errors.NewRuntimeError(fmt.Sprintf("chr(%d) is not a character", n), "applyBuiltin",
+				errors.ErrorCode(errors.OutOfRange),
+			)
+		}
+		return charVal(rune(n)), nil
+	}
+	return Value{}, errors.NewRuntimeError(fmt.Sprintf("unknown builtin %s", name), "applyBuiltin")
+}
+
+// clamp converts the 1-based start index and count of a substring of a
+// string with n characters into slice bounds, cutting the substring to what
+// the string holds.
+func clamp(index, count, n int) (from, to int) {
+	from = index - 1
+	if from < 0 {
+		from = 0
+	}
+	if from > n {
+		from = n
+	}
+	to = from + count
+	if count < 0 || to < from {
+		to = from
+	}
+	if to > n {
+		to = n
+	}
+	return from, to
+}
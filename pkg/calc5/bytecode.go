@@ -0,0 +1,149 @@
+package calc5
+
+import "fmt"
+
+// opcode is the operation of a bytecode instruction. The comments describe
+// the operands a and b and the effect on the operand stack.
+type opcode uint8
+
+const (
+	opConst      opcode = iota // push constant a
+	opPop                      // drop the top value
+	opDup                      // push a copy of the top value
+	opLoadLocal                // push local variable a
+	opStoreLocal               // pop into local variable a
+	opLoad                     // push variable a of the record at nesting level b
+	opStore                    // pop into variable a of the record at nesting level b
+	opRef                      // push a reference to variable a at nesting level b
+	opInit                     // give local variable a the initial value of type b
+	opClear                    // make local variable a unassigned
+	opConvert                  // prepare the top value for a variable of type a
+	opBinary                   // pop two operands and push their combination by operator a
+	opUnary                    // apply operator a to the top value
+	opAddInt                   // integer arithmetic and ordinal comparisons on the top two values
+	opSubInt
+	opMulInt
+	opDivInt
+	opEqual
+	opNotEqual
+	opLess
+	opLessEqual
+	opGreater
+	opGreaterEqual
+	opJump       // continue at a
+	opJumpFalse  // pop a condition and continue at a when it is false
+	opAndJump    // continue at a keeping the top value when it is false, else pop it
+	opOrJump     // continue at a keeping the top value when it is true, else pop it
+	opIndex      // pop an index and an array or string and push the element
+	opDefined    // fail unless the array element on top has been assigned
+	opStoreElem  // pop an index, an array and a value and store the value as the element
+	opSetChar    // pop an index, a string and a char and push the string with that char replaced
+	opRefElem    // pop an index and an array and push a reference to the element
+	opField      // pop a record and push its field named by constant a
+	opStoreField // pop a record and a value and store the value in field a
+	opRefField   // pop a record and push a reference to field a
+	opCall       // call procedure a with its arguments on the stack
+	opReturn     // leave the procedure, pushing the result of a function
+	opBuiltin    // call the builtin named by constant a with b arguments and push the result
+	opWrite      // pop a value, preceded by a width if b&1 and decimals if b&2, and buffer it as type a
+	opFlush      // print the buffered output, followed by a line break if a is 1
+	opRead       // push a value of type a read from the input
+	opReadln     // skip the rest of the input line
+	opForPrep    // turn the bounds on top into loop state, or pop them and continue at a when the range is empty; b is 1 for downto
+	opForNext    // step the loop state and continue at a, or pop it once the last value is done; b is 1 for downto
+	opCase       // pop a selector and continue where case table a sends it
+)
+
+var opcodeNames = [...]string{
+	opConst:        "CONST",
+	opPop:          "POP",
+	opDup:          "DUP",
+	opLoadLocal:    "LOADL",
+	opStoreLocal:   "STOREL",
+	opLoad:         "LOAD",
+	opStore:        "STORE",
+	opRef:          "REF",
+	opInit:         "INIT",
+	opClear:        "CLEAR",
+	opConvert:      "CONVERT",
+	opBinary:       "BINARY",
+	opUnary:        "UNARY",
+	opAddInt:       "ADDI",
+	opSubInt:       "SUBI",
+	opMulInt:       "MULI",
+	opDivInt:       "DIVI",
+	opEqual:        "EQ",
+	opNotEqual:     "NE",
+	opLess:         "LT",
+	opLessEqual:    "LE",
+	opGreater:      "GT",
+	opGreaterEqual: "GE",
+	opJump:         "JUMP",
+	opJumpFalse:    "JUMPF",
+	opAndJump:      "ANDJ",
+	opOrJump:       "ORJ",
+	opIndex:        "INDEX",
+	opDefined:      "DEFINED",
+	opStoreElem:    "STOREE",
+	opSetChar:      "SETCHAR",
+	opRefElem:      "REFE",
+	opField:        "FIELD",
+	opStoreField:   "STOREF",
+	opRefField:     "REFF",
+	opCall:         "CALL",
+	opReturn:       "RET",
+	opBuiltin:      "BUILTIN",
+	opWrite:        "WRITE",
+	opFlush:        "FLUSH",
+	opRead:         "READ",
+	opReadln:       "READLN",
+	opForPrep:      "FORPREP",
+	opForNext:      "FORNEXT",
+	opCase:         "CASE",
+}
+
+func (op opcode) String() string {
+	if int(op) < len(opcodeNames) && opcodeNames[op] != "" {
+		return opcodeNames[op]
+	}
+	return fmt.Sprintf("opcode(%d)", int(op))
+}
+
+// instr is one bytecode instruction.
+type instr struct {
+	op   opcode
+	a, b int32
+}
+
+// procCode is the compiled body of the program or of one procedure.
+type procCode struct {
+	name   string
+	level  int          // nesting level of the activation record the code runs in
+	params []int        // slots the arguments are stored in, in order
+	result int          // slot of the function result, -1 for procedures and the program
+	vars   []*varSymbol // the variables of the slots, in slot order
+	code   []instr
+	pos    []Position // source position of each instruction, for error reports
+}
+
+// caseTable maps the ordinal of a case selector to the code of its branch.
+type caseTable struct {
+	ranges []caseRange
+	other  int // target when no range matches
+}
+
+type caseRange struct {
+	low, high int
+	target    int
+}
+
+// bytecode is a compiled program. procs[0] is the main program; opCall and
+// the other instructions refer to procedures, constants, types and case
+// tables by their index here.
+type bytecode struct {
+	procs  []*procCode
+	consts []Value
+	types  []Symbol
+	cases  []caseTable
+	source string // program text, kept for the disassembler
+}
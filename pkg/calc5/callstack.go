@@ -0,0 +1,101 @@
+package calc5
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+type arType int
+
+const (
+	arProgram arType = iota
+	arProcedure
+)
+
+func (t arType) String() string {
+	switch t {
+	case arProgram:
+		return "PROGRAM"
+	case arProcedure:
+		return "PROCEDURE"
+	default:
+		return fmt.Sprintf("arType(%d)", int(t))
+	}
+}
+
+// activationRecord holds the locals of one running program or procedure. A
+// variable lives in the slot the semantic analyzer gave its symbol; an
+// undefined slot has not been assigned yet.
+type activationRecord struct {
+	name         string
+	typ          arType
+	nestingLevel int
+	vars         []*varSymbol // the variables of the slots, in slot order
+	slots        []Value
+	accessLink   *activationRecord // record of the routine the procedure is declared in
+}
+
+func newActivationRecord(name string, typ arType, nestingLevel int, vars []*varSymbol) *activationRecord {
+	return &activationRecord{
+		name:         name,
+		typ:          typ,
+		nestingLevel: nestingLevel,
+		vars:         vars,
+		slots:        make([]Value, len(vars)),
+	}
+}
+
+// enclosing follows access links from ar to the record at the given nesting
+// level, which is where a variable declared at that level lives. Access links
+// point at the record of the declaring routine rather than of the caller, so
+// the right frame is found even when the procedure was reached through
+// recursion or a call from a sibling.
+func (ar *activationRecord) enclosing(nestingLevel int) *activationRecord {
+	for ar != nil && ar.nestingLevel > nestingLevel {
+		ar = ar.accessLink
+	}
+	return ar
+}
+
+func (ar *activationRecord) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d: %s %s\n", ar.nestingLevel, ar.typ, ar.name)
+
+	vars := make([]*varSymbol, 0, len(ar.vars))
+	for _, v := range ar.vars {
+		if ar.slots[v.slot].defined() {
+			vars = append(vars, v)
+		}
+	}
+	sort.Slice(vars, func(i, j int) bool { return vars[i].name < vars[j].name })
+	for _, v := range vars {
+		fmt.Fprintf(&buf, "   %-20s: %v\n", v.name, ar.slots[v.slot])
+	}
+	return buf.String()
+}
+
+type callStack struct {
+	records []*activationRecord
+}
+
+func (s *callStack) push(ar *activationRecord) { s.records = append(s.records, ar) }
+
+func (s *callStack) pop() *activationRecord {
+	ar := s.records[len(s.records)-1]
+	s.records = s.records[:len(s.records)-1]
+	return ar
+}
+
+func (s *callStack) peek() *activationRecord { return s.records[len(s.records)-1] }
+
+func (s *callStack) depth() int { return len(s.records) }
+
+func (s *callStack) String() string {
+	var buf bytes.Buffer
+	buf.WriteString("CALL STACK\n")
+	for i := len(s.records) - 1; i >= 0; i-- {
+		buf.WriteString(s.records[i].String())
+	}
+	return buf.String()
+}
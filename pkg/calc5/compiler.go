@@ -0,0 +1,472 @@
+package calc5
+
+// compiler translates a checked program into bytecode. Procedures are compiled
+// when the first call to them is found, so routines that are never called
+// produce no code.
+type compiler struct {
+	global  *ScopedSymbolTable // where builtin types are looked up
+	prog    *bytecode
+	proc    *procCode // procedure being compiled
+	procs   map[*procedureSymbol]int
+	pending []*procedureSymbol // called procedures still to compile
+	consts  map[Value]int
+	types   map[Symbol]int
+}
+
+// compile returns the bytecode for node, which the semantic analyzer sb has
+// already checked.
+func compile(node *program, sb *SemanticAnalyzer) *bytecode {
+	c := &compiler{
+		global: sb.global,
+		prog:   &bytecode{},
+		procs:  make(map[*procedureSymbol]int),
+		consts: make(map[Value]int),
+		types:  make(map[Symbol]int),
+	}
+	c.proc = &procCode{name: node.name, level: 1, result: -1, vars: sb.global.vars}
+	c.prog.procs = append(c.prog.procs, c.proc)
+	c.block(node.block)
+	c.emit(opReturn, 0, 0, node.end.Pos().Start)
+
+	for len(c.pending) > 0 {
+		sym := c.pending[0]
+		c.pending = c.pending[1:]
+		c.proc = c.prog.procs[c.procs[sym]]
+		c.block(sym.block)
+		c.emit(opReturn, 0, 0, sym.block.compoundStatement.end.Pos().Start)
+	}
+	return c.prog
+}
+
+// exprType returns the type the semantic analyzer gave the expression node.
+func (c *compiler) exprType(node Node) Symbol {
+	return exprType(node, c.global)
+}
+
+func (c *compiler) emit(op opcode, a, b int, pos Position) int {
+	c.proc.code = append(c.proc.code, instr{op: op, a: int32(a), b: int32(b)})
+	c.proc.pos = append(c.proc.pos, pos)
+	return len(c.proc.code) - 1
+}
+
+// here returns the address of the next instruction.
+func (c *compiler) here() int { return len(c.proc.code) }
+
+// patch makes the jump at addr continue at the next instruction.
+func (c *compiler) patch(addr int) { c.proc.code[addr].a = int32(c.here()) }
+
+func (c *compiler) constant(v Value) int {
+	if idx, ok := c.consts[v]; ok {
+		return idx
+	}
+	c.prog.consts = append(c.prog.consts, v)
+	c.consts[v] = len(c.prog.consts) - 1
+	return len(c.prog.consts) - 1
+}
+
+func (c *compiler) typeIndex(typ Symbol) int {
+	if idx, ok := c.types[typ]; ok {
+		return idx
+	}
+	c.prog.types = append(c.prog.types, typ)
+	c.types[typ] = len(c.prog.types) - 1
+	return len(c.prog.types) - 1
+}
+
+// procIndex returns the index of the code of sym, scheduling it for
+// compilation the first time.
+func (c *compiler) procIndex(sym *procedureSymbol) int {
+	if idx, ok := c.procs[sym]; ok {
+		return idx
+	}
+	proc := &procCode{name: sym.name, level: sym.level, result: -1, vars: sym.vars}
+	for _, param := range sym.params {
+		proc.params = append(proc.params, param.(*varSymbol).slot)
+	}
+	if sym.result != nil {
+		proc.result = sym.result.slot
+	}
+	c.prog.procs = append(c.prog.procs, proc)
+	c.procs[sym] = len(c.prog.procs) - 1
+	c.pending = append(c.pending, sym)
+	return len(c.prog.procs) - 1
+}
+
+// convert emits a conversion of the top value for a variable of type typ
+// unless values of that type are stored as they are.
+func (c *compiler) convert(typ Symbol, token *Token) {
+	switch t := typ.(type) {
+	case *subrangeSymbol, *arraySymbol, *recordSymbol:
+	case *builtinTypeSymbol:
+		if t.name != "real" && t.name != "string" {
+			return
+		}
+	default:
+		return
+	}
+	c.emit(opConvert, c.typeIndex(typ), 0, token.Pos().Start)
+}
+
+func (c *compiler) block(node *block) {
+	for _, declaration := range node.declarations {
+		decl, ok := declaration.(*varDecl)
+		if !ok {
+			continue
+		}
+		symbol := decl.varNode.(*Var).symbol
+		typ := symbol.Type()
+		switch typ.(type) {
+		case *arraySymbol, *recordSymbol:
+		default:
+			if !isString(typ) {
+				continue
+			}
+		}
+		c.emit(opInit, symbol.slot, c.typeIndex(typ), decl.Pos().Start)
+	}
+	c.statement(node.compoundStatement)
+}
+
+func (c *compiler) statement(node Node) {
+	switch v := node.(type) {
+	case *Compound:
+		for _, child := range v.children {
+			c.statement(child)
+		}
+	case *NoOp:
+	case *assign:
+		c.expr(v.right)
+		c.store(v.left, v.op)
+	case *procCall:
+		if c.call(v) {
+			c.emit(opPop, 0, 0, v.token.Pos().Start)
+		}
+	case *ifStmt:
+		c.condition(v.cond)
+		jump := c.emit(opJumpFalse, 0, 0, v.cond.Token().Pos().Start)
+		c.statement(v.then)
+		if v.elseStmt != nil {
+			end := c.emit(opJump, 0, 0, v.token.Pos().Start)
+			c.patch(jump)
+			c.statement(v.elseStmt)
+			jump = end
+		}
+		c.patch(jump)
+	case *whileStmt:
+		loop := c.here()
+		c.condition(v.cond)
+		exit := c.emit(opJumpFalse, 0, 0, v.cond.Token().Pos().Start)
+		c.statement(v.body)
+		c.emit(opJump, loop, 0, v.token.Pos().Start)
+		c.patch(exit)
+	case *repeatStmt:
+		loop := c.here()
+		for _, child := range v.body {
+			c.statement(child)
+		}
+		c.condition(v.cond)
+		c.emit(opJumpFalse, loop, 0, v.cond.Token().Pos().Start)
+	case *forStmt:
+		c.forStatement(v)
+	case *caseStmt:
+		c.caseStatement(v)
+	case *withStmt:
+		for idx, record := range v.records {
+			c.expr(record)
+			c.emit(opStoreLocal, v.vars[idx].slot, 0, record.Pos().Start)
+		}
+		c.statement(v.body)
+		for _, hidden := range v.vars {
+			c.emit(opClear, hidden.slot, 0, v.token.Pos().Start)
+		}
+	}
+}
+
+// condition compiles an expression the semantic analyzer proved boolean.
+func (c *compiler) condition(node Node) { c.expr(node) }
+
+// forStatement keeps the last ordinal and the current value of the control
+// variable on the stack while the loop runs.
+func (c *compiler) forStatement(node *forStmt) {
+	downto := 0
+	if node.downto {
+		downto = 1
+	}
+	c.expr(node.start)
+	c.expr(node.end)
+	prep := c.emit(opForPrep, 0, downto, node.token.Pos().Start)
+	loop := c.here()
+	c.emit(opDup, 0, 0, node.variable.token.Pos().Start)
+	c.convert(node.variable.symbol.Type(), node.variable.token)
+	c.storeVar(node.variable.symbol, node.variable.token)
+	c.statement(node.body)
+	c.emit(opForNext, loop, downto, node.token.Pos().Start)
+	c.patch(prep)
+}
+
+func (c *compiler) caseStatement(node *caseStmt) {
+	c.expr(node.selector)
+	table := len(c.prog.cases)
+	c.prog.cases = append(c.prog.cases, caseTable{})
+	c.emit(opCase, table, 0, node.token.Pos().Start)
+
+	var ranges []caseRange
+	var exits []int
+	for _, branch := range node.branches {
+		for _, label := range branch.labels {
+			ranges = append(ranges, caseRange{low: label.low, high: label.high, target: c.here()})
+		}
+		c.statement(branch.body)
+		exits = append(exits, c.emit(opJump, 0, 0, node.token.Pos().Start))
+	}
+	other := c.here()
+	for _, child := range node.elseBody {
+		c.statement(child)
+	}
+	for _, exit := range exits {
+		c.patch(exit)
+	}
+	c.prog.cases[table] = caseTable{ranges: ranges, other: other}
+}
+
+// expr compiles an expression that leaves its value on the stack.
+func (c *compiler) expr(node Node) {
+	switch v := node.(type) {
+	case *Num:
+		value, _ := valueOf(v.value)
+		c.emit(opConst, c.constant(value), 0, v.Pos().Start)
+	case *boolConst:
+		c.emit(opConst, c.constant(boolVal(v.value)), 0, v.Pos().Start)
+	case *strConst:
+		c.emit(opConst, c.constant(textVal(v.value)), 0, v.Pos().Start)
+	case *Var:
+		switch {
+		case v.constant != nil:
+			c.emit(opConst, c.constant(v.constant.value), 0, v.Pos().Start)
+		case v.with != nil:
+			c.expr(v.with)
+		case v.call != nil:
+			c.call(&v.call.procCall)
+		default:
+			c.loadVar(v.symbol, v.token)
+		}
+	case *indexedVar:
+		typ := c.exprType(v.array)
+		c.expr(v.array)
+		for _, index := range v.indices {
+			c.expr(index)
+			c.emit(opIndex, 0, 0, index.Pos().Start)
+			if arr, ok := typ.(*arraySymbol); ok {
+				c.emit(opDefined, 0, 0, v.Pos().Start)
+				typ = arr.elem
+			}
+		}
+	case *fieldVar:
+		c.expr(v.record)
+		c.emit(opField, c.constant(strVal(v.field.value.(string))), 0, v.field.Pos().Start)
+	case *funcCall:
+		c.call(&v.procCall)
+	case *UnaryOp:
+		c.expr(v.expr)
+		c.emit(opUnary, int(v.op.typ), 0, v.op.Pos().Start)
+	case *BinOp:
+		c.binary(v)
+	}
+}
+
+// intOps and ordinalOps are the operators with an instruction of their own
+// for integer and for ordinal operands.
+var (
+	intOps = map[TokenTyp]opcode{
+		Plus:       opAddInt,
+		Minus:      opSubInt,
+		Mul:        opMulInt,
+		IntegerDiv: opDivInt,
+	}
+	ordinalOps = map[TokenTyp]opcode{
+		Equal:        opEqual,
+		NotEqual:     opNotEqual,
+		Less:         opLess,
+		LessEqual:    opLessEqual,
+		Greater:      opGreater,
+		GreaterEqual: opGreaterEqual,
+	}
+)
+
+func (c *compiler) binary(node *BinOp) {
+	pos := node.op.Pos().Start
+	c.expr(node.left)
+	switch node.op.typ {
+	case And, Or:
+		// once the left operand does not decide the result, the right one is it
+		op := opAndJump
+		if node.op.typ == Or {
+			op = opOrJump
+		}
+		jump := c.emit(op, 0, 0, pos)
+		c.expr(node.right)
+		c.patch(jump)
+		return
+	}
+	c.expr(node.right)
+
+	left, right := c.exprType(node.left), c.exprType(node.right)
+	if op, ok := intOps[node.op.typ]; ok && isInteger(left) && isInteger(right) {
+		c.emit(op, 0, 0, pos)
+		return
+	}
+	if op, ok := ordinalOps[node.op.typ]; ok && isOrdinal(left) && isOrdinal(right) {
+		c.emit(op, 0, 0, pos)
+		return
+	}
+	c.emit(opBinary, int(node.op.typ), 0, pos)
+}
+
+func (c *compiler) loadVar(symbol *varSymbol, token *Token) {
+	if symbol.level == c.proc.level {
+		c.emit(opLoadLocal, symbol.slot, 0, token.Pos().Start)
+		return
+	}
+	c.emit(opLoad, symbol.slot, symbol.level, token.Pos().Start)
+}
+
+func (c *compiler) storeVar(symbol *varSymbol, token *Token) {
+	if symbol.level == c.proc.level {
+		c.emit(opStoreLocal, symbol.slot, 0, token.Pos().Start)
+		return
+	}
+	c.emit(opStore, symbol.slot, symbol.level, token.Pos().Start)
+}
+
+// store compiles storing the value on top of the stack in the variable, array
+// element or record field target denotes. Range errors are reported at token.
+func (c *compiler) store(target Node, token *Token) {
+	switch left := target.(type) {
+	case *Var:
+		if left.with != nil {
+			c.store(left.with, token)
+			return
+		}
+		c.convert(left.symbol.Type(), token)
+		c.storeVar(left.symbol, token)
+	case *indexedVar:
+		c.convert(left.typ, token)
+		container, typ := c.container(left)
+		index := left.indices[len(left.indices)-1]
+		c.expr(container)
+		c.expr(index)
+		if isString(typ) {
+			c.emit(opSetChar, 0, 0, index.Pos().Start)
+			c.store(container, token)
+			return
+		}
+		c.emit(opStoreElem, 0, 0, index.Pos().Start)
+	case *fieldVar:
+		c.convert(left.typ, token)
+		c.expr(left.record)
+		c.emit(opStoreField, c.constant(strVal(left.field.value.(string))), 0, left.field.Pos().Start)
+	}
+}
+
+// ref compiles pushing a reference to the variable, array element or record
+// field target denotes, for a var parameter.
+func (c *compiler) ref(target Node) {
+	switch t := target.(type) {
+	case *Var:
+		if t.with != nil {
+			c.ref(t.with)
+			return
+		}
+		c.emit(opRef, t.symbol.slot, t.symbol.level, t.token.Pos().Start)
+	case *indexedVar:
+		container, _ := c.container(t)
+		index := t.indices[len(t.indices)-1]
+		c.expr(container)
+		c.expr(index)
+		c.emit(opRefElem, 0, 0, index.Pos().Start)
+	case *fieldVar:
+		c.expr(t.record)
+		c.emit(opRefField, c.constant(strVal(t.field.value.(string))), 0, t.field.Pos().Start)
+	}
+}
+
+// container returns the expression for the array or string the last index of
+// node selects from, together with its type.
+func (c *compiler) container(node *indexedVar) (Node, Symbol) {
+	last := len(node.indices) - 1
+	typ := c.exprType(node.array)
+	for i := 0; i < last; i++ {
+		if arr, ok := typ.(*arraySymbol); ok {
+			typ = arr.elem
+		}
+	}
+	if last == 0 {
+		return node.array, typ
+	}
+	return &indexedVar{array: node.array, indices: node.indices[:last], token: node.token, end: node.end}, typ
+}
+
+// call compiles a procedure or function call and reports whether it leaves a
+// value on the stack.
+func (c *compiler) call(node *procCall) bool {
+	if node.builtin != nil {
+		return c.builtin(node)
+	}
+	sym := node.procSymbol
+	for idx, arg := range node.actualParams {
+		param := sym.params[idx].(*varSymbol)
+		if param.mode == varParam {
+			c.ref(arg)
+			continue
+		}
+		c.expr(arg)
+		c.convert(param.Type(), arg.Token())
+	}
+	c.emit(opCall, c.procIndex(sym), 0, node.token.Pos().Start)
+	return sym.typ != nil
+}
+
+func (c *compiler) builtin(node *procCall) bool {
+	name := node.builtin.name
+	switch name {
+	case "write", "writeln":
+		for idx, arg := range node.actualParams {
+			flags := 0
+			if format, ok := arg.(*formatArg); ok {
+				c.expr(format.width)
+				flags |= 1
+				if format.precision != nil {
+					c.expr(format.precision)
+					flags |= 2
+				}
+				arg = format.expr
+			}
+			c.expr(arg)
+			c.emit(opWrite, c.typeIndex(node.argTypes[idx]), flags, arg.Pos().Start)
+		}
+		newline := 0
+		if name == "writeln" {
+			newline = 1
+		}
+		c.emit(opFlush, newline, 0, node.token.Pos().Start)
+		return false
+	case "read", "readln":
+		for idx, arg := range node.actualParams {
+			c.emit(opRead, c.typeIndex(node.argTypes[idx]), 0, arg.Pos().Start)
+			c.store(arg, arg.Token())
+		}
+		if name == "readln" {
+			c.emit(opReadln, 0, 0, node.token.Pos().Start)
+		}
+		return false
+	}
+	for _, arg := range node.actualParams {
+		c.expr(arg)
+	}
+	c.emit(opBuiltin, c.constant(strVal(name)), len(node.actualParams), builtinErrorNode(node).Pos().Start)
+	if n := modifiedArg(name); n >= 0 {
+		c.store(node.actualParams[n], node.token)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,304 @@
+package calc5
+
+import (
+	"fmt"
+	"github.com/IngvarListard/pascal-go-intepreter/pkg/calc5/errors"
+	"strings"
+)
+
+// arrayValue is the runtime form of an array. Elements that have not been
+// assigned yet are undefined.
+type arrayValue struct {
+	low   int
+	elems []Value
+	elem  Symbol
+}
+
+func (a *arrayValue) String() string {
+	elems := make([]string, len(a.elems))
+	for i, elem := range a.elems {
+		elems[i] = elem.String()
+	}
+	return "[" + strings.Join(elems, " ") + "]"
+}
+
+// resize changes the length of a dynamic array, keeping the elements that
+// still fit.
+func (a *arrayValue) resize(n int) error {
+	if n > 0 && valueSize(a.elem) > maxValueSize/n {
+		return sizeError(fmt.Sprintf("array of %d elements", n))
+	}
+	elems := make([]Value, n)
+	copy(elems, a.elems)
+	for i := len(a.elems); i < n; i++ {
+		elems[i] = newValue(a.elem)
+	}
+	a.elems = elems
+	return nil
+}
+
+// recordValue is the runtime form of a record. Fields that have not been
+// assigned yet are undefined. Variant fields are stored apart, and
+// selected remembers which variant of each part was written last.
+type recordValue struct {
+	typ      *recordSymbol
+	fields   map[string]Value
+	selected map[*variantPartSymbol]*variantSymbol
+}
+
+func (r *recordValue) String() string {
+	fields := make([]string, len(r.typ.fields))
+	for i, field := range r.typ.fields {
+		fields[i] = fmt.Sprintf("%s: %v", field.name, r.fields[field.name])
+	}
+	return "{" + strings.Join(fields, ", ") + "}"
+}
+
+// selectVariant makes v and the variants enclosing it the selected ones.
+func (r *recordValue) selectVariant(v *variantSymbol) {
+	for ; v != nil; v = v.part.parent {
+		r.selected[v.part] = v
+	}
+}
+
+// active reports whether the fields of v may be read: every variant on the
+// way to v must be the one its tag selects or, without a tag, the one
+// written last.
+func (r *recordValue) active(v *variantSymbol) bool {
+	for ; v != nil; v = v.part.parent {
+		if v.part.tag == nil {
+			if r.selected[v.part] != v {
+				return false
+			}
+			continue
+		}
+		tag := r.fields[v.part.tag.name]
+		if !tag.defined() || !v.selects(ordinal(tag)) {
+			return false
+		}
+	}
+	return true
+}
+
+// reference is what a var parameter holds: access to the variable, array
+// element or record field passed for it, so that reads and writes through the
+// parameter reach the caller's storage.
+type reference struct {
+	load  func() Value
+	store func(v Value)
+}
+
+func (r *reference) String() string { return "&" + r.load().String() }
+
+// slotRef returns a reference to slots[slot], or the reference the slot
+// already holds when it belongs to a var parameter.
+func slotRef(slots []Value, slot int) *reference {
+	if slots[slot].kind == kindRef {
+		return slots[slot].ref()
+	}
+	return &reference{
+		load:  func() Value { return slots[slot] },
+		store: func(v Value) { slots[slot] = overwrite(slots[slot], v) },
+	}
+}
+
+// elemRef returns a reference to the element at position idx of arr.
+func elemRef(arr *arrayValue, idx int) *reference {
+	return &reference{
+		// setlength may have cut the element off since
+		load: func() Value {
+			if idx >= len(arr.elems) {
+				return Value{}
+			}
+			return arr.elems[idx]
+		},
+		store: func(v Value) {
+			if idx < len(arr.elems) {
+				arr.elems[idx] = overwrite(arr.elems[idx], v)
+			}
+		},
+	}
+}
+
+// fieldRef returns a reference to the field name of record.
+func fieldRef(record *recordValue, name string) *reference {
+	return &reference{
+		load: func() Value { return record.fields[name] },
+		store: func(v Value) {
+			record.fields[name] = overwrite(record.fields[name], v)
+			record.selectVariant(record.typ.variants[name])
+		},
+	}
+}
+
+// boundsError reports an index n outside low..high.
+func boundsError(n, low, high int) error {
+	return errors.NewRuntimeError(fmt.Sprintf("index %d out of bounds %d..%d", n, low, high), "checkIndex",
+		errors.ErrorCode(errors.OutOfRange),
+	)
+}
+
+// maxValueSize bounds the elements and fields a variable may hold, so that an
+// array too large to allocate is reported instead of exhausting memory.
+const maxValueSize = 1 << 24
+
+// valueSize returns how many elements and fields a value of type typ holds,
+// or more than maxValueSize when there are too many.
+func valueSize(typ Symbol) int {
+	switch t := typ.(type) {
+	case *arraySymbol:
+		if t.index == nil {
+			return 1
+		}
+		// high - low wraps around for bounds too far apart
+		low, high := bounds(t.index)
+		n, elem := high-low+1, valueSize(t.elem)
+		if high-low < 0 || n > maxValueSize || elem > maxValueSize/n {
+			return maxValueSize + 1
+		}
+		return n * elem
+	case *recordSymbol:
+		n := 1
+		for _, field := range t.fields {
+			if n += valueSize(field.typ); n > maxValueSize {
+				return maxValueSize + 1
+			}
+		}
+		return n
+	}
+	return 1
+}
+
+// checkSize reports a variable of type typ that would be too large to create.
+func checkSize(typ Symbol) error {
+	if valueSize(typ) > maxValueSize {
+		return sizeError(typ.Name())
+	}
+	return nil
+}
+
+func sizeError(what string) error {
+	return errors.NewRuntimeError(fmt.Sprintf("%s holds more than %d elements", what, maxValueSize), "newValue",
+		errors.ErrorCode(errors.OutOfRange),
+	)
+}
+
+// newValue returns the initial value of a variable of type typ. Structured
+// variables exist as soon as they are declared so their parts can be assigned
+// one at a time and strings start out empty; other scalars start out
+// undefined.
+func newValue(typ Symbol) Value {
+	if isString(typ) {
+		return strVal("")
+	}
+	switch t := typ.(type) {
+	case *arraySymbol:
+		value := &arrayValue{elem: t.elem}
+		if t.index != nil {
+			low, high := bounds(t.index)
+			value.low = low
+			// callers have checked the size with checkSize
+			value.resize(high - low + 1)
+		}
+		return arrayVal(value)
+	case *recordSymbol:
+		value := &recordValue{
+			typ:      t,
+			fields:   make(map[string]Value),
+			selected: make(map[*variantPartSymbol]*variantSymbol),
+		}
+		for _, field := range t.fields {
+			if v := newValue(field.typ); v.defined() {
+				value.fields[field.name] = v
+			}
+		}
+		return recordVal(value)
+	}
+	return Value{}
+}
+
+// copyValue returns a deep copy of v so that assignment gives the target its
+// own structured value.
+func copyValue(v Value) Value {
+	switch v.kind {
+	case kindArray:
+		val := v.array()
+		elems := make([]Value, len(val.elems))
+		for i, elem := range val.elems {
+			elems[i] = copyValue(elem)
+		}
+		return arrayVal(&arrayValue{low: val.low, elems: elems, elem: val.elem})
+	case kindRecord:
+		val := v.record()
+		fields := make(map[string]Value, len(val.fields))
+		for name, field := range val.fields {
+			fields[name] = copyValue(field)
+		}
+		selected := make(map[*variantPartSymbol]*variantSymbol, len(val.selected))
+		for part, v := range val.selected {
+			selected[part] = v
+		}
+		return recordVal(&recordValue{typ: val.typ, fields: fields, selected: selected})
+	}
+	return v
+}
+
+// overwrite returns what to keep in place of old when v is assigned to it.
+// An array or record is copied into the one old already holds, so var
+// parameters and with statements that refer into it see the new contents
+// instead of a detached value. v must be a copy nobody else holds, as
+// convertValue makes.
+func overwrite(old, v Value) Value {
+	if old.kind != v.kind {
+		return v
+	}
+	switch v.kind {
+	case kindArray:
+		dst, src := old.array(), v.array()
+		if dst == src {
+			return old
+		}
+		for idx, elem := range src.elems {
+			if idx < len(dst.elems) {
+				src.elems[idx] = overwrite(dst.elems[idx], elem)
+			}
+		}
+		dst.low, dst.elems = src.low, src.elems
+		return old
+	case kindRecord:
+		dst, src := old.record(), v.record()
+		if dst == src {
+			return old
+		}
+		for name, field := range src.fields {
+			src.fields[name] = overwrite(dst.fields[name], field)
+		}
+		dst.fields, dst.selected = src.fields, src.selected
+		return old
+	}
+	return v
+}
+
+// convertValue prepares v for storage in a variable of type typ: integers
+// become reals where a real is expected, subrange values are range checked
+// and structured values are copied.
+func convertValue(typ Symbol, v Value) (Value, error) {
+	switch t := typ.(type) {
+	case *subrangeSymbol:
+		if n := ordinal(v); n < t.low || n > t.high {
+			return Value{}, errors.NewRuntimeError(fmt.Sprintf("%v is not in %s", v, t), "convert",
+				errors.ErrorCode(errors.OutOfRange),
+			)
+		}
+	case *builtinTypeSymbol:
+		if v.kind == kindInt && t.name == "real" {
+			return realVal(v.Real()), nil
+		}
+		if v.kind == kindChar && t.name == "string" {
+			return strVal(string(v.Char())), nil
+		}
+	case *arraySymbol, *recordSymbol:
+		return copyValue(v), nil
+	}
+	return v, nil
+}
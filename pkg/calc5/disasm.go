@@ -0,0 +1,131 @@
+package calc5
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Disassemble reads an object file written by Compile and prints its code to
+// w, one procedure after another. Each run of instructions is preceded by the
+// source line it was compiled from.
+func Disassemble(w io.Writer, obj io.Reader) error {
+	prog, err := decode(obj)
+	if err != nil {
+		return err
+	}
+	return prog.disassemble(w)
+}
+
+func (prog *bytecode) disassemble(w io.Writer) error {
+	lines := strings.Split(prog.source, "\n")
+	var buf strings.Builder
+	for idx, proc := range prog.procs {
+		if idx > 0 {
+			buf.WriteByte('\n')
+		}
+		kind := "procedure"
+		switch {
+		case idx == 0:
+			kind = "program"
+		case proc.result >= 0:
+			kind = "function"
+		}
+		fmt.Fprintf(&buf, "%s %s (level %d)\n", kind, proc.name, proc.level)
+		for slot, v := range proc.vars {
+			fmt.Fprintf(&buf, "    slot %d  %s", slot, v.name)
+			if v.typ != nil {
+				fmt.Fprintf(&buf, ": %s", v.typ.Name())
+			}
+			for _, param := range proc.params {
+				if param == slot {
+					buf.WriteString(" (parameter)")
+				}
+			}
+			if slot == proc.result {
+				buf.WriteString(" (result)")
+			}
+			buf.WriteByte('\n')
+		}
+
+		line := 0
+		for pc, in := range proc.code {
+			if pos := proc.pos[pc]; pos.Line != line && pos.Line > 0 {
+				line = pos.Line
+				src := ""
+				if line <= len(lines) {
+					src = strings.TrimRight(lines[line-1], "\r")
+				}
+				fmt.Fprintf(&buf, "%4d| %s\n", line, src)
+			}
+			text := fmt.Sprintf("%-8s", in.op)
+			switch in.op {
+			case opLoad, opStore, opRef, opInit, opBuiltin, opWrite, opForPrep, opForNext:
+				text += fmt.Sprintf(" %d %d", in.a, in.b)
+			case opPop, opDup, opAddInt, opSubInt, opMulInt, opDivInt,
+				opEqual, opNotEqual, opLess, opLessEqual, opGreater, opGreaterEqual,
+				opIndex, opDefined, opStoreElem, opSetChar, opRefElem, opReturn, opReadln:
+			default:
+				text += fmt.Sprintf(" %d", in.a)
+			}
+			if comment := prog.comment(proc, in); comment != "" {
+				text += "  ; " + comment
+			}
+			fmt.Fprintf(&buf, "      %04d  %s", pc, strings.TrimRight(text, " "))
+			buf.WriteByte('\n')
+		}
+	}
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
+
+// comment describes the operands of in: the constants, variables, types and
+// procedures its indices stand for.
+func (prog *bytecode) comment(proc *procCode, in instr) string {
+	a, b := int(in.a), int(in.b)
+	switch in.op {
+	case opConst:
+		return literal(prog.consts[a])
+	case opLoadLocal, opStoreLocal, opClear:
+		return proc.vars[a].name
+	case opInit:
+		return proc.vars[a].name + ": " + prog.types[b].Name()
+	case opLoad, opStore, opRef:
+		// only the program is known to own the records of its level
+		if b == 1 {
+			return prog.procs[0].vars[a].name
+		}
+		if b == proc.level && a < len(proc.vars) {
+			return proc.vars[a].name
+		}
+	case opConvert, opRead, opWrite:
+		return prog.types[a].Name()
+	case opBinary, opUnary:
+		return TokenTyp(a).String()
+	case opField, opStoreField, opRefField, opBuiltin:
+		return prog.consts[a].Str()
+	case opCall:
+		return prog.procs[a].name
+	case opFlush:
+		if a == 1 {
+			return "writeln"
+		}
+	case opForPrep, opForNext:
+		if b == 1 {
+			return "downto"
+		}
+	case opCase:
+		table := prog.cases[a]
+		arms := make([]string, 0, len(table.ranges)+1)
+		for _, r := range table.ranges {
+			label := fmt.Sprint(r.low)
+			if r.high != r.low {
+				label += ".." + fmt.Sprint(r.high)
+			}
+			arms = append(arms, fmt.Sprintf("%s -> %04d", label, r.target))
+		}
+		arms = append(arms, fmt.Sprintf("else -> %04d", table.other))
+		return strings.Join(arms, ", ")
+	}
+	return ""
+}
@@ -3,61 +3,113 @@ package errors
 import (
 	"bytes"
 	"errors"
-	calc5 "github.com/IngvarListard/pascal-go-intepreter/pkg/calc_last"
+	"fmt"
 )
 
-type errorCode string
-type errorType string
+// Code identifies what went wrong.
+type Code string
 
-const (
-	UnexpectedToken errorCode = "Unexpected token"
-	IDNotFound                = "ID not found"
-	DuplicateID               = "Duplicate ID"
+// Type identifies the phase that failed.
+type Type string
 
-	LexerError    errorType = "LexerError"
-	ParserError             = "ParserError"
-	SemanticError           = "SemanticError"
+const (
+	UnexpectedToken     Code = "Unexpected token"
+	UnexpectedCharacter Code = "Unexpected character"
+	UnterminatedComment Code = "Unterminated comment"
+	UnterminatedString  Code = "Unterminated string"
+	InvalidNumber       Code = "Invalid number"
+	IDNotFound          Code = "ID not found"
+	DuplicateID         Code = "Duplicate ID"
+	InvalidIdentifier   Code = "Invalid identifier use"
+	WrongParamsNum      Code = "Wrong number of arguments"
+	IncompatibleTypes   Code = "Incompatible types"
+	InvalidForControl   Code = "Invalid for-loop control variable"
+	NotConstant         Code = "Constant expression expected"
+	AssignToConstant    Code = "Assignment to constant"
+	InvalidRange        Code = "Invalid range"
+	DuplicateCaseLabel  Code = "Duplicate case label"
+	ForwardMismatch     Code = "Heading differs from forward declaration"
+	MissingBody         Code = "Forward declaration without body"
+	MissingResultType   Code = "Function without result type"
+	UninitializedVar    Code = "Uninitialized variable"
+	OutOfRange          Code = "Value out of range"
+	InactiveVariant     Code = "Inactive variant field"
+	InvalidInput        Code = "Invalid input"
+	DivisionByZero      Code = "Division by zero"
+	StackOverflow       Code = "Stack overflow"
+	Canceled            Code = "Canceled"
+
+	LexerError    Type = "LexerError"
+	ParserError   Type = "ParserError"
+	SemanticError Type = "SemanticError"
+	RuntimeError  Type = "RuntimeError"
 )
 
 type Error struct {
-	*errorCode
-	Token     *calc5.Token
+	code      *Code
+	Token     fmt.Stringer
+	Line      int // 1-based source line, 0 when unknown
+	Column    int // 1-based source column, 0 when unknown
 	err       error
-	typ       errorType
+	typ       Type
 	callStack []string
 }
 
+// String renders the error together with the scopes it was raised through.
 func (e *Error) String() string {
-
 	var buf bytes.Buffer
-	buf.WriteString(string(e.typ))
-	buf.WriteString(": ")
-	if e.errorCode != nil {
-		buf.WriteString(string(*e.errorCode))
-		buf.WriteString(": ")
-	}
-	buf.WriteString(e.err.Error())
+	buf.WriteString(e.Error())
 
 	for _, scopeDesc := range e.callStack {
+		buf.WriteString("\n\tin ")
 		buf.WriteString(scopeDesc)
-		buf.WriteString("\n")
 	}
 
 	return buf.String()
 }
 
 func (e *Error) Error() string {
-	return e.err.Error()
+	var buf bytes.Buffer
+	buf.WriteString(string(e.typ))
+	buf.WriteString(": ")
+	if e.Line > 0 {
+		fmt.Fprintf(&buf, "%d:%d: ", e.Line, e.Column)
+	}
+	if e.code != nil {
+		buf.WriteString(string(*e.code))
+		buf.WriteString(": ")
+	}
+	buf.WriteString(e.err.Error())
+	return buf.String()
 }
 
+// Type reports the phase that produced the error.
+func (e *Error) Type() Type { return e.typ }
+
+// Code reports the error code, or an empty code if none was set.
+func (e *Error) Code() Code {
+	if e.code == nil {
+		return ""
+	}
+	return *e.code
+}
+
+// Unwrap returns the underlying error, e.g. context.Canceled for canceled runs.
+func (e *Error) Unwrap() error { return e.err }
+
 func (e *Error) Through(scopeDescription string) *Error {
 	e.callStack = append(e.callStack, scopeDescription)
 	return e
 }
 
-func NewError(typ errorType, err, scopeDescription string, options ...Option) *Error {
+func NewError(typ Type, err, scopeDescription string, options ...Option) *Error {
+	return Wrap(typ, errors.New(err), scopeDescription, options...)
+}
+
+// Wrap builds an Error of the given type around an existing error.
+func Wrap(typ Type, err error, scopeDescription string, options ...Option) *Error {
 	e := &Error{
-		err:       errors.New(err),
+		err:       err,
 		typ:       typ,
 		callStack: []string{scopeDescription},
 	}
@@ -69,15 +121,23 @@ func NewError(typ errorType, err, scopeDescription string, options ...Option) *E
 
 type Option func(*Error)
 
-func Token(token *calc5.Token) Option {
+func Token(token fmt.Stringer) Option {
 	return func(e *Error) {
 		e.Token = token
 	}
 }
 
-func ErrorCode(ec *errorCode) Option {
+// Pos records where in the source the error occurred.
+func Pos(line, column int) Option {
 	return func(e *Error) {
-		e.errorCode = ec
+		e.Line = line
+		e.Column = column
+	}
+}
+
+func ErrorCode(ec Code) Option {
+	return func(e *Error) {
+		e.code = &ec
 	}
 }
 
@@ -92,3 +152,7 @@ func NewParserError(err, scopeDescription string, options ...Option) *Error {
 func NewSemanticError(err, scopeDescription string, options ...Option) *Error {
 	return NewError(SemanticError, err, scopeDescription, options...)
 }
+
+func NewRuntimeError(err, scopeDescription string, options ...Option) *Error {
+	return NewError(RuntimeError, err, scopeDescription, options...)
+}
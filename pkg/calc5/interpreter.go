@@ -1,170 +1,806 @@
 package calc5
 
 import (
+	"bufio"
+	"context"
 	"fmt"
-	"reflect"
+	"github.com/IngvarListard/pascal-go-intepreter/pkg/calc5/errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"unicode/utf8"
 )
 
+// defaultMaxCallDepth bounds recursion so a runaway program fails with an
+// error instead of exhausting the Go stack.
+const defaultMaxCallDepth = 10000
+
 type Interpreter struct {
-	parser      *Parser
-	GlobalScope map[string]interface{}
-	Symbols     *SemanticAnalyzer
+	parser       *Parser
+	GlobalScope  map[string]interface{}
+	Symbols      *SemanticAnalyzer
+	ctx          context.Context
+	trace        io.Writer
+	callStack    *callStack
+	maxCallDepth int
+	checked      bool
+	output       io.Writer
+	input        *bufio.Reader
+	compiled     bool
+	optimized    bool
+	source       string
+	object       *bytecode // compiled program Run executes, once there is one
 }
 
-func (i *Interpreter) interpret() interface{} {
-	node := i.parser.parse()
-	i.Symbols = new(SemanticAnalyzer)
-	i.Symbols.VisitNode(node)
-	return i.VisitNode(node)
+// Option configures an Interpreter created with New.
+type Option func(*Interpreter)
+
+// WithTrace makes the semantic analyzer and the interpreter log scope, symbol
+// table and call stack activity to w.
+func WithTrace(w io.Writer) Option {
+	return func(i *Interpreter) {
+		i.trace = w
+	}
 }
 
-func (i *Interpreter) visitBinOp(binary *BinOp) interface{} {
-	vl := i.VisitNode(binary.left)
-	vr := i.VisitNode(binary.right)
+// WithMaxCallDepth limits how deep procedure calls may nest at runtime. The
+// default is defaultMaxCallDepth; n of zero or less removes the limit, leaving
+// runaway recursion to exhaust the Go stack or memory.
+func WithMaxCallDepth(n int) Option {
+	return func(i *Interpreter) {
+		i.maxCallDepth = n
+	}
+}
 
-	lTyp := reflect.TypeOf(vl).Kind()
-	rTyp := reflect.TypeOf(vr).Kind()
+// WithVariantChecks makes reading a variant record field fail unless its
+// variant is the active one.
+func WithVariantChecks() Option {
+	return func(i *Interpreter) {
+		i.checked = true
+	}
+}
 
-	switch {
-	case lTyp == reflect.Int && rTyp == reflect.Int:
-		return execIntOp(vl.(int), vr.(int), binary.op.typ)
-	case lTyp == reflect.Float64 || rTyp == reflect.Float64:
-		left := getFloat(vl)
-		right := getFloat(vr)
-		return execFloatOp(left, right, binary.op.typ)
+// WithOutput sends what write and writeln print to w. Without it the output
+// is discarded.
+func WithOutput(w io.Writer) Option {
+	return func(i *Interpreter) {
+		i.output = w
 	}
+}
 
-	panic("unexpected types")
+// WithInput makes read and readln take their input from r. Without it the
+// program finds its input empty.
+func WithInput(r io.Reader) Option {
+	return func(i *Interpreter) {
+		i.input = bufio.NewReader(r)
+	}
 }
 
-func getFloat(v interface{}) float64 {
-	switch val := v.(type) {
-	case int:
-		return float64(val)
-	case float64:
-		return val
-	default:
-		panic(fmt.Sprintf("unexpected type %T", v))
-	}
-}
-
-func execFloatOp(left, right float64, op TokenTyp) float64 {
-	switch op {
-	case Plus:
-		return left + right
-	case Minus:
-		return left - right
-	case Mul:
-		return left * right
-	case IntegerDiv:
-		return left / right
-	case FloatDiv:
-		return left / right
-	default:
-		panic("AAA")
-	}
-}
-
-func execIntOp(left, right int, op TokenTyp) int {
-	switch op {
-	case Plus:
-		return left + right
-	case Minus:
-		return left - right
-	case Mul:
-		return left * right
-	case IntegerDiv:
-		return left / right
-	case FloatDiv:
-		return left / right
-	default:
-		panic("AAA")
+// WithBytecode makes Run compile the checked program to bytecode and execute
+// it on a stack machine instead of walking the tree. The results are the same.
+func WithBytecode() Option {
+	return func(i *Interpreter) {
+		i.compiled = true
+	}
+}
+
+// WithOptimization makes the checked program go through the optimizer before
+// it runs or is compiled: constant expressions are folded and branches that
+// can never run are removed. The results are the same.
+func WithOptimization() Option {
+	return func(i *Interpreter) {
+		i.optimized = true
+	}
+}
+
+// New reads a Pascal program from src and returns an Interpreter ready to Run it.
+func New(src io.Reader, opts ...Option) (*Interpreter, error) {
+	text, err := ioutil.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+
+	i := newInterpreter(opts)
+	i.parser = NewParser(NewLexer(string(text)))
+	i.source = string(text)
+	return i, nil
+}
+
+// Load reads an object file written by Compile and returns an Interpreter
+// that runs it on the stack machine. The program can be Run any number of
+// times.
+func Load(obj io.Reader, opts ...Option) (*Interpreter, error) {
+	prog, err := decode(obj)
+	if err != nil {
+		return nil, err
+	}
+	i := newInterpreter(opts)
+	i.compiled = true
+	i.object = prog
+	return i, nil
+}
+
+func newInterpreter(opts []Option) *Interpreter {
+	i := &Interpreter{
+		GlobalScope:  make(map[string]interface{}),
+		maxCallDepth: defaultMaxCallDepth,
+		output:       ioutil.Discard,
+		input:        bufio.NewReader(strings.NewReader("")),
+	}
+	for _, opt := range opts {
+		opt(i)
+	}
+	return i
+}
+
+// Compile parses, checks and compiles the program and writes it to w as an
+// object file for Load. Run then executes the compiled program too.
+func (i *Interpreter) Compile(w io.Writer) error {
+	if i.object == nil {
+		node, err := i.check()
+		if err != nil {
+			return err
+		}
+		i.object = compile(node.(*program), i.Symbols)
+		i.object.source = i.source
+	}
+	return i.object.encode(w)
+}
+
+// Run parses, checks and executes the program. It returns the global scope as
+// it was left after the last statement. Execution stops between statements
+// once ctx is done.
+func (i *Interpreter) Run(ctx context.Context) (map[string]interface{}, error) {
+	i.ctx = ctx
+	if _, err := i.interpret(); err != nil {
+		return nil, err
+	}
+	return i.GlobalScope, nil
+}
+
+func (i *Interpreter) interpret() (interface{}, error) {
+	if i.object != nil {
+		return nil, i.execute(i.object)
+	}
+	node, err := i.check()
+	if err != nil {
+		return nil, err
+	}
+	if i.compiled {
+		return nil, i.execute(compile(node.(*program), i.Symbols))
+	}
+	v, err := i.VisitNode(node)
+	if err != nil {
+		return nil, err
+	}
+	return v.Interface(), nil
+}
+
+// check parses the program and runs the semantic analyzer and, if asked for,
+// the optimizer over it.
+func (i *Interpreter) check() (Node, error) {
+	node, err := i.parser.parse()
+	if err != nil {
+		return nil, err
+	}
+	i.Symbols = NewSemanticAnalyzer()
+	i.Symbols.trace = i.trace
+	if err := i.Symbols.VisitNode(node); err != nil {
+		return nil, err
+	}
+	if i.optimized {
+		optimize(node.(*program))
+	}
+	return node, nil
+}
+
+func (i *Interpreter) visitBinOp(node *BinOp) (Value, error) {
+	vl, err := i.VisitNode(node.left)
+	if err != nil {
+		return Value{}, err
+	}
+	// and/or skip the right operand once the left one decides the result
+	if vl.kind == kindBool && (node.op.typ == And && !vl.Bool() || node.op.typ == Or && vl.Bool()) {
+		return vl, nil
+	}
+	vr, err := i.VisitNode(node.right)
+	if err != nil {
+		return Value{}, err
 	}
+	v, err := binary(node.op.typ, vl, vr)
+	if err != nil {
+		return Value{}, positioned(err, at(node.op))
+	}
+	return v, nil
 }
 
-func (i *Interpreter) visitNum(num *Num) interface{} {
-	return num.value
+func (i *Interpreter) visitNum(num *Num) (Value, error) {
+	v, _ := valueOf(num.value)
+	return v, nil
 }
 
-func (i *Interpreter) VisitNode(node Node) interface{} {
+func (i *Interpreter) VisitNode(node Node) (Value, error) {
 	switch v := node.(type) {
 	case *BinOp:
 		return i.visitBinOp(v)
 	case *Num:
 		return i.visitNum(v)
+	case *strConst:
+		return textVal(v.value), nil
+	case *boolConst:
+		return boolVal(v.value), nil
 	case *UnaryOp:
 		return i.VisitUnaryOp(v)
 	case *Compound:
-		i.VisitCompound(v)
+		return Value{}, i.VisitCompound(v)
 	case *assign:
-		i.VisitAssign(v)
+		return Value{}, i.VisitAssign(v)
 	case *NoOp:
 		i.VisitNoOp(v)
 	case *Var:
 		return i.VisitVar(v)
+	case *indexedVar:
+		return i.visitIndexedVar(v)
+	case *fieldVar:
+		return i.visitFieldVar(v)
 	case *block:
-		i.VisitBlock(v)
+		return Value{}, i.VisitBlock(v)
 	case *varDecl:
-		i.VisitVarDecl(v)
+		return Value{}, i.VisitVarDecl(v)
+	case *constDecl, *typeDecl:
 	case *procDecl:
 		i.VisitProcedureDec(v)
+	case *procCall:
+		_, err := i.visitProcCall(v)
+		return Value{}, err
+	case *ifStmt:
+		return Value{}, i.visitIf(v)
+	case *whileStmt:
+		return Value{}, i.visitWhile(v)
+	case *repeatStmt:
+		return Value{}, i.visitRepeat(v)
+	case *forStmt:
+		return Value{}, i.visitFor(v)
+	case *caseStmt:
+		return Value{}, i.visitCase(v)
+	case *withStmt:
+		return Value{}, i.visitWith(v)
+	case *funcCall:
+		return i.visitProcCall(&v.procCall)
 	case *typeNode:
 		i.VisitType(v)
 	case *program:
 		return i.VisitProgram(v)
 	default:
-		panic(fmt.Sprintf("unexpected type occurrence %T", v))
+		return Value{}, errors.NewRuntimeError(fmt.Sprintf("unexpected type occurrence %T", v), "VisitNode")
 	}
-	return nil
+	return Value{}, nil
 }
 
-func (i *Interpreter) VisitUnaryOp(node *UnaryOp) interface{} {
-	switch node.Token().typ {
-	case Plus:
-		return +i.VisitNode(node.expr).(int)
-	case Minus:
-		return -i.VisitNode(node.expr).(int)
-	default:
-		panic("Unexpected")
+func (i *Interpreter) VisitUnaryOp(node *UnaryOp) (Value, error) {
+	v, err := i.VisitNode(node.expr)
+	if err != nil {
+		return Value{}, err
+	}
+	if v, err = unary(node.op.typ, v); err != nil {
+		return Value{}, positioned(err, at(node.op))
+	}
+	return v, nil
+}
+
+// checkContext reports cancellation of the run's context.
+func (i *Interpreter) checkContext(context string) error {
+	if i.ctx == nil {
+		return nil
 	}
+	if err := i.ctx.Err(); err != nil {
+		return errors.Wrap(errors.RuntimeError, err, context, errors.ErrorCode(errors.Canceled))
+	}
+	return nil
 }
 
-func (i *Interpreter) VisitCompound(node *Compound) {
+func (i *Interpreter) VisitCompound(node *Compound) error {
 	for _, child := range node.children {
-		i.VisitNode(child)
+		if err := i.checkContext("VisitCompound"); err != nil {
+			return err
+		}
+		if _, err := i.VisitNode(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// condition evaluates an expression the semantic analyzer proved boolean.
+func (i *Interpreter) condition(node Node) (bool, error) {
+	v, err := i.VisitNode(node)
+	if err != nil {
+		return false, err
+	}
+	if v.kind != kindBool {
+		return false, errors.NewRuntimeError(fmt.Sprintf("condition evaluated to %v", v), "condition", at(node.Token()))
+	}
+	return v.Bool(), nil
+}
+
+func (i *Interpreter) visitIf(node *ifStmt) error {
+	cond, err := i.condition(node.cond)
+	if err != nil {
+		return err
 	}
+	if cond {
+		_, err = i.VisitNode(node.then)
+	} else if node.elseStmt != nil {
+		_, err = i.VisitNode(node.elseStmt)
+	}
+	return err
 }
 
-func (i *Interpreter) VisitAssign(node *assign) {
-	nodeName := node.left.(*Var).token.value
-	n := nodeName.(string)
-	v := i.VisitNode(node.right)
-	i.GlobalScope[n] = v
+func (i *Interpreter) visitWhile(node *whileStmt) error {
+	for {
+		if err := i.checkContext("visitWhile"); err != nil {
+			return err
+		}
+		cond, err := i.condition(node.cond)
+		if err != nil || !cond {
+			return err
+		}
+		if _, err := i.VisitNode(node.body); err != nil {
+			return err
+		}
+	}
+}
+
+func (i *Interpreter) visitRepeat(node *repeatStmt) error {
+	for {
+		for _, child := range node.body {
+			if err := i.checkContext("visitRepeat"); err != nil {
+				return err
+			}
+			if _, err := i.VisitNode(child); err != nil {
+				return err
+			}
+		}
+		cond, err := i.condition(node.cond)
+		if err != nil || cond {
+			return err
+		}
+	}
 }
 
-func (i *Interpreter) VisitVar(node *Var) interface{} {
-	name := node.token.value
-	val, ok := i.GlobalScope[name.(string)]
-	if !ok {
-		panic(fmt.Sprintf("no %s name in global scope", name.(string)))
+// visitFor evaluates both bounds once and then steps the control variable
+// through them. The body is not run at all when the range is empty.
+func (i *Interpreter) visitFor(node *forStmt) error {
+	start, err := i.VisitNode(node.start)
+	if err != nil {
+		return err
 	}
-	return val
+	end, err := i.VisitNode(node.end)
+	if err != nil {
+		return err
+	}
+	from, to := ordinal(start), ordinal(end)
+	step := 1
+	if node.downto {
+		step = -1
+	}
+
+	for n := from; node.downto && n >= to || !node.downto && n <= to; n += step {
+		if err := i.checkContext("visitFor"); err != nil {
+			return err
+		}
+		v, err := i.convert(node.variable.symbol.Type(), fromOrdinal(n, start), node.variable.token)
+		if err != nil {
+			return err
+		}
+		i.store(node.variable, v)
+		if _, err := i.VisitNode(node.body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// visitCase runs the branch whose labels cover the selector, or the else part
+// when none does. Without an else part an unmatched selector does nothing.
+func (i *Interpreter) visitCase(node *caseStmt) error {
+	v, err := i.VisitNode(node.selector)
+	if err != nil {
+		return err
+	}
+	selector := ordinal(v)
+	for _, branch := range node.branches {
+		for _, label := range branch.labels {
+			if label.low <= selector && selector <= label.high {
+				_, err := i.VisitNode(branch.body)
+				return err
+			}
+		}
+	}
+	for _, child := range node.elseBody {
+		if _, err := i.VisitNode(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (i *Interpreter) tracef(format string, a ...interface{}) {
+	if i.trace != nil {
+		fmt.Fprintf(i.trace, format, a...)
+	}
+}
+
+// frameOf returns the activation record holding the variable node refers to:
+// the symbol's level says how far up the access links it is, and its slot
+// where in that record.
+func (i *Interpreter) frameOf(node *Var) *activationRecord {
+	return i.callStack.peek().enclosing(node.symbol.level)
+}
+
+// convert prepares v for storage in a variable of type typ and reports a
+// value out of range at token.
+func (i *Interpreter) convert(typ Symbol, v Value, token *Token) (Value, error) {
+	v, err := convertValue(typ, v)
+	if err != nil {
+		return Value{}, positioned(err, at(token))
+	}
+	return v, nil
+}
+
+func (i *Interpreter) VisitAssign(node *assign) error {
+	v, err := i.VisitNode(node.right)
+	if err != nil {
+		return err
+	}
+	return i.assignTo(node.left, v, node.op)
+}
+
+// assignTo stores v in the variable, array element or record field target
+// denotes.
+func (i *Interpreter) assignTo(target Node, v Value, token *Token) error {
+	var err error
+	switch left := target.(type) {
+	case *Var:
+		if left.with != nil {
+			return i.assignTo(left.with, v, token)
+		}
+		if left.symbol != nil {
+			if v, err = i.convert(left.symbol.Type(), v, token); err != nil {
+				return err
+			}
+		}
+		i.store(left, v)
+	case *indexedVar:
+		if v, err = i.convert(left.typ, v, token); err != nil {
+			return err
+		}
+		container, c, n, err := i.element(left)
+		if err != nil {
+			return err
+		}
+		if c.kind == kindString {
+			runes := []rune(c.Str())
+			runes[n-1] = v.Char()
+			return i.assignTo(container, strVal(string(runes)), token)
+		}
+		arr := c.array()
+		arr.elems[n-arr.low] = overwrite(arr.elems[n-arr.low], v)
+	case *fieldVar:
+		if v, err = i.convert(left.typ, v, token); err != nil {
+			return err
+		}
+		r, err := i.VisitNode(left.record)
+		if err != nil {
+			return err
+		}
+		record, name := r.record(), left.field.value.(string)
+		record.fields[name] = overwrite(record.fields[name], v)
+		record.selectVariant(record.typ.variants[name])
+	}
+	return nil
+}
+
+// store sets the variable node names. A var parameter passes the value on to
+// the variable it stands for.
+func (i *Interpreter) store(node *Var, v Value) {
+	slots, slot := i.frameOf(node).slots, node.symbol.slot
+	if slots[slot].kind == kindRef {
+		slots[slot].ref().store(v)
+		return
+	}
+	slots[slot] = overwrite(slots[slot], v)
+}
+
+// element evaluates all of node but the value of its last index. It returns
+// the expression for the array or string that index selects from, its value
+// and the checked index.
+func (i *Interpreter) element(node *indexedVar) (Node, Value, int, error) {
+	last := len(node.indices) - 1
+	container := node.array
+	if last > 0 {
+		container = &indexedVar{array: node.array, indices: node.indices[:last], token: node.token, end: node.end}
+	}
+	c, err := i.VisitNode(container)
+	if err != nil {
+		return nil, Value{}, 0, err
+	}
+	index := node.indices[last]
+	v, err := i.VisitNode(index)
+	if err != nil {
+		return nil, Value{}, 0, err
+	}
+	n := ordinal(v)
+	switch c.kind {
+	case kindArray:
+		_, err = i.slot(c.array(), n, index)
+	case kindString:
+		err = i.checkIndex(n, 1, utf8.RuneCountInString(c.Str()), index)
+	}
+	if err != nil {
+		return nil, Value{}, 0, err
+	}
+	return container, c, n, nil
+}
+
+// locate returns a reference to the variable, array element or record field
+// target denotes, for passing it to a var parameter.
+func (i *Interpreter) locate(target Node) (*reference, error) {
+	switch t := target.(type) {
+	case *Var:
+		if t.with != nil {
+			return i.locate(t.with)
+		}
+		slots, slot := i.frameOf(t).slots, t.symbol.slot
+		return slotRef(slots, slot), nil
+	case *indexedVar:
+		_, c, n, err := i.element(t)
+		if err != nil {
+			return nil, err
+		}
+		arr := c.array()
+		return elemRef(arr, n-arr.low), nil
+	case *fieldVar:
+		r, err := i.VisitNode(t.record)
+		if err != nil {
+			return nil, err
+		}
+		return fieldRef(r.record(), t.field.value.(string)), nil
+	}
+	return nil, errors.NewRuntimeError(fmt.Sprintf("%T is not a variable", target), "locate", atNode(target))
+}
+
+// slot returns the position in arr of the element with index n.
+func (i *Interpreter) slot(arr *arrayValue, n int, index Node) (int, error) {
+	if err := i.checkIndex(n, arr.low, arr.low+len(arr.elems)-1, index); err != nil {
+		return 0, err
+	}
+	return n - arr.low, nil
+}
+
+// checkIndex reports an index n outside low..high at the index expression.
+func (i *Interpreter) checkIndex(n, low, high int, index Node) error {
+	if n < low || n > high {
+		return positioned(boundsError(n, low, high), atNode(index))
+	}
+	return nil
+}
+
+func (i *Interpreter) visitFieldVar(node *fieldVar) (Value, error) {
+	record, err := i.VisitNode(node.record)
+	if err != nil {
+		return Value{}, err
+	}
+	rec, name := record.record(), node.field.value.(string)
+	if variant := rec.typ.variants[name]; i.checked && variant != nil && !rec.active(variant) {
+		return Value{}, errors.NewRuntimeError(fmt.Sprintf("field %s belongs to an inactive variant", name), "visitFieldVar",
+			errors.ErrorCode(errors.InactiveVariant),
+			at(node.field),
+		)
+	}
+	v := rec.fields[name]
+	if !v.defined() {
+		return Value{}, errors.NewRuntimeError(fmt.Sprintf("field %v is read before it is assigned", node.field.value), "visitFieldVar",
+			errors.ErrorCode(errors.UninitializedVar),
+			at(node.field),
+		)
+	}
+	return v, nil
+}
+
+// visitWith evaluates the records once, keeps them in hidden variables of the
+// current activation record while the body runs and drops them afterwards.
+// Assigning to a record's variable in the body refills the same record, so the
+// hidden variables keep standing for it.
+func (i *Interpreter) visitWith(node *withStmt) error {
+	slots := i.callStack.peek().slots
+	defer func() {
+		for _, hidden := range node.vars {
+			slots[hidden.slot] = Value{}
+		}
+	}()
+	for idx, record := range node.records {
+		v, err := i.VisitNode(record)
+		if err != nil {
+			return err
+		}
+		slots[node.vars[idx].slot] = v
+	}
+	_, err := i.VisitNode(node.body)
+	return err
+}
+
+func (i *Interpreter) visitIndexedVar(node *indexedVar) (Value, error) {
+	v, err := i.VisitNode(node.array)
+	if err != nil {
+		return Value{}, err
+	}
+	for _, index := range node.indices {
+		n, err := i.VisitNode(index)
+		if err != nil {
+			return Value{}, err
+		}
+		switch v.kind {
+		case kindArray:
+			arr := v.array()
+			idx, err := i.slot(arr, ordinal(n), index)
+			if err != nil {
+				return Value{}, err
+			}
+			v = arr.elems[idx]
+		case kindString:
+			runes := []rune(v.Str())
+			if err := i.checkIndex(ordinal(n), 1, len(runes), index); err != nil {
+				return Value{}, err
+			}
+			v = charVal(runes[ordinal(n)-1])
+		}
+		if !v.defined() {
+			return Value{}, errors.NewRuntimeError("array element is read before it is assigned", "visitIndexedVar",
+				errors.ErrorCode(errors.UninitializedVar),
+				atNode(node),
+			)
+		}
+	}
+	return v, nil
+}
+
+func (i *Interpreter) VisitVar(node *Var) (Value, error) {
+	if node.constant != nil {
+		return node.constant.value, nil
+	}
+	if node.with != nil {
+		return i.visitFieldVar(node.with)
+	}
+	if node.call != nil {
+		return i.visitProcCall(&node.call.procCall)
+	}
+	val := i.frameOf(node).slots[node.symbol.slot]
+	if val.kind == kindRef {
+		val = val.ref().load()
+	}
+	if !val.defined() {
+		return Value{}, errors.NewRuntimeError(fmt.Sprintf("%s is read before it is assigned", node.symbol.name), "VisitVar",
+			errors.ErrorCode(errors.UninitializedVar),
+			at(node.token),
+		)
+	}
+	return val, nil
 }
 
 func (i *Interpreter) VisitNoOp(_ *NoOp) {}
 
-func (i *Interpreter) VisitProgram(node *program) interface{} {
-	return i.VisitNode(node.block)
+// VisitProgram runs the program and then copies the assigned global variables
+// into GlobalScope by name.
+func (i *Interpreter) VisitProgram(node *program) (Value, error) {
+	ar := newActivationRecord(node.name, arProgram, 1, i.Symbols.global.vars)
+	i.callStack = &callStack{}
+	i.callStack.push(ar)
+	i.tracef("ENTER: PROGRAM %s\n%s", node.name, i.callStack)
+
+	result, err := i.VisitNode(node.block)
+
+	i.tracef("LEAVE: PROGRAM %s\n%s", node.name, i.callStack)
+	i.callStack.pop()
+	i.saveGlobals(ar)
+	return result, err
 }
 
-func (i *Interpreter) VisitBlock(node *block) {
+// saveGlobals copies the assigned variables of the program's activation
+// record into GlobalScope by name.
+func (i *Interpreter) saveGlobals(ar *activationRecord) {
+	if i.GlobalScope == nil {
+		i.GlobalScope = make(map[string]interface{})
+	}
+	for _, v := range ar.vars {
+		if ar.slots[v.slot].defined() {
+			i.GlobalScope[v.name] = ar.slots[v.slot].Interface()
+		}
+	}
+}
+
+// visitProcCall runs a procedure or function and returns the function result,
+// or an undefined value for procedures.
+func (i *Interpreter) visitProcCall(node *procCall) (Value, error) {
+	if node.builtin != nil {
+		return i.callBuiltin(node)
+	}
+	procSymbol := node.procSymbol
+	if i.maxCallDepth > 0 && i.callStack.depth() >= i.maxCallDepth {
+		return Value{}, errors.NewRuntimeError(fmt.Sprintf("call depth exceeds %d", i.maxCallDepth), "visitProcCall",
+			errors.ErrorCode(errors.StackOverflow),
+			at(node.token),
+		)
+	}
+
+	ar := newActivationRecord(node.procName, arProcedure, procSymbol.level, procSymbol.vars)
+	// the procedure body sees the record of the routine it is declared in,
+	// which is the caller itself or one of the caller's enclosing records
+	ar.accessLink = i.callStack.peek().enclosing(procSymbol.level - 1)
+	for idx, arg := range node.actualParams {
+		param := procSymbol.params[idx]
+		if param.(*varSymbol).mode == varParam {
+			ref, err := i.locate(arg)
+			if err != nil {
+				return Value{}, err
+			}
+			ar.slots[param.(*varSymbol).slot] = refVal(ref)
+			continue
+		}
+		v, err := i.VisitNode(arg)
+		if err != nil {
+			return Value{}, err
+		}
+		if v, err = i.convert(param.Type(), v, arg.Token()); err != nil {
+			return Value{}, err
+		}
+		ar.slots[param.(*varSymbol).slot] = v
+	}
+
+	i.callStack.push(ar)
+	i.tracef("ENTER: PROCEDURE %s\n%s", node.procName, i.callStack)
+
+	err := i.VisitBlock(procSymbol.block)
+
+	i.tracef("LEAVE: PROCEDURE %s\n%s", node.procName, i.callStack)
+	i.callStack.pop()
+	if err != nil {
+		return Value{}, through(err, "procedure "+node.procName)
+	}
+	if procSymbol.result == nil {
+		return Value{}, nil
+	}
+	result := ar.slots[procSymbol.result.slot]
+	if !result.defined() {
+		return Value{}, errors.NewRuntimeError(fmt.Sprintf("function %s returned without a result", node.procName), "visitProcCall",
+			errors.ErrorCode(errors.UninitializedVar),
+			at(node.token),
+		)
+	}
+	return result, nil
+}
+
+func (i *Interpreter) VisitBlock(node *block) error {
 	for _, declaration := range node.declarations {
-		i.VisitNode(declaration)
+		if _, err := i.VisitNode(declaration); err != nil {
+			return err
+		}
 	}
-	i.VisitNode(node.compoundStatement)
+	_, err := i.VisitNode(node.compoundStatement)
+	return err
 }
 
-func (i *Interpreter) VisitVarDecl(_ *varDecl) {}
+// VisitVarDecl creates structured variables in the current activation record.
+func (i *Interpreter) VisitVarDecl(node *varDecl) error {
+	symbol := node.varNode.(*Var).symbol
+	if err := checkSize(symbol.Type()); err != nil {
+		return positioned(err, atNode(node))
+	}
+	if v := newValue(symbol.Type()); v.defined() {
+		i.callStack.peek().slots[symbol.slot] = v
+	}
+	return nil
+}
 
 func (i *Interpreter) VisitType(_ *typeNode) {}
 
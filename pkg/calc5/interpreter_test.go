@@ -1,29 +1,47 @@
 package calc5
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"github.com/IngvarListard/pascal-go-intepreter/pkg/calc5/errors"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
+// backends are the ways Run can execute a program. The Run tests expect the
+// same results from each of them.
+var backends = []struct {
+	name string
+	opts []Option
+}{
+	{name: "tree"},
+	{name: "bytecode", opts: []Option{WithBytecode()}},
+	{name: "optimized", opts: []Option{WithOptimization()}},
+	{name: "optimized_bytecode", opts: []Option{WithOptimization(), WithBytecode()}},
+}
+
 func TestInterpreter_interpret(t *testing.T) {
 	type fields struct {
 		parser *Parser
 	}
 	tests := []struct {
-		name   string
-		fields fields
-		want   interface{}
+		name        string
+		fields      fields
+		want        interface{}
+		wantGlobals map[string]interface{}
 	}{
 		{
-			name: "simple_sum",
+			name: "nested_scopes",
 			fields: fields{
 				parser: &Parser{
 					lexer: &Lexer{
 						text: []rune(`
 program Main;
    var b, x, y : real;
-   var z : integer;
+   var z, total : integer;
 
    procedure AlphaA(a : integer);
       var b : integer;
@@ -34,24 +52,35 @@ program Main;
          procedure Gamma(c : integer);
             var x : integer;
          begin { Gamma }
-            x := a + b + c + x + y + z;
+            x := 1000;
+            total := total + a + b + c + x + y + z;
+            if c > 0 then Beta(c - 1)
          end;  { Gamma }
 
       begin { Beta }
-
+         y := c * 100;
+         Gamma(c)
       end;  { Beta }
 
    begin { AlphaA }
-
+      b := a * 10;
+      if a > 1 then AlphaA(a - 1);
+      Beta(a)
    end;  { AlphaA }
 
    procedure AlphaB(a : integer);
       var c : real;
    begin { AlphaB }
       c := a + b;
+      x := c
    end;  { AlphaB }
 
 begin { Main }
+   b := 0.5;
+   z := 7;
+   total := 0;
+   AlphaA(2);
+   AlphaB(3)
 end.  { Main }
 `),
 						currentRune: '\n',
@@ -60,7 +89,10 @@ end.  { Main }
 					currentToken: nil,
 				},
 			},
-			want: 5,
+			want: nil,
+			// every Gamma call adds the a, b and y of the frames it is nested
+			// in, also when Beta and AlphaA recurse
+			wantGlobals: map[string]interface{}{"total": 5527, "x": 3.5, "b": 0.5},
 		},
 	}
 	for _, tt := range tests {
@@ -69,12 +101,1591 @@ end.  { Main }
 				parser: tt.fields.parser,
 			}
 			i.GlobalScope = make(map[string]interface{})
-			i.parser.currentToken = i.parser.lexer.getNextToken()
-			if got := i.interpret(); !reflect.DeepEqual(got, tt.want) {
+			i.parser.currentToken, _ = i.parser.lexer.getNextToken()
+			got, err := i.interpret()
+			if err != nil {
+				t.Fatalf("interpret() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("interpret() = %v, want %v", got, tt.want)
 			}
+			for name, want := range tt.wantGlobals {
+				if got := i.GlobalScope[name]; got != want {
+					t.Errorf("%s = %v, want %v", name, got, want)
+				}
+			}
 			fmt.Println("GLOBAL SCOPE", i.GlobalScope)
-			fmt.Println("SYMBOLS", i.Symbols.symbols)
+			fmt.Println("SYMBOLS", i.Symbols.global.symbols)
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		want    map[string]interface{}
+		wantErr bool
+	}{
+		{
+			name: "assignments",
+			src: `
+program Main;
+   var x, y : integer;
+   var r : real;
+begin
+   x := 2;
+   y := x * 3 + 1;
+   r := y / 2.0
+end.
+`,
+			want: map[string]interface{}{"x": 2, "y": 7, "r": 3.5},
+		},
+		{
+			name: "procedure_calls",
+			src: `
+program Main;
+   var total, n : integer;
+   var avg : real;
+
+   procedure Add(a : integer; w : real);
+      var scaled : real;
+   begin
+      scaled := a * w;
+      total := total + a;
+      avg := scaled
+   end;
+
+   procedure Reset;
+   begin
+      total := 0
+   end;
+
+begin
+   Reset;
+   n := 0;
+   Add(3, 2);
+   Add(4, 0.5)
+end.
+`,
+			want: map[string]interface{}{"total": 7, "n": 0, "avg": 2.0},
+		},
+		{
+			name: "functions",
+			src: `
+program Main;
+   var a, b : integer;
+   var h : real;
+
+   function Square(x : integer) : integer;
+   begin
+      Square := x * x
+   end;
+
+   function Half(x : real) : real;
+   begin
+      Half := x / 2
+   end;
+
+   function Seven : integer;
+   begin
+      Seven := 7
+   end;
+
+begin
+   a := Square(Square(2)) + Seven;
+   b := Seven * 2;
+   h := Half(Square(3))
+end.
+`,
+			want: map[string]interface{}{"a": 23, "b": 14, "h": 4.5},
+		},
+		{
+			name: "booleans",
+			src: `
+program Main;
+   var x : integer;
+   var a, b, c, d, e, f : boolean;
+
+   function Positive(n : real) : boolean;
+   begin
+      Positive := n > 0
+   end;
+
+begin
+   x := 5;
+   a := x > 3;
+   b := not a or (x = 5);
+   c := (x < 3) xor true;
+   d := Positive(-2.5) and (1 div 0 = 0);
+   e := 1 + 2 * 3 <= 7;
+   f := false <> (x >= 6)
+end.
+`,
+			want: map[string]interface{}{"x": 5, "a": true, "b": true, "c": true, "d": false, "e": true, "f": false},
+		},
+		{
+			name: "control_flow",
+			src: `
+program Main;
+   var fact, fib15, sum, down, steps, i, n : integer;
+   var flips : integer;
+   var b : boolean;
+
+   function Factorial(n : integer) : integer;
+   begin
+      if n <= 1 then
+         Factorial := 1
+      else
+         Factorial := n * Factorial(n - 1)
+   end;
+
+   function Fib(n : integer) : integer;
+   begin
+      if n < 2 then Fib := n else Fib := Fib(n - 1) + Fib(n - 2)
+   end;
+
+begin
+   fact := Factorial(10);
+   fib15 := Fib(15);
+
+   sum := 0;
+   for i := 1 to 10 do
+      sum := sum + i;
+
+   down := 0;
+   for i := 3 downto 1 do
+      down := down * 10 + i;
+   for i := 5 to 1 do
+      down := 0;
+
+   n := 27;
+   steps := 0;
+   while n <> 1 do
+   begin
+      if n - n div 2 * 2 = 0 then n := n div 2 else n := 3 * n + 1;
+      steps := steps + 1
+   end;
+
+   flips := 0;
+   for b := false to true do
+      flips := flips + 1;
+
+   repeat
+      flips := flips * 2
+   until flips > 100
+end.
+`,
+			want: map[string]interface{}{
+				"fact": 3628800, "fib15": 610, "sum": 55, "down": 321, "steps": 111,
+				"i": 1, "n": 1, "flips": 128, "b": true,
+			},
+		},
+		{
+			name: "case",
+			src: `
+program Main;
+   var state, i, ones, teens, tens, others, neg : integer;
+   var flag : boolean;
+begin
+   state := 0;
+   ones := 0; teens := 0; tens := 0; others := 0; neg := 0;
+   for i := -2 to 25 do
+      case i of
+         0..9: ones := ones + 1;
+         11, 13, 15, 17, 19: teens := teens + 1;
+         10, 20: tens := tens + 1;
+         -2, -1: neg := neg + 1;
+      else
+         others := others + 1
+      end;
+
+   for i := 1 to 5 do
+      case state of
+         0: state := 1;
+         1: begin state := 2 end;
+         2: state := 0
+      end;
+
+   flag := false;
+   case i > 3 of
+      true: flag := true
+   end
+end.
+`,
+			want: map[string]interface{}{
+				"state": 2, "i": 5, "ones": 10, "teens": 5, "tens": 2, "others": 9, "neg": 2, "flag": true,
+			},
+		},
+		{
+			name: "constants",
+			src: `
+program Main;
+const
+   Low = 1;
+   High = Low + 9;
+   Half = High / 4;
+   Debug = not true;
+var i, sum, small : integer;
+   r : real;
+   flag : boolean;
+begin
+   sum := 0; small := 0;
+   for i := Low to High do
+   begin
+      sum := sum + i;
+      case i of
+         Low..High div 2: small := small + 1
+      end
+   end;
+   r := Half;
+   flag := Debug
+end.
+`,
+			want: map[string]interface{}{"i": 10, "sum": 55, "small": 5, "r": 2.5, "flag": false},
+		},
+		{
+			name: "types",
+			src: `
+program Main;
+const Max = 10;
+type
+   Color = (Red, Green, Blue);
+   Index = 1..Max;
+   Whole = integer;
+   Warm = Red..Green;
+var c : Color;
+   w : Warm;
+   i : Index;
+   n, reds : Whole;
+   flag : boolean;
+   digit : 0..9;
+
+   function Next(c : Color) : Color;
+   begin
+      if c = Blue then Next := Red else
+      if c = Red then Next := Green else Next := Blue
+   end;
+
+begin
+   n := 0; reds := 0;
+   for i := 1 to Max do n := n + i;
+   c := Red;
+   for i := 1 to 7 do
+   begin
+      c := Next(c);
+      case c of
+         Red: reds := reds + 1;
+         Green..Blue: ;
+      end
+   end;
+   w := Green;
+   flag := (w > Red) and (c < Blue);
+   digit := 9
+end.
+`,
+			want: map[string]interface{}{"c": 1, "w": 1, "i": 7, "n": 55, "reds": 2, "flag": true, "digit": 9},
+		},
+		{
+			name: "arrays",
+			src: `
+program Main;
+type
+   Color = (Red, Green, Blue);
+   Vector = array[1..5] of integer;
+var v, w : Vector;
+   m : array[1..3, 1..3] of integer;
+   counts : array[Color] of integer;
+   d : array of real;
+   i, j, sum, trace, len : integer;
+   c : Color;
+
+   function Total(v : Vector) : integer;
+      var i, sum : integer;
+   begin
+      sum := 0;
+      for i := 1 to 5 do
+      begin
+         sum := sum + v[i];
+         v[i] := 0
+      end;
+      Total := sum
+   end;
+
+begin
+   for i := 1 to 5 do v[i] := i * i;
+   w := v;
+   w[1] := 100;
+   sum := Total(v);
+
+   for i := 1 to 3 do
+      for j := 1 to 3 do
+         if i = j then m[i, j] := 1 else m[i][j] := 0;
+   trace := 0;
+   for i := 1 to 3 do trace := trace + m[i, i];
+
+   for c := Red to Blue do counts[c] := 0;
+   counts[Green] := counts[Green] + 2;
+
+   setlength(d, 2);
+   d[0] := 1;
+   d[1] := d[0] / 4;
+   setlength(d, 3);
+   len := length(d) + length(v)
+end.
+`,
+			want: map[string]interface{}{
+				"v": "[1 4 9 16 25]", "w": "[100 4 9 16 25]", "m": "[[1 0 0] [0 1 0] [0 0 1]]",
+				"counts": "[0 2 0]", "d": "[1 0.25 <nil>]",
+				"i": 3, "j": 3, "sum": 55, "trace": 3, "len": 8, "c": 2,
+			},
+		},
+		{
+			name: "records",
+			src: `
+program Main;
+type
+   Point = record x, y : integer end;
+   Segment = record
+      a, b : Point;
+      len : real;
+   end;
+var s, t : Segment;
+   pts : array[1..2] of Point;
+   p : Point;
+   i, dx : integer;
+
+   function Width(s : Segment) : integer;
+   begin
+      s.a.x := 0;
+      Width := s.b.x - s.a.x
+   end;
+
+begin
+   s.a.x := 1; s.a.y := 2;
+   s.b.x := 4; s.b.y := 6;
+   with s do len := b.x - a.x;
+   t := s;
+   t.a.x := 10;
+   dx := Width(s);
+
+   for i := 1 to 2 do
+      with pts[i], s.b do
+      begin
+         pts[i].x := i;
+         y := x * 10
+      end;
+   p := pts[2]
+end.
+`,
+			want: map[string]interface{}{
+				"s":   "{a: {x: 1, y: 2}, b: {x: 4, y: 40}, len: 3}",
+				"t":   "{a: {x: 10, y: 2}, b: {x: 4, y: 6}, len: 3}",
+				"pts": "[{x: 1, y: <nil>} {x: 2, y: <nil>}]",
+				"p":   "{x: 2, y: <nil>}",
+				"i":   2, "dx": 4,
+			},
+		},
+		{
+			name: "with_after_assignment",
+			src: `
+program Main;
+type Point = record x, y : integer end;
+var p, q : Point;
+   a, b : array[1..2] of Point;
+begin
+   q.x := 1; q.y := 1;
+   b[1] := q; b[2] := q;
+   with p do
+   begin
+      p := q;
+      x := 2
+   end;
+   with a[2] do
+   begin
+      a := b;
+      y := 3
+   end
+end.
+`,
+			want: map[string]interface{}{
+				"p": "{x: 2, y: 1}", "q": "{x: 1, y: 1}",
+				"a": "[{x: 1, y: 1} {x: 1, y: 3}]", "b": "[{x: 1, y: 1} {x: 1, y: 1}]",
+			},
+		},
+		{
+			name: "variant_records",
+			src: `
+program Main;
+type
+   Kind = (Circle, Rect, Empty);
+   Shape = record
+      x, y : integer;
+      case kind : Kind of
+         Circle: (r : integer);
+         Rect: (w, h : integer;
+            case square : boolean of
+               true: (side : integer);
+               false: ());
+         Empty: ()
+   end;
+   Cell = record
+      case integer of
+         0: (i : integer);
+         1: (b : boolean)
+   end;
+var shapes : array[1..3] of Shape;
+   c : Cell;
+   k, area : integer;
+begin
+   with shapes[1] do begin kind := Circle; r := 2 end;
+   with shapes[2] do begin kind := Rect; square := false; w := 3; h := 4 end;
+   with shapes[3] do begin kind := Rect; square := true; side := 5 end;
+   area := 0;
+   for k := 1 to 3 do
+      with shapes[k] do
+         case kind of
+            Circle: area := area + 3 * r * r;
+            Rect: if square then area := area + side * side else area := area + w * h
+         end;
+   c.i := 7;
+   c.b := true
+end.
+`,
+			want: map[string]interface{}{
+				"shapes": "[{x: <nil>, y: <nil>, kind: 0, r: 2, w: <nil>, h: <nil>, square: <nil>, side: <nil>} " +
+					"{x: <nil>, y: <nil>, kind: 1, r: <nil>, w: 3, h: 4, square: false, side: <nil>} " +
+					"{x: <nil>, y: <nil>, kind: 1, r: <nil>, w: <nil>, h: <nil>, square: true, side: 5}]",
+				"c": "{i: 7, b: true}", "k": 3, "area": 49,
+			},
+		},
+		{
+			name: "strings",
+			src: `
+program Main;
+const Greeting = 'Hello';
+type Lower = 'a'..'z';
+var s, t, u, d, r : string;
+   c, first : char;
+   l : Lower;
+   n, p, vowels, i : integer;
+   less, same : boolean;
+   counts : array['a'..'e'] of integer;
+begin
+   s := Greeting + ', ' + 'world';
+   t := 'it''s';
+   c := s[1];
+   s[1] := 'J';
+   n := length(s);
+   p := pos('world', s);
+   u := copy(s, 8, 5);
+   d := concat(t, ' ', upcase(u), '!');
+   insert('big ', u, 1);
+   r := 'abcdef';
+   delete(r, 2, 3);
+   first := upcase('q');
+   l := 'm';
+   less := 'abc' < 'abd';
+   same := 'x' = c;
+   vowels := 0;
+   for i := 1 to length(s) do
+      case s[i] of
+         'a', 'e', 'i', 'o', 'u': vowels := vowels + 1
+      end;
+   for c := 'a' to 'e' do counts[c] := ord(c) - ord('a');
+   c := chr(ord('A') + 2)
+end.
+`,
+			want: map[string]interface{}{
+				"s": "Jello, world", "t": "it's", "u": "big world", "d": "it's WORLD!", "r": "aef",
+				"c": 'C', "first": 'Q', "l": 'm', "n": 12, "p": 8, "vowels": 3, "i": 12,
+				"less": true, "same": false, "counts": "[0 1 2 3 4]",
+			},
+		},
+		{
+			name: "var_params",
+			src: `
+program Main;
+type Pair = record a, b : integer end;
+   Triple = array[1..3] of integer;
+var x, y, calls : integer;
+   row : Triple;
+   p : Pair;
+   s, t : string;
+
+procedure Swap(var a, b : integer);
+var tmp : integer;
+begin
+   tmp := a; a := b; b := tmp
+end;
+
+procedure Fill(var r : Triple; const v : integer);
+var i : integer;
+begin
+   for i := 1 to 3 do r[i] := v * i
+end;
+
+procedure Twice(var n : integer);
+begin
+   Swap(n, n); n := n * 2
+end;
+
+procedure Count(var n : integer; v : integer);
+begin
+   n := n + v; v := 0
+end;
+
+procedure Init(var n : integer);
+begin
+   n := 10
+end;
+
+function Next(var n : integer) : integer;
+begin
+   n := n + 1; Next := n
+end;
+
+procedure SwapText(var a, b : string);
+var tmp : string;
+begin
+   tmp := a; a := b; b := tmp
+end;
+
+begin
+   x := 1; y := 2;
+   Swap(x, y);
+   Fill(row, 5);
+   Swap(row[1], row[3]);
+   p.a := 7; p.b := 8;
+   Swap(p.a, p.b);
+   with p do Twice(a);
+   Init(calls);
+   Count(calls, x);
+   calls := calls + Next(calls);
+   s := 'left'; t := 'right';
+   SwapText(s, t)
+end.
+`,
+			want: map[string]interface{}{
+				"x": 2, "y": 1, "row": "[15 10 5]", "p": "{a: 16, b: 7}", "calls": 25,
+				"s": "right", "t": "left",
+			},
+		},
+		{
+			name: "var_params_after_assignment",
+			src: `
+program Main;
+type Point = record x, y : integer end;
+var p, q : Point;
+   a, b : array[1..2] of Point;
+
+procedure ResetPoint(var k : integer);
+begin
+   p := q; k := 5
+end;
+
+procedure ResetRow(var k : integer);
+begin
+   a := b; k := 5
+end;
+
+begin
+   q.x := 1; q.y := 1;
+   p.x := 2; p.y := 2;
+   b[1] := q; b[2] := q;
+   a[1] := p; a[2] := p;
+   ResetPoint(p.x);
+   ResetRow(a[2].y)
+end.
+`,
+			want: map[string]interface{}{
+				"p": "{x: 5, y: 1}", "q": "{x: 1, y: 1}",
+				"a": "[{x: 1, y: 1} {x: 1, y: 5}]", "b": "[{x: 1, y: 1} {x: 1, y: 1}]",
+			},
+		},
+		{
+			name: "forward",
+			src: `
+program Main;
+var even, odd : boolean;
+   steps, halved : integer;
+
+function IsOdd(n : integer) : boolean; forward;
+procedure Count(var total : integer; n : integer); forward;
+function Half(n : integer) : integer; forward;
+
+function IsEven(n : integer) : boolean;
+begin
+   if n = 0 then IsEven := true else IsEven := IsOdd(n - 1)
+end;
+
+function IsOdd(n : integer) : boolean;
+begin
+   if n = 0 then IsOdd := false else IsOdd := IsEven(n - 1)
+end;
+
+procedure Count;
+begin
+   total := total + n;
+   if n > 0 then Count(total, n - 1)
+end;
+
+function Half;
+begin
+   Half := n div 2
+end;
+
+begin
+   even := IsEven(10);
+   odd := IsOdd(10);
+   steps := 0;
+   Count(steps, 4);
+   halved := Half(9)
+end.
+`,
+			want: map[string]interface{}{"even": true, "odd": false, "steps": 10, "halved": 4},
+		},
+		{
+			name: "assignment_compatibility",
+			src: `
+program Main;
+type Digit = 0..9;
+   Color = (Red, Green);
+var r : real;
+   n : integer;
+   d : Digit;
+   s : string;
+   c : Color;
+begin
+   r := 3;
+   r := r / 2 + 7 div 2;
+   d := 4;
+   n := d * 2;
+   s := 'x';
+   c := Green
+end.
+`,
+			want: map[string]interface{}{"r": 4.5, "n": 8, "d": 4, "s": "x", "c": 1},
+		},
+		{
+			name: "mixed_arithmetic",
+			src: `
+program Main;
+const Half = -1 / 2;
+   Big = 2 * 3 - -4;
+var r : real;
+   n : integer;
+   b, less : boolean;
+   c : char;
+begin
+   r := -Half * 3;
+   n := Big div 3 - 7;
+   c := 'a';
+   b := (c < 'b') and (c + 'z' = 'az');
+   less := false < true
+end.
+`,
+			want: map[string]interface{}{"r": 1.5, "n": -4, "b": true, "less": true, "c": 'a'},
+		},
+		{
+			name:    "syntax_error",
+			src:     `program Main; begin x := end`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		for _, backend := range backends {
+			t.Run(backend.name+"/"+tt.name, func(t *testing.T) {
+				i, err := New(strings.NewReader(tt.src), backend.opts...)
+				if err != nil {
+					t.Fatalf("New() error = %v", err)
+				}
+				got, err := i.Run(context.Background())
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("Run() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				for name, v := range got {
+					if s, ok := v.(fmt.Stringer); ok {
+						got[name] = s.String()
+					}
+				}
+				if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("Run() = %v, want %v", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		src      string
+		wantType errors.Type
+		wantCode errors.Code
+	}{
+		{
+			name:     "lexer",
+			src:      `program Main; begin x := 1 # 2 end.`,
+			wantType: errors.LexerError,
+			wantCode: errors.UnexpectedCharacter,
+		},
+		{
+			name:     "unterminated_comment",
+			src:      `program Main; begin { never closed end.`,
+			wantType: errors.LexerError,
+			wantCode: errors.UnterminatedComment,
+		},
+		{
+			name:     "unterminated_string",
+			src:      `program Main; var s : string; begin s := 'open end.`,
+			wantType: errors.LexerError,
+			wantCode: errors.UnterminatedString,
+		},
+		{
+			name:     "invalid_number",
+			src:      `program Main; var n : integer; begin n := 99999999999999999999 end.`,
+			wantType: errors.LexerError,
+			wantCode: errors.InvalidNumber,
+		},
+		{
+			name:     "parser",
+			src:      `program Main; var x : integer; begin x := 1 x := 2 end.`,
+			wantType: errors.ParserError,
+			wantCode: errors.UnexpectedToken,
+		},
+		{
+			name:     "undeclared",
+			src:      `program Main; begin x := 1 end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.IDNotFound,
+		},
+		{
+			name:     "duplicate",
+			src:      `program Main; var x : integer; var x : real; begin end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.DuplicateID,
+		},
+		{
+			name:     "wrong_params_num",
+			src:      `program Main; procedure P(a : integer); begin end; begin P(1, 2) end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.WrongParamsNum,
+		},
+		{
+			name:     "incompatible_param",
+			src:      `program Main; procedure P(a : integer); begin end; begin P(1.5) end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.IncompatibleTypes,
+		},
+		{
+			name:     "call_variable",
+			src:      `program Main; var x : integer; begin x(1) end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.InvalidIdentifier,
+		},
+		{
+			name:     "infinite_recursion",
+			src:      `program Main; procedure P; begin P end; begin P end.`,
+			wantType: errors.RuntimeError,
+			wantCode: errors.StackOverflow,
+		},
+		{
+			name:     "procedure_in_expression",
+			src:      `program Main; var x : integer; procedure P(a : integer); begin end; begin x := P(1) end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.InvalidIdentifier,
+		},
+		{
+			name:     "missing_result",
+			src:      `program Main; var x : integer; function F : integer; begin end; begin x := F end.`,
+			wantType: errors.RuntimeError,
+			wantCode: errors.UninitializedVar,
+		},
+		{
+			name:     "boolean_arithmetic",
+			src:      `program Main; var x : integer; begin x := true + 1 end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.IncompatibleTypes,
+		},
+		{
+			name:     "integer_logic",
+			src:      `program Main; var b : boolean; begin b := not 1 end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.IncompatibleTypes,
+		},
+		{
+			name:     "integer_condition",
+			src:      `program Main; var x : integer; begin while x do x := 1 end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.IncompatibleTypes,
+		},
+		{
+			name:     "nonlocal_control",
+			src:      `program Main; var i : integer; procedure P; begin for i := 1 to 2 do end; begin end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.InvalidForControl,
+		},
+		{
+			name:     "real_control",
+			src:      `program Main; var r : real; begin for r := 1 to 2 do end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.InvalidForControl,
+		},
+		{
+			name:     "assign_control",
+			src:      `program Main; var i : integer; begin for i := 1 to 2 do i := 5 end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.InvalidForControl,
+		},
+		{
+			name:     "overlapping_labels",
+			src:      `program Main; var x : integer; begin case x of 1..5: x := 0; 5: x := 1 end end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.DuplicateCaseLabel,
+		},
+		{
+			name:     "label_type",
+			src:      `program Main; var x : integer; begin case x of true: x := 0 end end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.IncompatibleTypes,
+		},
+		{
+			name:     "variable_label",
+			src:      `program Main; var x, y : integer; begin case x of y: x := 0 end end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.NotConstant,
+		},
+		{
+			name:     "real_selector",
+			src:      `program Main; var r : real; begin case r of 1: r := 0 end end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.IncompatibleTypes,
+		},
+		{
+			name:     "division_by_zero",
+			src:      `program Main; var x : integer; begin x := 1 div 0 end.`,
+			wantType: errors.RuntimeError,
+			wantCode: errors.DivisionByZero,
+		},
+		{
+			name:     "assign_constant",
+			src:      `program Main; const N = 3; begin N := 4 end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.AssignToConstant,
+		},
+		{
+			name:     "constant_from_variable",
+			src:      `program Main; var x : integer; const N = x + 1; begin end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.NotConstant,
+		},
+		{
+			name:     "constant_division_by_zero",
+			src:      `program Main; const N = 1 div 0; begin end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.DivisionByZero,
+		},
+		{
+			name:     "subrange_overflow",
+			src:      `program Main; var d : 0..9; i : integer; begin i := 9; d := i + 1 end.`,
+			wantType: errors.RuntimeError,
+			wantCode: errors.OutOfRange,
+		},
+		{
+			name:     "subrange_param",
+			src:      `program Main; type Small = 1..3; procedure P(s : Small); begin end; begin P(4) end.`,
+			wantType: errors.RuntimeError,
+			wantCode: errors.OutOfRange,
+		},
+		{
+			name:     "empty_subrange",
+			src:      `program Main; type Empty = 5..1; begin end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.InvalidRange,
+		},
+		{
+			name:     "mixed_enums",
+			src:      `program Main; type A = (X, Y); B = (Z, W); var v : A; begin v := X; if v = Z then v := Y end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.IncompatibleTypes,
+		},
+		{
+			name:     "unknown_type",
+			src:      `program Main; var a : Missing; begin end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.IDNotFound,
+		},
+		{
+			name:     "duplicate_enum_value",
+			src:      `program Main; type A = (X, Y); B = (Y, Z); begin end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.DuplicateID,
+		},
+		{
+			name:     "index_out_of_bounds",
+			src:      `program Main; var a : array[1..3] of integer; i : integer; begin i := 4; a[i] := 1 end.`,
+			wantType: errors.RuntimeError,
+			wantCode: errors.OutOfRange,
+		},
+		{
+			name:     "dynamic_out_of_bounds",
+			src:      `program Main; var a : array of integer; begin setlength(a, 2); a[2] := 1 end.`,
+			wantType: errors.RuntimeError,
+			wantCode: errors.OutOfRange,
+		},
+		{
+			name:     "uninitialized_element",
+			src:      `program Main; var a : array[1..3] of integer; i : integer; begin i := a[2] end.`,
+			wantType: errors.RuntimeError,
+			wantCode: errors.UninitializedVar,
+		},
+		{
+			name:     "index_scalar",
+			src:      `program Main; var i : integer; begin i[1] := 2 end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.IncompatibleTypes,
+		},
+		{
+			name:     "real_index",
+			src:      `program Main; var a : array[1..3] of integer; begin a[1.5] := 2 end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.IncompatibleTypes,
+		},
+		{
+			name:     "huge_setlength",
+			src:      `program Main; var a : array of integer; begin setlength(a, 10000000000000) end.`,
+			wantType: errors.RuntimeError,
+			wantCode: errors.OutOfRange,
+		},
+		{
+			name:     "huge_setlength_of_arrays",
+			src:      `program Main; var a : array of array[1..100000] of integer; begin setlength(a, 100000) end.`,
+			wantType: errors.RuntimeError,
+			wantCode: errors.OutOfRange,
+		},
+		{
+			name:     "huge_static_array",
+			src:      `program Main; var a : array[1..2000000000] of integer; begin end.`,
+			wantType: errors.RuntimeError,
+			wantCode: errors.OutOfRange,
+		},
+		{
+			name: "huge_local_array",
+			src: `program Main;
+procedure P; var a : array[-9000000000000000000..9000000000000000000] of integer; begin end;
+begin P end.`,
+			wantType: errors.RuntimeError,
+			wantCode: errors.OutOfRange,
+		},
+		{
+			name:     "huge_nested_array",
+			src:      `program Main; var a : array[1..10000, 1..10000] of record x, y : integer end; begin end.`,
+			wantType: errors.RuntimeError,
+			wantCode: errors.OutOfRange,
+		},
+		{
+			name:     "setlength_static",
+			src:      `program Main; var a : array[1..3] of integer; begin setlength(a, 2) end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.IncompatibleTypes,
+		},
+		{
+			name:     "unknown_field",
+			src:      `program Main; var r : record x : integer end; begin r.z := 1 end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.IDNotFound,
+		},
+		{
+			name:     "duplicate_field",
+			src:      `program Main; var r : record x : integer; x : real end; begin end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.DuplicateID,
+		},
+		{
+			name:     "with_scalar",
+			src:      `program Main; var i : integer; begin with i do i := 1 end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.IncompatibleTypes,
+		},
+		{
+			name:     "uninitialized_field",
+			src:      `program Main; var r : record x, y : integer end; begin r.x := r.y end.`,
+			wantType: errors.RuntimeError,
+			wantCode: errors.UninitializedVar,
+		},
+		{
+			name:     "variant_label_type",
+			src:      `program Main; type R = record case b : boolean of 1: (i : integer) end; begin end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.IncompatibleTypes,
+		},
+		{
+			name:     "duplicate_variant_label",
+			src:      `program Main; type R = record case integer of 1: (i : integer); 1: (b : boolean) end; begin end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.DuplicateCaseLabel,
+		},
+		{
+			name:     "duplicate_variant_field",
+			src:      `program Main; type R = record i : integer; case integer of 1: (i : integer) end; begin end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.DuplicateID,
+		},
+		{
+			name:     "string_index_out_of_bounds",
+			src:      `program Main; var s : string; c : char; begin s := 'abc'; c := s[4] end.`,
+			wantType: errors.RuntimeError,
+			wantCode: errors.OutOfRange,
+		},
+		{
+			name:     "string_minus",
+			src:      `program Main; var s : string; begin s := 'abc' - 'b' end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.IncompatibleTypes,
+		},
+		{
+			name:     "builtin_arguments",
+			src:      `program Main; var n : integer; begin n := pos('a') end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.WrongParamsNum,
+		},
+		{
+			name:     "upcase_integer",
+			src:      `program Main; var c : char; begin c := upcase(1) end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.IncompatibleTypes,
+		},
+		{
+			name:     "char_subrange",
+			src:      `program Main; var l : 'a'..'f'; s : string; begin s := 'z'; l := s[1] end.`,
+			wantType: errors.RuntimeError,
+			wantCode: errors.OutOfRange,
+		},
+		{
+			name:     "format_outside_write",
+			src:      `program Main; var s : string; begin s := copy('abc':2, 1, 1) end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.UnexpectedToken,
+		},
+		{
+			name:     "decimals_on_integer",
+			src:      `program Main; begin writeln(1:4:2) end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.IncompatibleTypes,
+		},
+		{
+			name:     "real_width",
+			src:      `program Main; begin writeln(1:4.0) end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.IncompatibleTypes,
+		},
+		{
+			name:     "huge_width",
+			src:      `program Main; begin writeln(1:100000000000) end.`,
+			wantType: errors.RuntimeError,
+			wantCode: errors.OutOfRange,
+		},
+		{
+			name:     "huge_precision",
+			src:      `program Main; var x : real; begin x := 1; writeln(x:1:1000000000) end.`,
+			wantType: errors.RuntimeError,
+			wantCode: errors.OutOfRange,
+		},
+		{
+			name:     "write_array",
+			src:      `program Main; var a : array[1..2] of integer; begin writeln(a) end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.IncompatibleTypes,
+		},
+		{
+			name:     "read_boolean",
+			src:      `program Main; var b : boolean; begin read(b) end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.IncompatibleTypes,
+		},
+		{
+			name:     "read_constant",
+			src:      `program Main; const N = 1; begin read(N) end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.AssignToConstant,
+		},
+		{
+			name:     "write_as_function",
+			src:      `program Main; var n : integer; begin n := write(1) end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.InvalidIdentifier,
+		},
+		{
+			name:     "var_arg_literal",
+			src:      `program Main; procedure P(var n : integer); begin end; begin P(1) end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.InvalidIdentifier,
+		},
+		{
+			name:     "var_arg_expression",
+			src:      `program Main; var x : integer; procedure P(var n : integer); begin end; begin x := 1; P(x + 1) end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.InvalidIdentifier,
+		},
+		{
+			name:     "var_arg_type",
+			src:      `program Main; var x : real; procedure P(var n : integer); begin end; begin P(x) end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.IncompatibleTypes,
+		},
+		{
+			name:     "var_arg_constant",
+			src:      `program Main; const N = 1; procedure P(var n : integer); begin end; begin P(N) end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.AssignToConstant,
+		},
+		{
+			name:     "var_arg_string_element",
+			src:      `program Main; var s : string; procedure P(var c : char); begin end; begin s := 'ab'; P(s[1]) end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.InvalidIdentifier,
+		},
+		{
+			name:     "assign_const_param",
+			src:      `program Main; procedure P(const n : integer); begin n := 2 end; begin P(1) end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.AssignToConstant,
+		},
+		{
+			name:     "const_param_as_var_arg",
+			src:      `program Main; procedure Q(var n : integer); begin end; procedure P(const n : integer); begin Q(n) end; begin P(1) end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.AssignToConstant,
+		},
+		{
+			name:     "var_param_control",
+			src:      `program Main; var x : integer; procedure P(var n : integer); begin for n := 1 to 2 do end; begin P(x) end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.InvalidForControl,
+		},
+		{
+			name:     "var_arg_uninitialized",
+			src:      `program Main; var x, y : integer; procedure P(var n : integer); begin y := n end; begin P(x) end.`,
+			wantType: errors.RuntimeError,
+			wantCode: errors.UninitializedVar,
+		},
+		{
+			name:     "forward_param_type",
+			src:      `program Main; procedure P(n : integer); forward; procedure P(n : real); begin end; begin end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.ForwardMismatch,
+		},
+		{
+			name:     "forward_param_mode",
+			src:      `program Main; procedure P(var n : integer); forward; procedure P(n : integer); begin end; begin end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.ForwardMismatch,
+		},
+		{
+			name:     "forward_result_type",
+			src:      `program Main; function F : integer; forward; function F : boolean; begin F := true end; begin end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.ForwardMismatch,
+		},
+		{
+			name:     "forward_function_as_procedure",
+			src:      `program Main; function F : integer; forward; procedure F; begin end; begin end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.ForwardMismatch,
+		},
+		{
+			name:     "forward_procedure_as_function",
+			src:      `program Main; procedure P; forward; function P; begin end; begin end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.ForwardMismatch,
+		},
+		{
+			name:     "missing_result_type",
+			src:      `program Main; function F; begin F := 1 end; begin end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.MissingResultType,
+		},
+		{
+			name:     "forward_missing_body",
+			src:      `program Main; procedure P; forward; begin P end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.MissingBody,
+		},
+		{
+			name:     "forward_missing_body_nested",
+			src:      `program Main; procedure P; procedure Q; forward; begin end; begin P end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.MissingBody,
+		},
+		{
+			name:     "forward_twice",
+			src:      `program Main; procedure P; forward; procedure P; forward; procedure P; begin end; begin end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.DuplicateID,
+		},
+		{
+			name:     "body_twice",
+			src:      `program Main; procedure P; forward; procedure P; begin end; procedure P; begin end; begin end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.DuplicateID,
+		},
+		{
+			name:     "real_to_integer",
+			src:      `program Main; var n : integer; begin n := 1.5 end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.IncompatibleTypes,
+		},
+		{
+			name:     "float_div_to_integer",
+			src:      `program Main; var n : integer; begin n := 4 / 2 end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.IncompatibleTypes,
+		},
+		{
+			name:     "div_on_real",
+			src:      `program Main; var r : real; begin r := 4.0 div 2 end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.IncompatibleTypes,
+		},
+		{
+			name:     "boolean_to_integer",
+			src:      `program Main; var n : integer; begin n := 1 < 2 end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.IncompatibleTypes,
+		},
+		{
+			name:     "enum_assignment",
+			src:      `program Main; type A = (X, Y); B = (Z, W); var v : A; begin v := Z end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.IncompatibleTypes,
+		},
+		{
+			name:     "string_to_char",
+			src:      `program Main; var c : char; begin c := 'ab' end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.IncompatibleTypes,
+		},
+		{
+			name:     "real_function_result",
+			src:      `program Main; function F : integer; begin F := 2.5 end; begin end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.IncompatibleTypes,
+		},
+		{
+			name:     "real_to_integer_element",
+			src:      `program Main; var a : array[1..2] of integer; begin a[1] := 0.5 end.`,
+			wantType: errors.SemanticError,
+			wantCode: errors.IncompatibleTypes,
+		},
+		{
+			name:     "uninitialized",
+			src:      `program Main; var x, y : integer; begin x := y end.`,
+			wantType: errors.RuntimeError,
+			wantCode: errors.UninitializedVar,
+		},
+	}
+	for _, tt := range tests {
+		for _, backend := range backends {
+			t.Run(backend.name+"/"+tt.name, func(t *testing.T) {
+				i, err := New(strings.NewReader(tt.src), backend.opts...)
+				if err != nil {
+					t.Fatalf("New() error = %v", err)
+				}
+				_, err = i.Run(context.Background())
+				e, ok := err.(*errors.Error)
+				if !ok {
+					t.Fatalf("Run() error = %v (%T), want *errors.Error", err, err)
+				}
+				if e.Type() != tt.wantType || e.Code() != tt.wantCode {
+					t.Errorf("Run() error = %v, want %s: %s", e, tt.wantType, tt.wantCode)
+				}
+			})
+		}
+	}
+}
+
+func TestRunIndexPosition(t *testing.T) {
+	src := `program Main;
+var a : array[0..2, 0..2] of integer;
+begin
+   a[1,  1 + 2] := 0
+end.`
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			i, err := New(strings.NewReader(src), backend.opts...)
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			_, err = i.Run(context.Background())
+			e, ok := err.(*errors.Error)
+			if !ok || e.Code() != errors.OutOfRange {
+				t.Fatalf("Run() error = %v, want %s", err, errors.OutOfRange)
+			}
+			if e.Line != 4 || e.Column != 10 {
+				t.Errorf("error at %d:%d, want 4:10", e.Line, e.Column)
+			}
+		})
+	}
+}
+
+func TestRunTypeErrorPosition(t *testing.T) {
+	src := `program Main;
+var n : integer;
+begin
+   n := 1;
+   n := n * 2 / 2
+end.`
+	i, err := New(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	_, err = i.Run(context.Background())
+	e, ok := err.(*errors.Error)
+	if !ok || e.Type() != errors.SemanticError || e.Code() != errors.IncompatibleTypes {
+		t.Fatalf("Run() error = %v, want %s: %s", err, errors.SemanticError, errors.IncompatibleTypes)
+	}
+	if e.Line != 5 || e.Column != 9 {
+		t.Errorf("error at %d:%d, want 5:9", e.Line, e.Column)
+	}
+}
+
+func TestRunVariantChecks(t *testing.T) {
+	const decls = `
+program Main;
+type
+   Kind = (Circle, Rect);
+   Shape = record
+      case kind : Kind of
+         Circle: (r : integer);
+         Rect: (w : integer; case boolean of true: (h : integer); false: (d : integer))
+   end;
+   Cell = record case integer of 0: (i : integer); 1: (b : boolean) end;
+var s : Shape;
+   c : Cell;
+   n : integer;
+   f : boolean;
+`
+	tests := []struct {
+		name    string
+		body    string
+		wantErr bool
+	}{
+		{name: "active_tag", body: `s.kind := Circle; s.r := 1; n := s.r`},
+		{name: "inactive_tag", body: `s.kind := Circle; s.r := 1; s.kind := Rect; n := s.r`, wantErr: true},
+		{name: "unset_tag", body: `s.r := 1; n := s.r`, wantErr: true},
+		{name: "nested_active", body: `s.kind := Rect; s.h := 2; n := s.h`},
+		{name: "nested_inactive", body: `s.kind := Rect; s.h := 2; s.d := 3; n := s.h`, wantErr: true},
+		{name: "nested_outer_inactive", body: `s.kind := Rect; s.h := 2; s.kind := Circle; n := s.h`, wantErr: true},
+		{name: "tagless_last_written", body: `c.i := 1; c.b := true; f := c.b`},
+		{name: "tagless_inactive", body: `c.i := 1; c.b := true; n := c.i`, wantErr: true},
+		{name: "with", body: `with c do begin i := 1; b := true; n := i end`, wantErr: true},
+	}
+	for _, tt := range tests {
+		for _, backend := range backends {
+			t.Run(backend.name+"/"+tt.name, func(t *testing.T) {
+				src := decls + "begin " + tt.body + " end."
+				for _, checked := range []bool{false, true} {
+					opts := append([]Option{}, backend.opts...)
+					if checked {
+						opts = append(opts, WithVariantChecks())
+					}
+					i, err := New(strings.NewReader(src), opts...)
+					if err != nil {
+						t.Fatalf("New() error = %v", err)
+					}
+					_, err = i.Run(context.Background())
+					if !checked || !tt.wantErr {
+						if err != nil {
+							t.Errorf("Run() checked=%v error = %v", checked, err)
+						}
+						continue
+					}
+					if e, ok := err.(*errors.Error); !ok || e.Code() != errors.InactiveVariant {
+						t.Errorf("Run() checked=%v error = %v, want %s", checked, err, errors.InactiveVariant)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestRunIO(t *testing.T) {
+	tests := []struct {
+		name     string
+		src      string
+		input    string
+		want     string
+		wantCode errors.Code
+	}{
+		{
+			name: "write",
+			src: `program Main; type Color = (Red, Green); var c : Color;
+begin c := Green; write(1, ' ', 2.5, ' ', true, ' ', 'x', ' ', c); writeln; writeln('done') end.`,
+			want: "1 2.5 TRUE x green\ndone\n",
+		},
+		{
+			name: "write_in_argument",
+			src: `program Main;
+function F(line : boolean) : integer;
+begin
+   if line then writeln('c') else write('b');
+   F := 1
+end;
+begin write('a', F(false)); writeln('d', F(true), 'e') end.`,
+			want: "ba1c\nd1e\n",
+		},
+		{
+			name: "real",
+			src:  `program Main; var r : real; begin r := 2; writeln(1.0, ' ', r * 50, ' ', 1 / 4, ' ', -r, ' ', r * 1000000 * 1000000) end.`,
+			want: "1.0 100.0 0.25 -2.0 2e+12\n",
+		},
+		{
+			name: "width",
+			src:  `program Main; begin writeln(42:5, '|', 'ab':4, '|', 3.14159:8:2, '|', 2.5:0:3, '|', 12345:2) end.`,
+			want: "   42|  ab|    3.14|2.500|12345\n",
+		},
+		{
+			name: "computed_width",
+			src:  `program Main; var w : integer; begin w := 3; writeln(1:w + 1, 1.0:w + 2:w - 2) end.`,
+			want: "   1  1.0\n",
+		},
+		{
+			name: "read",
+			src: `program Main; var n, m : integer; x : real; c : char; s : string;
+begin read(n, m); readln(x); read(c); readln(s); writeln(n + m, ' ', x:0:1, ' ', c, s) end.`,
+			input: "1  2\n\t3.75 ignored\nhello world\r\n",
+			want:  "3 3.8 hello world\n",
+		},
+		{
+			name:  "readln_skips_line",
+			src:   `program Main; var a, b : integer; begin readln(a); readln; read(b); write(a * b) end.`,
+			input: "6 7\nskipped\n5",
+			want:  "30",
+		},
+		{
+			name:  "read_into_element",
+			src:   `program Main; var a : array[1..2] of integer; r : record s : string end; begin read(a[2]); readln; readln(r.s); write(a[2], r.s) end.`,
+			input: "9\nfield",
+			want:  "9field",
+		},
+		{
+			name:  "string_at_end",
+			src:   `program Main; var s : string; begin readln(s); write('[', s, ']') end.`,
+			input: "",
+			want:  "[]",
+		},
+		{
+			name:     "bad_integer",
+			src:      `program Main; var n : integer; begin read(n) end.`,
+			input:    "4x",
+			wantCode: errors.InvalidInput,
+		},
+		{
+			name:     "end_of_input",
+			src:      `program Main; var n : integer; begin read(n) end.`,
+			input:    " \n ",
+			wantCode: errors.InvalidInput,
+		},
+		{
+			name:     "read_subrange",
+			src:      `program Main; var d : 1..9; begin read(d) end.`,
+			input:    "10",
+			wantCode: errors.OutOfRange,
+		},
+	}
+	for _, tt := range tests {
+		for _, backend := range backends {
+			t.Run(backend.name+"/"+tt.name, func(t *testing.T) {
+				var out bytes.Buffer
+				i, err := New(strings.NewReader(tt.src), append(backend.opts, WithOutput(&out), WithInput(strings.NewReader(tt.input)))...)
+				if err != nil {
+					t.Fatalf("New() error = %v", err)
+				}
+				_, err = i.Run(context.Background())
+				if tt.wantCode != "" {
+					if e, ok := err.(*errors.Error); !ok || e.Code() != tt.wantCode {
+						t.Fatalf("Run() error = %v, want %s", err, tt.wantCode)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("Run() error = %v", err)
+				}
+				if out.String() != tt.want {
+					t.Errorf("output = %q, want %q", out.String(), tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestRunCanceled(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			i, err := New(strings.NewReader(`program Main; var x : integer; begin x := 0; while true do x := x + 1 end.`), backend.opts...)
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+
+			_, err = i.Run(ctx)
+			e, ok := err.(*errors.Error)
+			if !ok || e.Code() != errors.Canceled {
+				t.Fatalf("Run() error = %v, want %s", err, errors.Canceled)
+			}
+		})
+	}
+}
+
+func TestRunGlobalScope(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			i, err := New(strings.NewReader(`program Main; var x : integer; begin x := 1 end.`), backend.opts...)
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			i.GlobalScope["host"] = true
+
+			got, err := i.Run(context.Background())
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			want := map[string]interface{}{"host": true, "x": 1}
+			if !reflect.DeepEqual(got, want) || !reflect.DeepEqual(i.GlobalScope, want) {
+				t.Errorf("Run() = %v, GlobalScope = %v, want %v", got, i.GlobalScope, want)
+			}
+		})
+	}
+}
+
+func BenchmarkRunLoop(b *testing.B) {
+	const src = `
+program Main;
+var i, sum : integer;
+
+function Square(n : integer) : integer;
+begin
+   Square := n * n
+end;
+
+begin
+   sum := 0;
+   for i := 1 to 10000 do
+      sum := sum + Square(i - i div 7 * 7)
+end.`
+	for _, backend := range backends {
+		b.Run(backend.name, func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				i, err := New(strings.NewReader(src), backend.opts...)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := i.Run(context.Background()); err != nil {
+					b.Fatal(err)
+				}
+			}
 		})
 	}
 }
@@ -15,26 +15,63 @@ const (
 	Comma                    // ","
 	FloatDiv                 // "/"
 	Plus                     // "+"
-	Minus                    // "="
+	Minus                    // "-"
 	Mul                      // "*"
 	Lparen                   // "("
 	Rparen                   // ")"
+	Lbracket                 // "["
+	Rbracket                 // "]"
 	Dot                      // "."
 	Semi                     // ";"
+	Equal                    // "="
+	Less                     // "<"
+	Greater                  // ">"
+	// two character token types
+	NotEqual     // "<>"
+	LessEqual    // "<="
+	GreaterEqual // ">="
 	// reserved words
 	Begin      // "BEGIN"
 	Program    // "PROGRAM"
 	VarT       // "VAR"
+	Const      // "CONST"
+	TypeT      // "TYPE"
 	Integer    // "INTEGER"
 	Real       // "REAL"
+	Boolean    // "BOOLEAN"
+	Char       // "CHAR"
+	StringT    // "STRING"
+	Array      // "ARRAY"
+	Record     // "RECORD"
 	IntegerDiv // "DIV"
+	And        // "AND"
+	Or         // "OR"
+	Xor        // "XOR"
+	Not        // "NOT"
+	If         // "IF"
+	Then       // "THEN"
+	Else       // "ELSE"
+	While      // "WHILE"
+	Do         // "DO"
+	Repeat     // "REPEAT"
+	Until      // "UNTIL"
+	For        // "FOR"
+	To         // "TO"
+	Downto     // "DOWNTO"
+	Case       // "CASE"
+	With       // "WITH"
+	Of         // "OF"
 	Procedure  // "PROCEDURE"
+	Function   // "FUNCTION"
 	End        // "END"
 	// misc
 	Id           // "ID"
 	IntegerConst // "INTEGER_CONST"
 	RealConst    // "REAL_CONST"
+	BooleanConst // "BOOLEAN_CONST"
+	StringConst  // "STRING_CONST"
 	Assign       // ":="
+	Range        // ".."
 	EOF          // "EOF"
 
 	NullRune rune = 0
@@ -46,36 +83,100 @@ var TokenTypes = [...]string{
 	Comma:    ",",
 	FloatDiv: "/",
 	Plus:     "+",
-	Minus:    "=",
+	Minus:    "-",
 	Mul:      "*",
 	Lparen:   "(",
 	Rparen:   ")",
+	Lbracket: "[",
+	Rbracket: "]",
 	Dot:      ".",
 	Semi:     ";",
+	Equal:    "=",
+	Less:     "<",
+	Greater:  ">",
+	// two character token types
+	NotEqual:     "<>",
+	LessEqual:    "<=",
+	GreaterEqual: ">=",
 	// reserved words
 	Program:    "PROGRAM",
 	VarT:       "VAR",
+	Const:      "CONST",
+	TypeT:      "TYPE",
 	Integer:    "INTEGER",
 	Real:       "REAL",
+	Boolean:    "BOOLEAN",
+	Char:       "CHAR",
+	StringT:    "STRING",
+	Array:      "ARRAY",
+	Record:     "RECORD",
 	IntegerDiv: "DIV",
+	And:        "AND",
+	Or:         "OR",
+	Xor:        "XOR",
+	Not:        "NOT",
+	If:         "IF",
+	Then:       "THEN",
+	Else:       "ELSE",
+	While:      "WHILE",
+	Do:         "DO",
+	Repeat:     "REPEAT",
+	Until:      "UNTIL",
+	For:        "FOR",
+	To:         "TO",
+	Downto:     "DOWNTO",
+	Case:       "CASE",
+	With:       "WITH",
+	Of:         "OF",
 	Procedure:  "PROCEDURE",
+	Function:   "FUNCTION",
 	Begin:      "BEGIN",
 	End:        "END",
 	// misc
 	Id:           "ID",
 	IntegerConst: "INTEGER_CONST",
 	RealConst:    "REAL_CONST",
+	BooleanConst: "BOOLEAN_CONST",
+	StringConst:  "STRING_CONST",
 	Assign:       ":=",
+	Range:        "..",
 	EOF:          "EOF",
 }
 
 var ReservedKeywords = map[string]*Token{
 	"program":   {typ: Program, value: "program"},
 	"var":       {typ: VarT, value: "var"},
+	"const":     {typ: Const, value: "const"},
+	"type":      {typ: TypeT, value: "type"},
 	"integer":   {typ: Integer, value: "integer"},
 	"real":      {typ: Real, value: "real"},
+	"boolean":   {typ: Boolean, value: "boolean"},
+	"char":      {typ: Char, value: "char"},
+	"string":    {typ: StringT, value: "string"},
+	"array":     {typ: Array, value: "array"},
+	"record":    {typ: Record, value: "record"},
 	"div":       {typ: IntegerDiv, value: "div"},
+	"and":       {typ: And, value: "and"},
+	"or":        {typ: Or, value: "or"},
+	"xor":       {typ: Xor, value: "xor"},
+	"not":       {typ: Not, value: "not"},
+	"if":        {typ: If, value: "if"},
+	"then":      {typ: Then, value: "then"},
+	"else":      {typ: Else, value: "else"},
+	"while":     {typ: While, value: "while"},
+	"do":        {typ: Do, value: "do"},
+	"repeat":    {typ: Repeat, value: "repeat"},
+	"until":     {typ: Until, value: "until"},
+	"for":       {typ: For, value: "for"},
+	"to":        {typ: To, value: "to"},
+	"downto":    {typ: Downto, value: "downto"},
+	"case":      {typ: Case, value: "case"},
+	"with":      {typ: With, value: "with"},
+	"of":        {typ: Of, value: "of"},
+	"true":      {typ: BooleanConst, value: true},
+	"false":     {typ: BooleanConst, value: false},
 	"procedure": {typ: Procedure, value: "procedure"},
+	"function":  {typ: Function, value: "function"},
 	"begin":     {typ: Begin, value: "begin"},
 	"end":       {typ: End, value: "end"},
 }
@@ -104,19 +205,53 @@ type Lexer struct {
 	column      int
 }
 
+// NewLexer returns a Lexer positioned at the first rune of text.
+func NewLexer(text string) *Lexer {
+	l := &Lexer{
+		text:   []rune(text),
+		lineno: 1,
+		column: 1,
+	}
+	if len(l.text) > 0 {
+		l.currentRune = l.text[0]
+	}
+	return l
+}
+
 func (l *Lexer) next() {
+	if l.pos >= len(l.text) {
+		return
+	}
 	if l.currentRune == '\n' {
 		l.lineno++
 		l.column = 0
 	}
 
 	l.pos++
+	l.column++
 	if l.pos >= len(l.text) {
 		l.currentRune = NullRune
 		return
 	}
 	l.currentRune = l.text[l.pos]
-	l.column++
+}
+
+// position returns the location of the current rune.
+func (l *Lexer) position() Position {
+	return Position{Line: l.lineno, Column: l.column}
+}
+
+// token builds a token that started at start and ends just before the current rune.
+func (l *Lexer) token(typ TokenTyp, value interface{}, start Position) *Token {
+	end := l.position()
+	return &Token{
+		typ:       typ,
+		value:     value,
+		lineno:    start.Line,
+		column:    start.Column,
+		endLineno: end.Line,
+		endColumn: end.Column,
+	}
 }
 
 func (l *Lexer) skipWhitespace() {
@@ -125,75 +260,122 @@ func (l *Lexer) skipWhitespace() {
 	}
 }
 
-func (l *Lexer) skipComment() {
+func (l *Lexer) skipComment() error {
 	for l.currentRune != '}' {
+		if l.currentRune == NullRune {
+			return l.error(errors.UnterminatedComment, "unterminated comment", "skipComment")
+		}
 		l.next()
 	}
 	l.next()
+	return nil
+}
+
+// NextToken scans and returns the next token, or an EOF token at the end of input.
+func (l *Lexer) NextToken() (*Token, error) {
+	return l.getNextToken()
 }
 
-func (l *Lexer) getNextToken() *Token {
+func (l *Lexer) getNextToken() (*Token, error) {
 	for l.currentRune != NullRune {
+		start := l.position()
 		switch r := l.currentRune; {
 		case r == '{':
 			l.next()
-			l.skipComment()
+			if err := l.skipComment(); err != nil {
+				return nil, err
+			}
 			continue
 		case r == ':' && l.peek() == '=':
 			l.next()
 			l.next()
-			return &Token{typ: Assign, value: r}
+			return l.token(Assign, r, start), nil
 		case r == ':':
 			l.next()
-			return &Token{typ: Colon, value: r}
+			return l.token(Colon, r, start), nil
+		case r == '<' && l.peek() == '>':
+			l.next()
+			l.next()
+			return l.token(NotEqual, "<>", start), nil
+		case r == '<' && l.peek() == '=':
+			l.next()
+			l.next()
+			return l.token(LessEqual, "<=", start), nil
+		case r == '>' && l.peek() == '=':
+			l.next()
+			l.next()
+			return l.token(GreaterEqual, ">=", start), nil
+		case r == '<':
+			l.next()
+			return l.token(Less, r, start), nil
+		case r == '>':
+			l.next()
+			return l.token(Greater, r, start), nil
+		case r == '=':
+			l.next()
+			return l.token(Equal, r, start), nil
 		case r == ',':
 			l.next()
-			return &Token{typ: Comma, value: r}
+			return l.token(Comma, r, start), nil
 		case unicode.IsLetter(r) || r == '_':
-			return l.id()
+			return l.id(), nil
 		case unicode.IsSpace(r):
 			l.skipWhitespace()
 		case unicode.IsDigit(r):
 			return l.readNumber()
+		case r == '\'':
+			return l.readString()
 		case r == '+':
 			l.next()
-			return &Token{typ: Plus, value: r}
+			return l.token(Plus, r, start), nil
 		case r == '-':
 			l.next()
-			return &Token{typ: Minus, value: r}
+			return l.token(Minus, r, start), nil
 		case r == '*':
 			l.next()
-			return &Token{typ: Mul, value: r}
+			return l.token(Mul, r, start), nil
 		case r == '/':
 			l.next()
-			return &Token{typ: FloatDiv, value: r}
+			return l.token(FloatDiv, r, start), nil
 		case r == '(':
 			l.next()
-			return &Token{typ: Lparen, value: r}
+			return l.token(Lparen, r, start), nil
 		case r == ')':
 			l.next()
-			return &Token{typ: Rparen, value: r}
+			return l.token(Rparen, r, start), nil
+		case r == '[':
+			l.next()
+			return l.token(Lbracket, r, start), nil
+		case r == ']':
+			l.next()
+			return l.token(Rbracket, r, start), nil
 		case r == ';':
 			l.next()
-			return &Token{typ: Semi, value: r}
+			return l.token(Semi, r, start), nil
+		case r == '.' && l.peek() == '.':
+			l.next()
+			l.next()
+			return l.token(Range, "..", start), nil
 		case r == '.':
 			l.next()
-			return &Token{typ: Dot, value: r}
+			return l.token(Dot, r, start), nil
 		default:
-			l.panic(fmt.Sprintf("Unexpected character occurance: %s", string(r)), "getNextToken")
+			return nil, l.error(errors.UnexpectedCharacter, fmt.Sprintf("Unexpected character occurance: %s", string(r)), "getNextToken")
 		}
 	}
-	return &Token{typ: EOF, value: NullRune}
+	return l.token(EOF, NullRune, l.position()), nil
 }
 
-func (l *Lexer) readNumber() *Token {
+func (l *Lexer) readNumber() (*Token, error) {
+	start := l.position()
 	var numberBuf bytes.Buffer
 	for unicode.IsDigit(l.currentRune) && l.currentRune != NullRune {
 		numberBuf.WriteRune(l.currentRune)
 		l.next()
 	}
 
-	if l.currentRune == '.' {
+	// a dot not followed by a digit starts a ".." range instead of a fraction
+	if l.currentRune == '.' && unicode.IsDigit(l.peek()) {
 		numberBuf.WriteRune(l.currentRune)
 		l.next()
 
@@ -204,13 +386,40 @@ func (l *Lexer) readNumber() *Token {
 
 		realNumber, err := strconv.ParseFloat(numberBuf.String(), 64)
 		if err != nil {
-			l.panic(fmt.Sprintf(`real number parsing from string "%s" error: %v`, numberBuf.String(), err), "readNumber")
+			return nil, l.error(errors.InvalidNumber, fmt.Sprintf(`real number parsing from string "%s" error: %v`, numberBuf.String(), err), "readNumber")
 		}
-		return &Token{typ: RealConst, value: realNumber}
+		return l.token(RealConst, realNumber, start), nil
+	}
+
+	number, err := strconv.Atoi(numberBuf.String())
+	if err != nil {
+		return nil, l.error(errors.InvalidNumber, fmt.Sprintf(`integer parsing from string "%s" error: %v`, numberBuf.String(), err), "readNumber")
 	}
+	return l.token(IntegerConst, number, start), nil
+}
 
-	number, _ := strconv.Atoi(numberBuf.String())
-	return &Token{typ: IntegerConst, value: number}
+// readString reads a quoted literal. Two quotes in a row stand for one quote
+// character. A literal may not span lines.
+func (l *Lexer) readString() (*Token, error) {
+	start := l.position()
+	var buf bytes.Buffer
+	l.next()
+	for {
+		switch {
+		case l.currentRune == NullRune || l.currentRune == '\n':
+			return nil, l.error(errors.UnterminatedString, "unterminated string literal", "readString")
+		case l.currentRune == '\'' && l.peek() == '\'':
+			buf.WriteRune('\'')
+			l.next()
+			l.next()
+		case l.currentRune == '\'':
+			l.next()
+			return l.token(StringConst, buf.String(), start), nil
+		default:
+			buf.WriteRune(l.currentRune)
+			l.next()
+		}
+	}
 }
 
 func (l *Lexer) peek() rune {
@@ -222,6 +431,7 @@ func (l *Lexer) peek() rune {
 }
 
 func (l *Lexer) id() *Token {
+	start := l.position()
 	var result bytes.Buffer
 	for l.currentRune != NullRune && (unicode.IsDigit(l.currentRune) || unicode.IsLetter(l.currentRune)) || l.currentRune == '_' {
 		result.WriteRune(l.currentRune)
@@ -229,14 +439,16 @@ func (l *Lexer) id() *Token {
 	}
 
 	id := strings.ToLower(result.String())
-	tok, ok := ReservedKeywords[id]
-	if !ok {
-		tok = &Token{typ: Id, value: id}
+	if keyword, ok := ReservedKeywords[id]; ok {
+		return l.token(keyword.typ, keyword.value, start)
 	}
-	return tok
+	return l.token(Id, id, start)
 }
 
-func (l *Lexer) panic(err, context string) {
-	msg := fmt.Sprintf("Lexer error on %s: line: %v column: %v: %s", string(l.currentRune), l.lineno, l.column, err)
-	panic(errors.NewLexerError(msg, context).String())
+func (l *Lexer) error(code errors.Code, err, context string) *errors.Error {
+	msg := fmt.Sprintf("Lexer error on %q: %s", l.currentRune, err)
+	return errors.NewLexerError(msg, context,
+		errors.ErrorCode(code),
+		errors.Pos(l.lineno, l.column),
+	)
 }
@@ -0,0 +1,60 @@
+package calc5
+
+import (
+	"testing"
+)
+
+func TestLexer_positions(t *testing.T) {
+	l := NewLexer("program Main;\n  x := 3.14 { note }\nend.")
+	want := []struct {
+		typ  TokenTyp
+		span string
+	}{
+		{Program, "1:1-1:8"},
+		{Id, "1:9-1:13"},
+		{Semi, "1:13-1:14"},
+		{Id, "2:3-2:4"},
+		{Assign, "2:5-2:7"},
+		{RealConst, "2:8-2:12"},
+		{End, "3:1-3:4"},
+		{Dot, "3:4-3:5"},
+		{EOF, "3:5-3:5"},
+	}
+	for _, w := range want {
+		tok, err := l.getNextToken()
+		if err != nil {
+			t.Fatalf("getNextToken() error = %v", err)
+		}
+		if tok.typ != w.typ || tok.Pos().String() != w.span {
+			t.Errorf("getNextToken() = %v at %v, want %v at %v", tok.typ, tok.Pos(), w.typ, w.span)
+		}
+	}
+}
+
+func TestLexer_strings(t *testing.T) {
+	tests := []struct {
+		src     string
+		want    string
+		span    string
+		wantErr bool
+	}{
+		{src: `'hello'`, want: "hello", span: "1:1-1:8"},
+		{src: `''`, want: "", span: "1:1-1:3"},
+		{src: `'it''s'`, want: "it's", span: "1:1-1:8"},
+		{src: `''''`, want: "'", span: "1:1-1:5"},
+		{src: `'open`, wantErr: true},
+		{src: "'two\nlines'", wantErr: true},
+	}
+	for _, tt := range tests {
+		tok, err := NewLexer(tt.src).getNextToken()
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("getNextToken(%q) error = %v, wantErr %v", tt.src, err, tt.wantErr)
+		}
+		if tt.wantErr {
+			continue
+		}
+		if tok.typ != StringConst || tok.value != tt.want || tok.Pos().String() != tt.span {
+			t.Errorf("getNextToken(%q) = %v %q at %v, want %q at %v", tt.src, tok.typ, tok.value, tok.Pos(), tt.want, tt.span)
+		}
+	}
+}
@@ -0,0 +1,637 @@
+package calc5
+
+import (
+	"bufio"
+	"bytes"
+	bin "encoding/binary"
+	"fmt"
+	"io"
+)
+
+// An object file holds a compiled program so it can be run without the
+// source. After the header come the constant pool, the type table, the case
+// tables, the code of every procedure and the debug section, which keeps the
+// source text and a line table per procedure. Integers are varints and
+// strings are a length followed by their bytes.
+//
+// objectVersion changes whenever the encoding or the meaning of an
+// instruction does, operator tokens included, so old files are rejected
+// instead of misread.
+const (
+	objectMagic   = "P5BC"
+	objectVersion = 1
+)
+
+// maxObjectCount bounds the counts read from an object file so a corrupt one
+// cannot make the loader allocate without limit.
+const maxObjectCount = 1 << 24
+
+// tags of the type table entries
+const (
+	typeBuiltin byte = iota
+	typeEnum
+	typeSubrange
+	typeArray
+	typeRecord
+)
+
+// IsObject reports whether data starts like an object file written by Compile.
+func IsObject(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(objectMagic))
+}
+
+type encoder struct {
+	w     *bufio.Writer
+	table []Symbol       // types in the order they are written, dependencies first
+	types map[Symbol]int // index of each type in table
+}
+
+func (e *encoder) uint(n uint64) {
+	var buf [bin.MaxVarintLen64]byte
+	e.w.Write(buf[:bin.PutUvarint(buf[:], n)])
+}
+
+func (e *encoder) int(n int) {
+	var buf [bin.MaxVarintLen64]byte
+	e.w.Write(buf[:bin.PutVarint(buf[:], int64(n))])
+}
+
+func (e *encoder) str(s string) {
+	e.uint(uint64(len(s)))
+	e.w.WriteString(s)
+}
+
+// ref writes a reference to a type of the table, 0 standing for none.
+func (e *encoder) ref(typ Symbol) {
+	if typ == nil {
+		e.uint(0)
+		return
+	}
+	e.uint(uint64(e.types[typ] + 1))
+}
+
+// addType puts typ in the table after the types it is made of.
+func (e *encoder) addType(typ Symbol) error {
+	if _, ok := e.types[typ]; ok || typ == nil {
+		return nil
+	}
+	var parts []Symbol
+	switch t := typ.(type) {
+	case *builtinTypeSymbol, *enumSymbol:
+	case *subrangeSymbol:
+		parts = []Symbol{t.base}
+	case *arraySymbol:
+		parts = []Symbol{t.index, t.elem}
+	case *recordSymbol:
+		for _, field := range t.fields {
+			parts = append(parts, field.typ)
+		}
+	default:
+		return fmt.Errorf("cannot encode type %v", typ)
+	}
+	for _, part := range parts {
+		if err := e.addType(part); err != nil {
+			return err
+		}
+	}
+	e.types[typ] = len(e.table)
+	e.table = append(e.table, typ)
+	return nil
+}
+
+func (e *encoder) writeType(typ Symbol) {
+	switch t := typ.(type) {
+	case *builtinTypeSymbol:
+		e.w.WriteByte(typeBuiltin)
+		e.str(t.name)
+	case *enumSymbol:
+		e.w.WriteByte(typeEnum)
+		e.str(t.name)
+		e.uint(uint64(len(t.values)))
+		for _, value := range t.values {
+			e.str(value.name)
+		}
+	case *subrangeSymbol:
+		e.w.WriteByte(typeSubrange)
+		e.str(t.name)
+		e.ref(t.base)
+		e.int(t.low)
+		e.int(t.high)
+	case *arraySymbol:
+		e.w.WriteByte(typeArray)
+		e.str(t.name)
+		e.ref(t.index)
+		e.ref(t.elem)
+	case *recordSymbol:
+		e.w.WriteByte(typeRecord)
+		e.str(t.name)
+		e.uint(uint64(len(t.fields)))
+		fields := make(map[string]int, len(t.fields))
+		for idx, field := range t.fields {
+			fields[field.name] = idx
+			e.str(field.name)
+			e.ref(field.typ)
+		}
+		e.writeVariants(t, fields)
+	}
+}
+
+// writeVariants writes the variant parts of a record, each after the part
+// its parent variant belongs to. Variants are numbered across all parts so a
+// nested part can name its parent.
+func (e *encoder) writeVariants(t *recordSymbol, fields map[string]int) {
+	var parts []*variantPartSymbol
+	seen := make(map[*variantPartSymbol]bool)
+	var add func(part *variantPartSymbol)
+	add = func(part *variantPartSymbol) {
+		if seen[part] {
+			return
+		}
+		if part.parent != nil {
+			add(part.parent.part)
+		}
+		seen[part] = true
+		parts = append(parts, part)
+	}
+	for _, field := range t.fields {
+		if v := t.variants[field.name]; v != nil {
+			add(v.part)
+		}
+	}
+
+	numbers := make(map[*variantSymbol]int)
+	e.uint(uint64(len(parts)))
+	for _, part := range parts {
+		if part.tag != nil {
+			e.uint(uint64(fields[part.tag.name] + 1))
+		} else {
+			e.uint(0)
+		}
+		if part.parent != nil {
+			e.uint(uint64(numbers[part.parent] + 1))
+		} else {
+			e.uint(0)
+		}
+		e.uint(uint64(len(part.variants)))
+		for _, v := range part.variants {
+			numbers[v] = len(numbers)
+			e.uint(uint64(len(v.labels)))
+			for _, label := range v.labels {
+				e.int(label.low)
+				e.int(label.high)
+			}
+			e.uint(uint64(len(v.fields)))
+			for _, field := range v.fields {
+				e.uint(uint64(fields[field.name]))
+			}
+		}
+	}
+}
+
+// encode writes prog to w as an object file.
+func (prog *bytecode) encode(w io.Writer) error {
+	e := &encoder{w: bufio.NewWriter(w), types: make(map[Symbol]int)}
+	for _, typ := range prog.types {
+		if err := e.addType(typ); err != nil {
+			return err
+		}
+	}
+	for _, proc := range prog.procs {
+		for _, v := range proc.vars {
+			if err := e.addType(v.typ); err != nil {
+				return err
+			}
+		}
+	}
+
+	e.w.WriteString(objectMagic)
+	e.uint(objectVersion)
+
+	e.uint(uint64(len(prog.consts)))
+	for _, c := range prog.consts {
+		e.w.WriteByte(byte(c.kind))
+		if c.kind == kindString {
+			e.str(c.Str())
+		} else {
+			e.uint(c.bits)
+		}
+	}
+
+	e.uint(uint64(len(e.table)))
+	for _, typ := range e.table {
+		e.writeType(typ)
+	}
+	e.uint(uint64(len(prog.types)))
+	for _, typ := range prog.types {
+		e.ref(typ)
+	}
+
+	e.uint(uint64(len(prog.cases)))
+	for _, table := range prog.cases {
+		e.uint(uint64(table.other))
+		e.uint(uint64(len(table.ranges)))
+		for _, r := range table.ranges {
+			e.int(r.low)
+			e.int(r.high)
+			e.uint(uint64(r.target))
+		}
+	}
+
+	e.uint(uint64(len(prog.procs)))
+	for _, proc := range prog.procs {
+		e.str(proc.name)
+		e.uint(uint64(proc.level))
+		e.int(proc.result)
+		e.uint(uint64(len(proc.params)))
+		for _, slot := range proc.params {
+			e.uint(uint64(slot))
+		}
+		e.uint(uint64(len(proc.vars)))
+		for _, v := range proc.vars {
+			e.str(v.name)
+			e.ref(v.typ)
+		}
+		e.uint(uint64(len(proc.code)))
+		for _, in := range proc.code {
+			e.w.WriteByte(byte(in.op))
+			e.int(int(in.a))
+			e.int(int(in.b))
+		}
+	}
+
+	// debug section: a line table entry for every instruction whose position
+	// differs from the one before
+	e.str(prog.source)
+	for _, proc := range prog.procs {
+		var entries []int
+		last := Position{}
+		for pc, pos := range proc.pos {
+			if pc == 0 || pos != last {
+				entries = append(entries, pc)
+				last = pos
+			}
+		}
+		e.uint(uint64(len(entries)))
+		for _, pc := range entries {
+			e.uint(uint64(pc))
+			e.uint(uint64(proc.pos[pc].Line))
+			e.uint(uint64(proc.pos[pc].Column))
+		}
+	}
+	return e.w.Flush()
+}
+
+// decoder reads an object file. The first error sticks: later reads return
+// zero values, and the error is reported once decoding is done.
+type decoder struct {
+	r     *bufio.Reader
+	err   error
+	types []Symbol
+}
+
+func (d *decoder) fail(format string, a ...interface{}) {
+	if d.err == nil {
+		d.err = fmt.Errorf(format, a...)
+	}
+}
+
+func (d *decoder) readErr(err error) {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	d.fail("%v", err)
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	b, err := d.r.ReadByte()
+	if err != nil {
+		d.readErr(err)
+	}
+	return b
+}
+
+func (d *decoder) uint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	n, err := bin.ReadUvarint(d.r)
+	if err != nil {
+		d.readErr(err)
+	}
+	return n
+}
+
+func (d *decoder) int() int {
+	if d.err != nil {
+		return 0
+	}
+	n, err := bin.ReadVarint(d.r)
+	if err != nil {
+		d.readErr(err)
+	}
+	return int(n)
+}
+
+// count reads the length of a list.
+func (d *decoder) count() int {
+	n := d.uint()
+	if n > maxObjectCount {
+		d.fail("count %d too large", n)
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) str() string {
+	n := d.count()
+	if d.err != nil {
+		return ""
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(d.r, buf); err != nil {
+		d.readErr(err)
+	}
+	return string(buf)
+}
+
+// ref reads a reference to a type decoded before.
+func (d *decoder) ref() Symbol {
+	n := d.uint()
+	if n == 0 {
+		return nil
+	}
+	if n > uint64(len(d.types)) {
+		d.fail("type %d not defined", n-1)
+		return nil
+	}
+	return d.types[n-1]
+}
+
+func (d *decoder) readType() Symbol {
+	switch tag := d.byte(); tag {
+	case typeBuiltin:
+		return &builtinTypeSymbol{name: d.str()}
+	case typeEnum:
+		enum := &enumSymbol{name: d.str()}
+		n := d.count()
+		for k := 0; k < n && d.err == nil; k++ {
+			enum.values = append(enum.values, &constSymbol{name: d.str(), typ: enum, value: intVal(k)})
+		}
+		return enum
+	case typeSubrange:
+		return &subrangeSymbol{name: d.str(), base: d.ref(), low: d.int(), high: d.int()}
+	case typeArray:
+		name, index, elem := d.str(), d.ref(), d.ref()
+		if elem == nil {
+			d.fail("array %s without element type", name)
+		}
+		return &arraySymbol{name: name, index: index, elem: elem}
+	case typeRecord:
+		record := &recordSymbol{name: d.str(), variants: make(map[string]*variantSymbol)}
+		n := d.count()
+		for k := 0; k < n && d.err == nil; k++ {
+			record.fields = append(record.fields, &varSymbol{name: d.str(), typ: d.ref()})
+		}
+		d.readVariants(record)
+		return record
+	default:
+		d.fail("unknown type tag %d", tag)
+		return nil
+	}
+}
+
+func (d *decoder) field(record *recordSymbol, n int) *varSymbol {
+	if n < 0 || n >= len(record.fields) {
+		d.fail("record %s has no field %d", record.name, n)
+		return nil
+	}
+	return record.fields[n]
+}
+
+func (d *decoder) readVariants(record *recordSymbol) {
+	var variants []*variantSymbol
+	parts := d.count()
+	for k := 0; k < parts && d.err == nil; k++ {
+		part := &variantPartSymbol{}
+		if tag := d.count(); tag > 0 {
+			part.tag = d.field(record, tag-1)
+		}
+		if parent := d.count(); parent > 0 {
+			if parent > len(variants) {
+				d.fail("record %s has no variant %d", record.name, parent-1)
+				return
+			}
+			part.parent = variants[parent-1]
+		}
+		n := d.count()
+		for j := 0; j < n && d.err == nil; j++ {
+			variant := &variantSymbol{part: part}
+			labels := d.count()
+			for l := 0; l < labels && d.err == nil; l++ {
+				variant.labels = append(variant.labels, &caseLabel{low: d.int(), high: d.int()})
+			}
+			fields := d.count()
+			for f := 0; f < fields && d.err == nil; f++ {
+				if field := d.field(record, d.count()); field != nil {
+					variant.fields = append(variant.fields, field)
+					record.variants[field.name] = variant
+				}
+			}
+			part.variants = append(part.variants, variant)
+			variants = append(variants, variant)
+		}
+	}
+}
+
+// decode reads an object file written by encode and checks that its
+// instructions only refer to what the file defines.
+func decode(r io.Reader) (*bytecode, error) {
+	d := &decoder{r: bufio.NewReader(r)}
+	magic := make([]byte, len(objectMagic))
+	if _, err := io.ReadFull(d.r, magic); err != nil || string(magic) != objectMagic {
+		return nil, fmt.Errorf("not an object file")
+	}
+	if version := d.uint(); d.err == nil && version != objectVersion {
+		return nil, fmt.Errorf("object file version %d, want %d", version, objectVersion)
+	}
+
+	prog := &bytecode{}
+	n := d.count()
+	for k := 0; k < n && d.err == nil; k++ {
+		switch kind := valueKind(d.byte()); kind {
+		case kindString:
+			prog.consts = append(prog.consts, strVal(d.str()))
+		case kindInt, kindReal, kindBool, kindChar:
+			prog.consts = append(prog.consts, Value{kind: kind, bits: d.uint()})
+		default:
+			d.fail("constant %d has kind %d", k, kind)
+		}
+	}
+
+	n = d.count()
+	for k := 0; k < n && d.err == nil; k++ {
+		d.types = append(d.types, d.readType())
+	}
+	n = d.count()
+	for k := 0; k < n && d.err == nil; k++ {
+		typ := d.ref()
+		if typ == nil {
+			d.fail("type %d missing", k)
+		}
+		prog.types = append(prog.types, typ)
+	}
+
+	n = d.count()
+	for k := 0; k < n && d.err == nil; k++ {
+		table := caseTable{other: d.count()}
+		ranges := d.count()
+		for j := 0; j < ranges && d.err == nil; j++ {
+			table.ranges = append(table.ranges, caseRange{low: d.int(), high: d.int(), target: d.count()})
+		}
+		prog.cases = append(prog.cases, table)
+	}
+
+	n = d.count()
+	for k := 0; k < n && d.err == nil; k++ {
+		proc := &procCode{name: d.str(), level: d.count(), result: d.int()}
+		params := d.count()
+		for j := 0; j < params && d.err == nil; j++ {
+			proc.params = append(proc.params, d.count())
+		}
+		vars := d.count()
+		for j := 0; j < vars && d.err == nil; j++ {
+			proc.vars = append(proc.vars, &varSymbol{name: d.str(), typ: d.ref(), level: proc.level, slot: j})
+		}
+		code := d.count()
+		for j := 0; j < code && d.err == nil; j++ {
+			proc.code = append(proc.code, instr{op: opcode(d.byte()), a: int32(d.int()), b: int32(d.int())})
+		}
+		prog.procs = append(prog.procs, proc)
+	}
+
+	prog.source = d.str()
+	for _, proc := range prog.procs {
+		proc.pos = make([]Position, len(proc.code))
+		entries := d.count()
+		for j := 0; j < entries && d.err == nil; j++ {
+			pc, pos := d.count(), Position{Line: d.count(), Column: d.count()}
+			if pc >= len(proc.code) {
+				d.fail("line table of %s refers to instruction %d", proc.name, pc)
+				break
+			}
+			for ; pc < len(proc.pos); pc++ {
+				proc.pos[pc] = pos
+			}
+		}
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("malformed object file: %v", d.err)
+	}
+	if err := prog.verify(); err != nil {
+		return nil, fmt.Errorf("malformed object file: %v", err)
+	}
+	return prog, nil
+}
+
+// verify checks that every instruction refers to constants, types, variables,
+// procedures, case tables and addresses that exist and that no code runs off
+// its end. It does not check how instructions use the stack; that is left to
+// the compiler that wrote the file.
+func (prog *bytecode) verify() error {
+	if len(prog.procs) == 0 {
+		return fmt.Errorf("no program code")
+	}
+	for _, proc := range prog.procs {
+		if proc.level < 1 || proc.result >= len(proc.vars) {
+			return fmt.Errorf("%s: bad level or result slot", proc.name)
+		}
+		for _, slot := range proc.params {
+			if slot >= len(proc.vars) {
+				return fmt.Errorf("%s: parameter slot %d out of range", proc.name, slot)
+			}
+		}
+		if len(proc.code) == 0 || proc.code[len(proc.code)-1].op != opReturn {
+			return fmt.Errorf("%s: code does not end with %v", proc.name, opReturn)
+		}
+		for pc, in := range proc.code {
+			if err := prog.verifyInstr(proc, in); err != nil {
+				return fmt.Errorf("%s: %d: %v: %v", proc.name, pc, in.op, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (prog *bytecode) verifyInstr(proc *procCode, in instr) error {
+	a, b := int(in.a), int(in.b)
+	within := func(n, limit int, what string) error {
+		if n < 0 || n >= limit {
+			return fmt.Errorf("%s %d out of range", what, n)
+		}
+		return nil
+	}
+	switch in.op {
+	case opConst:
+		return within(a, len(prog.consts), "constant")
+	case opField, opStoreField, opRefField, opBuiltin:
+		if err := within(a, len(prog.consts), "constant"); err != nil {
+			return err
+		}
+		if prog.consts[a].kind != kindString {
+			return fmt.Errorf("constant %d is not a name", a)
+		}
+		if in.op == opBuiltin && b < 0 {
+			return fmt.Errorf("negative argument count")
+		}
+	case opLoadLocal, opStoreLocal, opClear:
+		return within(a, len(proc.vars), "slot")
+	case opInit:
+		if err := within(a, len(proc.vars), "slot"); err != nil {
+			return err
+		}
+		return within(b, len(prog.types), "type")
+	case opLoad, opStore, opRef:
+		if b < 1 || b > proc.level {
+			return fmt.Errorf("level %d out of range", b)
+		}
+		// the record at level b belongs to one of the procedures at that level
+		slots := 0
+		for _, other := range prog.procs {
+			if other.level == b && len(other.vars) > slots {
+				slots = len(other.vars)
+			}
+		}
+		return within(a, slots, "slot")
+	case opConvert, opWrite, opRead:
+		return within(a, len(prog.types), "type")
+	case opJump, opJumpFalse, opAndJump, opOrJump, opForPrep, opForNext:
+		return within(a, len(proc.code), "address")
+	case opCall:
+		if a == 0 {
+			return fmt.Errorf("call of the program")
+		}
+		return within(a, len(prog.procs), "procedure")
+	case opCase:
+		if err := within(a, len(prog.cases), "case table"); err != nil {
+			return err
+		}
+		table := prog.cases[a]
+		if err := within(table.other, len(proc.code), "address"); err != nil {
+			return err
+		}
+		for _, r := range table.ranges {
+			if err := within(r.target, len(proc.code), "address"); err != nil {
+				return err
+			}
+		}
+	case opPop, opDup, opBinary, opUnary, opAddInt, opSubInt, opMulInt, opDivInt,
+		opEqual, opNotEqual, opLess, opLessEqual, opGreater, opGreaterEqual,
+		opIndex, opDefined, opStoreElem, opSetChar, opRefElem, opReturn, opFlush, opReadln:
+	default:
+		return fmt.Errorf("unknown instruction")
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package calc5
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/IngvarListard/pascal-go-intepreter/pkg/calc5/errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// compileObject compiles src and returns the object file.
+func compileObject(t *testing.T, src string) []byte {
+	t.Helper()
+	i, err := New(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	var obj bytes.Buffer
+	if err := i.Compile(&obj); err != nil {
+		t.Fatalf("Compile() error = %v", err)
+	}
+	return obj.Bytes()
+}
+
+func stringify(globals map[string]interface{}) map[string]interface{} {
+	for name, v := range globals {
+		if s, ok := v.(fmt.Stringer); ok {
+			globals[name] = s.String()
+		}
+	}
+	return globals
+}
+
+func TestObjectRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		src   string
+		input string
+	}{
+		{
+			name: "scalars",
+			src: `program Main;
+const Greeting = 'hi';
+var n : integer; r : real; b : boolean; c : char; s : string;
+begin n := 7 div 2; r := n / 4; b := (n > 2) or (r < 0); c := 'z'; s := Greeting + c end.`,
+		},
+		{
+			name: "routines",
+			src: `program Main;
+var total : integer;
+
+procedure Add(var acc : integer; n : integer);
+   function Twice(k : integer) : integer;
+   begin Twice := k * 2 end;
+begin acc := acc + Twice(n) end;
+
+begin
+   total := 0;
+   Add(total, 3);
+   Add(total, 4)
+end.`,
+		},
+		{
+			name: "structured",
+			src: `program Main;
+type Color = (Red, Green, Blue);
+   Shape = record
+      name : string;
+      case kind : Color of
+         Red : (r : real);
+         Green, Blue : (case wide : boolean of
+                           true : (w : integer);
+                           false : (h : 1..10))
+   end;
+var s : Shape; grid : array[1..2, Red..Blue] of integer; d : array of char; i : integer; c : Color;
+begin
+   s.name := 'box';
+   s.kind := Green;
+   s.wide := false;
+   s.h := 4;
+   for i := 1 to 2 do
+      for c := Red to Blue do
+         grid[i, c] := i * 10 + ord(c);
+   setlength(d, 2);
+   d[0] := 'a'; d[1] := 'b';
+   with s do name := name + '!'
+end.`,
+		},
+		{
+			name: "control_and_io",
+			src: `program Main;
+var n, sum : integer; w : string;
+begin
+   read(n); readln(w);
+   sum := 0;
+   repeat
+      case n - n div 3 * 3 of
+         0 : sum := sum + 1;
+         1, 2 : sum := sum + 10
+      else sum := -1
+      end;
+      n := n - 1
+   until n = 0;
+   while sum > 25 do sum := sum - 7;
+   writeln(w, ': ', sum:4, ' ', 2.5:0:2)
+end.`,
+			input: "5 word\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var wantOut bytes.Buffer
+			tree, err := New(strings.NewReader(tt.src), WithOutput(&wantOut), WithInput(strings.NewReader(tt.input)))
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			want, err := tree.Run(context.Background())
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			stringify(want)
+
+			obj := compileObject(t, tt.src)
+			for run := 0; run < 2; run++ {
+				var out bytes.Buffer
+				i, err := Load(bytes.NewReader(obj), WithOutput(&out), WithInput(strings.NewReader(tt.input)), WithVariantChecks())
+				if err != nil {
+					t.Fatalf("Load() error = %v", err)
+				}
+				got, err := i.Run(context.Background())
+				if err != nil {
+					t.Fatalf("Run() of loaded program error = %v", err)
+				}
+				if !reflect.DeepEqual(stringify(got), want) {
+					t.Errorf("loaded program globals = %v, want %v", got, want)
+				}
+				if out.String() != wantOut.String() {
+					t.Errorf("loaded program output = %q, want %q", out.String(), wantOut.String())
+				}
+			}
+		})
+	}
+}
+
+func TestObjectErrorPosition(t *testing.T) {
+	src := `program Main;
+var n : integer;
+
+function Inverse(k : integer) : integer;
+begin
+   Inverse := 100 div k
+end;
+
+begin
+   n := Inverse(0)
+end.`
+	i, err := Load(bytes.NewReader(compileObject(t, src)))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	_, err = i.Run(context.Background())
+	e, ok := err.(*errors.Error)
+	if !ok || e.Code() != errors.DivisionByZero {
+		t.Fatalf("Run() error = %v, want %s", err, errors.DivisionByZero)
+	}
+	if e.Line != 6 || e.Column != 19 {
+		t.Errorf("error at %d:%d, want 6:19", e.Line, e.Column)
+	}
+	if !strings.Contains(e.String(), "in procedure inverse") {
+		t.Errorf("error %q does not name the function it was raised in", e.String())
+	}
+}
+
+func TestLoadMalformed(t *testing.T) {
+	obj := compileObject(t, `program Main; var a : array[1..2] of integer;
+begin a[1] := 1; if a[1] > 0 then writeln('positive') end.`)
+
+	if _, err := Load(strings.NewReader("program Main; begin end.")); err == nil {
+		t.Error("Load() of source text succeeded")
+	}
+	newer := append([]byte(objectMagic), objectVersion+1)
+	if _, err := Load(bytes.NewReader(append(newer, obj[len(newer):]...))); err == nil {
+		t.Error("Load() of a newer version succeeded")
+	}
+	for n := len(objectMagic); n < len(obj); n++ {
+		if _, err := Load(bytes.NewReader(obj[:n])); err == nil {
+			t.Fatalf("Load() of the first %d of %d bytes succeeded", n, len(obj))
+		}
+	}
+	if _, err := Load(bytes.NewReader(obj)); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	src := `program Main;
+var x : integer;
+begin
+   x := 6 * 7
+end.`
+	var out bytes.Buffer
+	if err := Disassemble(&out, bytes.NewReader(compileObject(t, src))); err != nil {
+		t.Fatalf("Disassemble() error = %v", err)
+	}
+	want := `program main (level 1)
+    slot 0  x: integer
+   4|    x := 6 * 7
+      0000  CONST    0  ; 6
+      0001  CONST    1  ; 7
+      0002  MULI
+      0003  STOREL   0  ; x
+   5| end.
+      0004  RET
+`
+	if out.String() != want {
+		t.Errorf("Disassemble() =\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestRunMalformed(t *testing.T) {
+	prog, err := decode(bytes.NewReader(compileObject(t, `program Main;
+var x : integer;
+begin
+   x := 6 * 7
+end.`)))
+	if err != nil {
+		t.Fatalf("decode() error = %v", err)
+	}
+	// popping the first constant leaves the multiplication one operand short
+	prog.procs[0].code[0] = instr{op: opPop}
+	var obj bytes.Buffer
+	if err := prog.encode(&obj); err != nil {
+		t.Fatalf("encode() error = %v", err)
+	}
+
+	i, err := Load(&obj)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	_, err = i.Run(context.Background())
+	if e, ok := err.(*errors.Error); !ok || e.Type() != errors.RuntimeError {
+		t.Errorf("Run() error = %v, want a runtime error", err)
+	}
+}
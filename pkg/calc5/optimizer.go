@@ -0,0 +1,194 @@
+package calc5
+
+// optimize simplifies a program the semantic analyzer has checked, in place,
+// without changing what it does: operations on constants are replaced by
+// their result, empty statements are dropped from compound statements and
+// if and while statements whose condition is a constant lose the branch that
+// can never run. An operation that fails, such as a division by zero, is
+// left for the program to report when it gets there.
+func optimize(node *program) {
+	optimizeBlock(node.block)
+}
+
+func optimizeBlock(node *block) {
+	for _, declaration := range node.declarations {
+		if decl, ok := declaration.(*procDecl); ok && decl.block != nil {
+			optimizeBlock(decl.block)
+		}
+	}
+	node.compoundStatement = optimizeStatement(node.compoundStatement).(*Compound)
+}
+
+// optimizeStatement returns the simplified form of node, a NoOp when nothing
+// of it is left.
+func optimizeStatement(node Node) Node {
+	switch v := node.(type) {
+	case *Compound:
+		children := v.children[:0]
+		for _, child := range v.children {
+			child = optimizeStatement(child)
+			if _, ok := child.(*NoOp); !ok {
+				children = append(children, child)
+			}
+		}
+		v.children = children
+	case *assign:
+		v.left = optimizeExpr(v.left)
+		v.right = optimizeExpr(v.right)
+	case *procCall:
+		optimizeCall(v)
+	case *ifStmt:
+		v.cond = optimizeExpr(v.cond)
+		if cond, ok := constantCond(v.cond); ok {
+			if cond {
+				return optimizeStatement(v.then)
+			}
+			if v.elseStmt != nil {
+				return optimizeStatement(v.elseStmt)
+			}
+			return &NoOp{pos: v.Pos().Start}
+		}
+		v.then = optimizeStatement(v.then)
+		if v.elseStmt != nil {
+			v.elseStmt = optimizeStatement(v.elseStmt)
+		}
+	case *whileStmt:
+		v.cond = optimizeExpr(v.cond)
+		if cond, ok := constantCond(v.cond); ok && !cond {
+			return &NoOp{pos: v.Pos().Start}
+		}
+		v.body = optimizeStatement(v.body)
+	case *repeatStmt:
+		for idx, child := range v.body {
+			v.body[idx] = optimizeStatement(child)
+		}
+		v.cond = optimizeExpr(v.cond)
+	case *forStmt:
+		v.start = optimizeExpr(v.start)
+		v.end = optimizeExpr(v.end)
+		v.body = optimizeStatement(v.body)
+	case *caseStmt:
+		v.selector = optimizeExpr(v.selector)
+		for _, branch := range v.branches {
+			branch.body = optimizeStatement(branch.body)
+		}
+		for idx, child := range v.elseBody {
+			v.elseBody[idx] = optimizeStatement(child)
+		}
+	case *withStmt:
+		for idx, record := range v.records {
+			v.records[idx] = optimizeExpr(record)
+		}
+		v.body = optimizeStatement(v.body)
+	}
+	return node
+}
+
+func optimizeCall(node *procCall) {
+	for idx, arg := range node.actualParams {
+		if format, ok := arg.(*formatArg); ok {
+			format.expr = optimizeExpr(format.expr)
+			format.width = optimizeExpr(format.width)
+			if format.precision != nil {
+				format.precision = optimizeExpr(format.precision)
+			}
+			continue
+		}
+		// variables passed by reference come back as they are, with only
+		// their indices folded
+		node.actualParams[idx] = optimizeExpr(arg)
+	}
+}
+
+// optimizeExpr returns node with its constant operations folded. Variables
+// are never replaced, so the result can still be assigned to.
+func optimizeExpr(node Node) Node {
+	switch v := node.(type) {
+	case *BinOp:
+		v.left = optimizeExpr(v.left)
+		v.right = optimizeExpr(v.right)
+		left, ok := constantOf(v.left)
+		if !ok {
+			break
+		}
+		right, ok := constantOf(v.right)
+		if !ok {
+			break
+		}
+		if value, err := binary(v.op.typ, left, right); err == nil {
+			return literalNode(node, value, v.typ)
+		}
+	case *UnaryOp:
+		v.expr = optimizeExpr(v.expr)
+		if operand, ok := constantOf(v.expr); ok {
+			if value, err := unary(v.op.typ, operand); err == nil {
+				return literalNode(node, value, v.typ)
+			}
+		}
+	case *indexedVar:
+		v.array = optimizeExpr(v.array)
+		for idx, index := range v.indices {
+			v.indices[idx] = optimizeExpr(index)
+		}
+	case *fieldVar:
+		v.record = optimizeExpr(v.record)
+	case *funcCall:
+		optimizeCall(&v.procCall)
+	}
+	return node
+}
+
+// constantOf returns the value of a literal or a named constant.
+func constantOf(node Node) (Value, bool) {
+	switch v := node.(type) {
+	case *Num:
+		return valueOf(v.value)
+	case *boolConst:
+		return boolVal(v.value), true
+	case *strConst:
+		return textVal(v.value), true
+	case *Var:
+		if v.constant != nil {
+			return v.constant.value, true
+		}
+	}
+	return Value{}, false
+}
+
+// constantCond returns the value of a condition known before the program runs.
+func constantCond(node Node) (bool, bool) {
+	v, ok := constantOf(node)
+	if !ok || v.kind != kindBool {
+		return false, false
+	}
+	return v.Bool(), true
+}
+
+// literalNode returns the literal for value, covering the source of the
+// expression node it replaces so errors are still reported where the
+// expression starts. When the literal would not have type typ, as for a
+// string of one character, which reads as a char, node is kept.
+func literalNode(node Node, value Value, typ Symbol) Node {
+	span := node.Pos()
+	token := &Token{
+		lineno:    span.Start.Line,
+		column:    span.Start.Column,
+		endLineno: span.End.Line,
+		endColumn: span.End.Column,
+	}
+	switch {
+	case value.kind == kindInt && isInteger(typ):
+		token.typ, token.value = IntegerConst, value.Int()
+		return &Num{token: token, value: value.Int()}
+	case value.kind == kindReal && isReal(typ):
+		token.typ, token.value = RealConst, value.Real()
+		return &Num{token: token, value: value.Real()}
+	case value.kind == kindBool && isBoolean(typ):
+		token.typ, token.value = BooleanConst, value.Bool()
+		return &boolConst{token: token, value: value.Bool()}
+	case value.kind == kindString && isString(typ) && len([]rune(value.Str())) != 1:
+		token.typ, token.value = StringConst, value.Str()
+		return &strConst{token: token, value: value.Str()}
+	}
+	return node
+}
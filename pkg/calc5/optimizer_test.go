@@ -0,0 +1,165 @@
+package calc5
+
+import (
+	"bytes"
+	"context"
+	"github.com/IngvarListard/pascal-go-intepreter/pkg/calc5/errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOptimize(t *testing.T) {
+	src := `program Main;
+const Debug = false;
+   Limit = 10;
+var n, m : integer; r : real; b : boolean; s : string;
+begin
+   n := 2 * 3 + Limit;
+   r := 7 / 2;
+   m := 7 div 2;
+   b := not (Limit > 5) or Debug;
+   s := 'ab' + 'c';
+   n := 1 div (Limit - 10);
+   if Debug then n := 0;
+   if Limit > 5 then m := 1 else m := 2;
+   while 1 > 2 do n := n + 1;
+   ;;
+   r := -r
+end.`
+	i, err := New(strings.NewReader(src), WithOptimization())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	node, err := i.check()
+	if err != nil {
+		t.Fatalf("check() error = %v", err)
+	}
+	var got []string
+	for _, child := range node.(*program).block.compoundStatement.children {
+		var buf bytes.Buffer
+		if err := FprintAST(&buf, child); err != nil {
+			t.Fatalf("FprintAST() error = %v", err)
+		}
+		got = append(got, strings.Join(strings.Fields(buf.String()), " "))
+	}
+
+	want := []string{
+		"Assign [6:4-6:22] Var n [6:4-6:5] Num 16 [6:9-6:22]",
+		"Assign [7:4-7:14] Var r [7:4-7:5] Num 3.5 [7:9-7:14]",
+		"Assign [8:4-8:16] Var m [8:4-8:5] Num 3 [8:9-8:16]",
+		"Assign [9:4-9:33] Var b [9:4-9:5] Bool false [9:9-9:33]",
+		"Assign [10:4-10:19] Var s [10:4-10:5] String 'abc' [10:9-10:19]",
+		"Assign [11:4-11:26] Var n [11:4-11:5] BinOp DIV [11:9-11:26] Num 1 [11:9-11:10] Num 0 [11:16-11:26]",
+		"Assign [13:22-13:28] Var m [13:22-13:23] Num 1 [13:27-13:28]",
+		"Assign [16:4-16:11] Var r [16:4-16:5] UnaryOp - [16:9-16:11] Var r [16:10-16:11]",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("optimized statements =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestOptimizedMatches(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{
+			name: "arithmetic",
+			src: `program Main;
+const Half = 1 / 2; Big = 1000000 * 1000;
+var n : integer; r, q : real; c : char; s : string;
+begin
+   n := Big div 7 - -3 * 2;
+   r := Half + 3 div 2;
+   q := 10 / 4 * 2;
+   c := 'x';
+   s := c + 'y' + 'z';
+   writeln(n, ' ', r:0:2, ' ', q:0:1, ' ', s, ' ', 2 + 3:4, ' ', 'a' < 'b')
+end.`,
+		},
+		{
+			name: "dead_branches",
+			src: `program Main;
+const Verbose = true;
+var n, calls : integer;
+
+procedure Trace(k : integer);
+begin
+   calls := calls + 1;
+   if Verbose and (k > 0) then writeln('k = ', k)
+end;
+
+begin
+   calls := 0;
+   n := 0;
+   if not Verbose then Trace(-1) else Trace(1);
+   while Verbose and false do n := n + 1;
+   repeat n := n + 1; ; until 2 < 1 + n * 0 + 3;
+   if Verbose then begin ; end
+end.`,
+		},
+		{
+			name: "division_by_zero",
+			src: `program Main;
+const Zero = 0;
+var n : integer;
+begin
+   n := 1;
+   n := n + 10 div (Zero * 2)
+end.`,
+		},
+		{
+			name: "real_division_by_zero",
+			src: `program Main;
+var r : real;
+begin
+   if 1 > 0 then r := 1.5 / (2 - 2)
+end.`,
+		},
+		{
+			name: "index_out_of_range",
+			src: `program Main;
+var a : array[1..3] of integer;
+begin
+   a[2 * 2] := 1
+end.`,
+		},
+	}
+	for _, tt := range tests {
+		// the optimized backends are what these runs compare against
+		for _, backend := range backends[:2] {
+			t.Run(backend.name+"/"+tt.name, func(t *testing.T) {
+				run := func(opts ...Option) (map[string]interface{}, string, error) {
+					var out bytes.Buffer
+					i, err := New(strings.NewReader(tt.src), append(opts, WithOutput(&out))...)
+					if err != nil {
+						t.Fatalf("New() error = %v", err)
+					}
+					globals, err := i.Run(context.Background())
+					return stringify(globals), out.String(), err
+				}
+				want, wantOut, wantErr := run(backend.opts...)
+				got, gotOut, err := run(append(backend.opts, WithOptimization())...)
+
+				if wantErr != nil {
+					e, ok := err.(*errors.Error)
+					w := wantErr.(*errors.Error)
+					if !ok || e.Code() != w.Code() || e.Line != w.Line || e.Column != w.Column {
+						t.Fatalf("optimized Run() error = %v, want %v", err, wantErr)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("optimized Run() error = %v", err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("optimized globals = %v, want %v", got, want)
+				}
+				if gotOut != wantOut {
+					t.Errorf("optimized output = %q, want %q", gotOut, wantOut)
+				}
+			})
+		}
+	}
+}
@@ -2,6 +2,7 @@ package calc5
 
 import (
 	"fmt"
+	"github.com/IngvarListard/pascal-go-intepreter/pkg/calc5/errors"
 )
 
 type Parser struct {
@@ -9,217 +10,865 @@ type Parser struct {
 	currentToken *Token
 }
 
-func (p *Parser) term() Node {
-	node := p.factor()
+// NewParser returns a Parser reading tokens from lexer.
+func NewParser(lexer *Lexer) *Parser {
+	return &Parser{lexer: lexer}
+}
+
+func (p *Parser) term() (Node, error) {
+	node, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
 
 Loop:
 	for {
 		token := p.currentToken
 		switch t := p.currentToken.typ; t {
-		case Mul:
-			p.consume(t)
-		case IntegerDiv:
-			p.consume(t)
-		case FloatDiv:
-			p.consume(t)
+		case Mul, IntegerDiv, FloatDiv, And:
+			if err := p.consume(t); err != nil {
+				return nil, err
+			}
 		default:
 			break Loop
 		}
-		node = &BinOp{left: node, right: p.factor(), op: token}
+		right, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		node = &BinOp{left: node, right: right, op: token}
 	}
-	return node
+	return node, nil
 }
 
-func (p *Parser) expr() Node {
-	node := p.term()
+func (p *Parser) simpleExpr() (Node, error) {
+	node, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.currentToken.typ == Plus || p.currentToken.typ == Minus || p.currentToken.typ == Or || p.currentToken.typ == Xor {
+		token := p.currentToken
+		if err := p.consume(p.currentToken.typ); err != nil {
+			return nil, err
+		}
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		node = &BinOp{left: node, right: right, op: token}
+	}
+
+	return node, nil
+}
+
+func isRelational(typ TokenTyp) bool {
+	switch typ {
+	case Equal, NotEqual, Less, LessEqual, Greater, GreaterEqual:
+		return true
+	default:
+		return false
+	}
+}
+
+// expr parses a simple expression optionally compared with another one.
+// Relational operators have the lowest precedence and do not chain.
+func (p *Parser) expr() (Node, error) {
+	node, err := p.simpleExpr()
+	if err != nil {
+		return nil, err
+	}
 
-	for p.currentToken.typ == Plus || p.currentToken.typ == Minus {
+	if isRelational(p.currentToken.typ) {
 		token := p.currentToken
-		p.consume(p.currentToken.typ)
-		node = &BinOp{left: node, right: p.term(), op: token}
+		if err := p.consume(token.typ); err != nil {
+			return nil, err
+		}
+		right, err := p.simpleExpr()
+		if err != nil {
+			return nil, err
+		}
+		node = &BinOp{left: node, right: right, op: token}
 	}
 
-	return node
+	return node, nil
 }
 
-func (p *Parser) factor() Node {
+func (p *Parser) factor() (Node, error) {
 	token := p.currentToken
 
 	switch token.typ {
-	case IntegerConst:
-		p.consume(IntegerConst)
-		return &Num{token: token, value: token.value}
-	case RealConst:
-		p.consume(RealConst)
-		return &Num{token: token, value: token.value}
+	case IntegerConst, RealConst:
+		if err := p.consume(token.typ); err != nil {
+			return nil, err
+		}
+		return &Num{token: token, value: token.value}, nil
+	case BooleanConst:
+		if err := p.consume(BooleanConst); err != nil {
+			return nil, err
+		}
+		return &boolConst{token: token, value: token.value.(bool)}, nil
+	case StringConst:
+		if err := p.consume(StringConst); err != nil {
+			return nil, err
+		}
+		return &strConst{token: token, value: token.value.(string)}, nil
 	case Lparen:
-		p.consume(Lparen)
-		node := p.expr()
-		p.consume(Rparen)
-		return node
-	case Plus:
-		p.consume(Plus)
-		return &UnaryOp{expr: p.factor(), op: token}
-	case Minus:
-		p.consume(Minus)
-		return &UnaryOp{expr: p.factor(), op: token}
+		if err := p.consume(Lparen); err != nil {
+			return nil, err
+		}
+		node, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.consume(Rparen); err != nil {
+			return nil, err
+		}
+		return node, nil
+	case Plus, Minus, Not:
+		if err := p.consume(token.typ); err != nil {
+			return nil, err
+		}
+		expr, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		return &UnaryOp{expr: expr, op: token}, nil
 	default:
-		return p.variable()
+		node, err := p.variable()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := node.(*Var); !ok || p.currentToken.typ != Lparen {
+			return node, nil
+		}
+		call, err := p.procCallStatement(node.Token())
+		if err != nil {
+			return nil, err
+		}
+		return &funcCall{procCall: *call.(*procCall)}, nil
 	}
 }
 
-func (p *Parser) consume(typ TokenTyp) {
-	if p.currentToken.typ == typ {
-		p.currentToken = p.lexer.getNextToken()
-		return
+func (p *Parser) consume(typ TokenTyp) error {
+	if p.currentToken.typ != typ {
+		return p.error(fmt.Sprintf("expected %s", TokenTypes[typ]), "consume")
 	}
-	panic(fmt.Sprintf("Got unexpected op type: %v", typ))
+	token, err := p.lexer.getNextToken()
+	if err != nil {
+		return err
+	}
+	p.currentToken = token
+	return nil
 }
 
-func (p *Parser) parse() Node {
-	node := p.program()
+// error reports an unexpected current token.
+func (p *Parser) error(msg, context string) *errors.Error {
+	msg = fmt.Sprintf("%s: got %s", msg, p.currentToken)
+	return errors.NewParserError(msg, context,
+		errors.ErrorCode(errors.UnexpectedToken),
+		at(p.currentToken),
+	)
+}
+
+// Parse reads a whole program and returns its AST.
+func (p *Parser) Parse() (Node, error) {
+	return p.parse()
+}
+
+func (p *Parser) parse() (Node, error) {
+	if p.currentToken == nil {
+		token, err := p.lexer.getNextToken()
+		if err != nil {
+			return nil, err
+		}
+		p.currentToken = token
+	}
+	node, err := p.program()
+	if err != nil {
+		return nil, err
+	}
 	if p.currentToken.typ != EOF {
-		panic("not eof")
+		return nil, p.error("expected end of file", "parse")
 	}
-	return node
+	return node, nil
 }
 
-func (p *Parser) program() Node {
-	p.consume(Program)
-	varNode := p.variable()
+func (p *Parser) program() (Node, error) {
+	token := p.currentToken
+	if err := p.consume(Program); err != nil {
+		return nil, err
+	}
+	varNode, err := p.variable()
+	if err != nil {
+		return nil, err
+	}
 	progName := varNode.Token().value
-	p.consume(Semi)
+	if err := p.consume(Semi); err != nil {
+		return nil, err
+	}
 
-	blockNode := p.block()
+	blockNode, err := p.block()
+	if err != nil {
+		return nil, err
+	}
 	programNode := &program{
 		name:  progName.(string),
 		block: blockNode.(*block),
+		token: token,
+		end:   p.currentToken,
+	}
+	if err := p.consume(Dot); err != nil {
+		return nil, err
 	}
-	p.consume(Dot)
 
-	return programNode
+	return programNode, nil
 }
 
-func (p *Parser) compoundStatement() Node {
-	p.consume(Begin)
-	nodes := p.statementList()
-	p.consume(End)
+func (p *Parser) compoundStatement() (Node, error) {
+	begin := p.currentToken
+	if err := p.consume(Begin); err != nil {
+		return nil, err
+	}
+	nodes, err := p.statementList()
+	if err != nil {
+		return nil, err
+	}
+	end := p.currentToken
+	if err := p.consume(End); err != nil {
+		return nil, err
+	}
 
-	root := &Compound{children: make([]Node, len(nodes))}
+	root := &Compound{children: make([]Node, len(nodes)), begin: begin, end: end}
 	for i, node := range nodes {
 		root.children[i] = node
 	}
-	return root
+	return root, nil
 }
 
-func (p *Parser) statementList() []Node {
-	node := p.statement()
+func (p *Parser) statementList() ([]Node, error) {
+	node, err := p.statement()
+	if err != nil {
+		return nil, err
+	}
 	results := []Node{node}
 	for p.currentToken.typ == Semi {
-		p.consume(Semi)
-		results = append(results, p.statement())
+		if err := p.consume(Semi); err != nil {
+			return nil, err
+		}
+		node, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, node)
 	}
 
 	if p.currentToken.typ == Id {
-		panic("unexpected token Id")
+		return nil, p.error("expected ;", "statementList")
 	}
 
-	return results
+	return results, nil
 }
 
-func (p *Parser) statement() Node {
+func (p *Parser) statement() (Node, error) {
 	switch p.currentToken.typ {
 	case Begin:
 		return p.compoundStatement()
+	case If:
+		return p.ifStatement()
+	case While:
+		return p.whileStatement()
+	case Repeat:
+		return p.repeatStatement()
+	case For:
+		return p.forStatement()
+	case Case:
+		return p.caseStatement()
+	case With:
+		return p.withStatement()
 	case Id:
-		return p.assignmentStatement()
+		left, err := p.variable()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := left.(*Var); !ok || p.currentToken.typ == Assign {
+			return p.assignmentStatement(left)
+		}
+		return p.procCallStatement(left.Token())
+	default:
+		return p.empty(), nil
+	}
+}
+
+func (p *Parser) ifStatement() (Node, error) {
+	node := &ifStmt{token: p.currentToken}
+	if err := p.consume(If); err != nil {
+		return nil, err
+	}
+	cond, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	node.cond = cond
+	if err := p.consume(Then); err != nil {
+		return nil, err
+	}
+	if node.then, err = p.statement(); err != nil {
+		return nil, err
+	}
+	// else belongs to the innermost if that does not have one yet
+	if p.currentToken.typ == Else {
+		if err := p.consume(Else); err != nil {
+			return nil, err
+		}
+		if node.elseStmt, err = p.statement(); err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+func (p *Parser) whileStatement() (Node, error) {
+	node := &whileStmt{token: p.currentToken}
+	if err := p.consume(While); err != nil {
+		return nil, err
+	}
+	cond, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	node.cond = cond
+	if err := p.consume(Do); err != nil {
+		return nil, err
+	}
+	if node.body, err = p.statement(); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+func (p *Parser) repeatStatement() (Node, error) {
+	node := &repeatStmt{token: p.currentToken}
+	if err := p.consume(Repeat); err != nil {
+		return nil, err
+	}
+	body, err := p.statementList()
+	if err != nil {
+		return nil, err
+	}
+	node.body = body
+	if err := p.consume(Until); err != nil {
+		return nil, err
+	}
+	if node.cond, err = p.expr(); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+func (p *Parser) forStatement() (Node, error) {
+	node := &forStmt{token: p.currentToken}
+	if err := p.consume(For); err != nil {
+		return nil, err
+	}
+	token := p.currentToken
+	if err := p.consume(Id); err != nil {
+		return nil, err
+	}
+	node.variable = &Var{token: token}
+	if err := p.consume(Assign); err != nil {
+		return nil, err
+	}
+	var err error
+	if node.start, err = p.expr(); err != nil {
+		return nil, err
+	}
+	switch p.currentToken.typ {
+	case To:
+	case Downto:
+		node.downto = true
 	default:
-		return p.empty()
+		return nil, p.error("expected TO or DOWNTO", "forStatement")
+	}
+	if err := p.consume(p.currentToken.typ); err != nil {
+		return nil, err
+	}
+	if node.end, err = p.expr(); err != nil {
+		return nil, err
+	}
+	if err := p.consume(Do); err != nil {
+		return nil, err
+	}
+	if node.body, err = p.statement(); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+func (p *Parser) withStatement() (Node, error) {
+	node := &withStmt{token: p.currentToken}
+	if err := p.consume(With); err != nil {
+		return nil, err
+	}
+	for {
+		record, err := p.variable()
+		if err != nil {
+			return nil, err
+		}
+		node.records = append(node.records, record)
+		if p.currentToken.typ != Comma {
+			break
+		}
+		if err := p.consume(Comma); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.consume(Do); err != nil {
+		return nil, err
+	}
+	body, err := p.statement()
+	if err != nil {
+		return nil, err
+	}
+	node.body = body
+	return node, nil
+}
+
+func (p *Parser) caseStatement() (Node, error) {
+	node := &caseStmt{token: p.currentToken}
+	if err := p.consume(Case); err != nil {
+		return nil, err
+	}
+	selector, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	node.selector = selector
+	if err := p.consume(Of); err != nil {
+		return nil, err
+	}
+
+	for p.currentToken.typ != Else && p.currentToken.typ != End {
+		branch, err := p.caseBranch()
+		if err != nil {
+			return nil, err
+		}
+		node.branches = append(node.branches, branch)
+		if p.currentToken.typ != Semi {
+			break
+		}
+		if err := p.consume(Semi); err != nil {
+			return nil, err
+		}
+	}
+	if len(node.branches) == 0 {
+		return nil, p.error("expected case label", "caseStatement")
+	}
+
+	if p.currentToken.typ == Else {
+		if err := p.consume(Else); err != nil {
+			return nil, err
+		}
+		if node.elseBody, err = p.statementList(); err != nil {
+			return nil, err
+		}
+	}
+	node.end = p.currentToken
+	if err := p.consume(End); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+func (p *Parser) caseBranch() (*caseBranch, error) {
+	labels, err := p.caseLabels()
+	if err != nil {
+		return nil, err
+	}
+	body, err := p.statement()
+	if err != nil {
+		return nil, err
+	}
+	return &caseBranch{labels: labels, body: body}, nil
+}
+
+// caseLabels parses a comma separated list of constants and lo..hi ranges
+// followed by a colon.
+func (p *Parser) caseLabels() ([]*caseLabel, error) {
+	var labels []*caseLabel
+	for {
+		label := &caseLabel{}
+		var err error
+		if label.lo, err = p.simpleExpr(); err != nil {
+			return nil, err
+		}
+		if p.currentToken.typ == Range {
+			if err := p.consume(Range); err != nil {
+				return nil, err
+			}
+			if label.hi, err = p.simpleExpr(); err != nil {
+				return nil, err
+			}
+		}
+		labels = append(labels, label)
+		if p.currentToken.typ != Comma {
+			break
+		}
+		if err := p.consume(Comma); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.consume(Colon); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+func (p *Parser) procCallStatement(token *Token) (Node, error) {
+	node := &procCall{
+		procName: token.value.(string),
+		token:    token,
+		end:      token,
+	}
+	if p.currentToken.typ != Lparen {
+		return node, nil
+	}
+	if err := p.consume(Lparen); err != nil {
+		return nil, err
+	}
+	if p.currentToken.typ != Rparen {
+		params, err := p.actualParams()
+		if err != nil {
+			return nil, err
+		}
+		node.actualParams = params
+	}
+	node.end = p.currentToken
+	if err := p.consume(Rparen); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// actualParams parses the arguments of a call. Any argument may carry a field
+// width and precision as in write(x:8:2); the semantic analyzer rejects them
+// outside write and writeln.
+func (p *Parser) actualParams() ([]Node, error) {
+	var params []Node
+	for {
+		param, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.currentToken.typ == Colon {
+			arg := &formatArg{expr: param, colon: p.currentToken}
+			if err := p.consume(Colon); err != nil {
+				return nil, err
+			}
+			if arg.width, err = p.expr(); err != nil {
+				return nil, err
+			}
+			if p.currentToken.typ == Colon {
+				if err := p.consume(Colon); err != nil {
+					return nil, err
+				}
+				if arg.precision, err = p.expr(); err != nil {
+					return nil, err
+				}
+			}
+			param = arg
+		}
+		params = append(params, param)
+		if p.currentToken.typ != Comma {
+			return params, nil
+		}
+		if err := p.consume(Comma); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *Parser) exprList() ([]Node, error) {
+	node, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	nodes := []Node{node}
+	for p.currentToken.typ == Comma {
+		if err := p.consume(Comma); err != nil {
+			return nil, err
+		}
+		node, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
 	}
+	return nodes, nil
 }
 
-func (p *Parser) assignmentStatement() Node {
-	left := p.variable()
+func (p *Parser) assignmentStatement(left Node) (Node, error) {
 	token := p.currentToken
-	p.consume(Assign)
+	if err := p.consume(Assign); err != nil {
+		return nil, err
+	}
 
-	right := p.expr()
+	right, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
 
-	return &assign{left: left, right: right, op: token}
+	return &assign{left: left, right: right, op: token}, nil
 }
 
-func (p *Parser) variable() Node {
-	node := &Var{token: p.currentToken}
-	p.consume(Id)
-	return node
+// variable parses an identifier followed by any number of [index, ...] and
+// .field selectors.
+func (p *Parser) variable() (Node, error) {
+	var node Node = &Var{token: p.currentToken}
+	if err := p.consume(Id); err != nil {
+		return nil, err
+	}
+	for p.currentToken.typ == Lbracket || p.currentToken.typ == Dot {
+		if p.currentToken.typ == Dot {
+			if err := p.consume(Dot); err != nil {
+				return nil, err
+			}
+			node = &fieldVar{record: node, field: p.currentToken}
+			if err := p.consume(Id); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		indexed := &indexedVar{array: node, token: p.currentToken}
+		if err := p.consume(Lbracket); err != nil {
+			return nil, err
+		}
+		indices, err := p.exprList()
+		if err != nil {
+			return nil, err
+		}
+		indexed.indices = indices
+		indexed.end = p.currentToken
+		if err := p.consume(Rbracket); err != nil {
+			return nil, err
+		}
+		node = indexed
+	}
+	return node, nil
 }
 
 func (p *Parser) empty() Node {
-	return &NoOp{}
+	return &NoOp{pos: p.currentToken.Pos().Start}
 }
 
-func (p *Parser) block() Node {
-	declarationNodes := p.declarations()
-	compoundStatementNode := p.compoundStatement()
+func (p *Parser) block() (Node, error) {
+	declarationNodes, err := p.declarations()
+	if err != nil {
+		return nil, err
+	}
+	compoundStatementNode, err := p.compoundStatement()
+	if err != nil {
+		return nil, err
+	}
 	return &block{
 		declarations:      declarationNodes,
 		compoundStatement: compoundStatementNode.(*Compound),
-	}
+	}, nil
 }
 
-func (p *Parser) declarations() []Node {
+func (p *Parser) declarations() ([]Node, error) {
 	var decs []Node
 	for {
-		if p.currentToken.typ == VarT {
-			p.consume(VarT)
+		if p.currentToken.typ == Const {
+			if err := p.consume(Const); err != nil {
+				return nil, err
+			}
 			for p.currentToken.typ == Id {
-				varDecl := p.variableDeclaration()
-				decs = append(decs, varDecl...)
-				p.consume(Semi)
+				constDecl, err := p.constDeclaration()
+				if err != nil {
+					return nil, err
+				}
+				decs = append(decs, constDecl)
+				if err := p.consume(Semi); err != nil {
+					return nil, err
+				}
 			}
-		} else if p.currentToken.typ == Procedure {
-			p.consume(Procedure)
-			procName := p.currentToken.value
-			p.consume(Id)
-
-			var params []*param
-
-			if p.currentToken.typ == Lparen {
-				p.consume(Lparen)
-				params = p.formalParameterList()
-
-				p.consume(Rparen)
+		} else if p.currentToken.typ == TypeT {
+			if err := p.consume(TypeT); err != nil {
+				return nil, err
 			}
-
-			p.consume(Semi)
-			blockNode := p.block()
-			procDecl := &procDecl{
-				procName: procName.(string),
-				params:   params,
-				block:    blockNode.(*block),
+			for p.currentToken.typ == Id {
+				typeDecl, err := p.typeDeclaration()
+				if err != nil {
+					return nil, err
+				}
+				decs = append(decs, typeDecl)
+				if err := p.consume(Semi); err != nil {
+					return nil, err
+				}
+			}
+		} else if p.currentToken.typ == VarT {
+			if err := p.consume(VarT); err != nil {
+				return nil, err
+			}
+			for p.currentToken.typ == Id {
+				varDecl, err := p.variableDeclaration()
+				if err != nil {
+					return nil, err
+				}
+				decs = append(decs, varDecl...)
+				if err := p.consume(Semi); err != nil {
+					return nil, err
+				}
+			}
+		} else if p.currentToken.typ == Procedure || p.currentToken.typ == Function {
+			procDecl, err := p.procedureDeclaration()
+			if err != nil {
+				return nil, err
 			}
 			decs = append(decs, procDecl)
-			p.consume(Semi)
 		} else {
 			break
 		}
 	}
 
-	return decs
+	return decs, nil
+}
+
+func (p *Parser) constDeclaration() (Node, error) {
+	name := p.currentToken
+	if err := p.consume(Id); err != nil {
+		return nil, err
+	}
+	if err := p.consume(Equal); err != nil {
+		return nil, err
+	}
+	expr, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	return &constDecl{name: name, expr: expr}, nil
+}
+
+func (p *Parser) typeDeclaration() (Node, error) {
+	name := p.currentToken
+	if err := p.consume(Id); err != nil {
+		return nil, err
+	}
+	if err := p.consume(Equal); err != nil {
+		return nil, err
+	}
+	typ, err := p.typeSpec()
+	if err != nil {
+		return nil, err
+	}
+	return &typeDecl{name: name, typeNode: typ}, nil
+}
+
+func (p *Parser) procedureDeclaration() (Node, error) {
+	token := p.currentToken
+	if err := p.consume(token.typ); err != nil {
+		return nil, err
+	}
+	name := p.currentToken
+	procName := name.value
+	if err := p.consume(Id); err != nil {
+		return nil, err
+	}
+
+	var params []*param
+
+	if p.currentToken.typ == Lparen {
+		if err := p.consume(Lparen); err != nil {
+			return nil, err
+		}
+		var err error
+		if params, err = p.formalParameterList(); err != nil {
+			return nil, err
+		}
+		if err := p.consume(Rparen); err != nil {
+			return nil, err
+		}
+	}
+
+	// the body of a forward declared function may leave out the result
+	// type, which the semantic analyzer checks
+	var returnType *typeNode
+	if token.typ == Function && p.currentToken.typ == Colon {
+		if err := p.consume(Colon); err != nil {
+			return nil, err
+		}
+		var err error
+		if returnType, err = p.typeIdentifier(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := p.consume(Semi); err != nil {
+		return nil, err
+	}
+	procDecl := &procDecl{
+		procName:   procName.(string),
+		params:     params,
+		returnType: returnType,
+		token:      token,
+		name:       name,
+	}
+	// forward is a directive rather than a reserved word
+	if p.currentToken.typ == Id && p.currentToken.value == "forward" {
+		if err := p.consume(Id); err != nil {
+			return nil, err
+		}
+	} else {
+		blockNode, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		procDecl.block = blockNode.(*block)
+	}
+	procDecl.end = p.currentToken
+	if err := p.consume(Semi); err != nil {
+		return nil, err
+	}
+	return procDecl, nil
 }
 
-func (p *Parser) formalParameters() []*param {
+func (p *Parser) formalParameters() ([]*param, error) {
 	var paramNodes []*param
 
+	mode := valueParam
+	switch p.currentToken.typ {
+	case VarT:
+		mode = varParam
+	case Const:
+		mode = constParam
+	}
+	if mode != valueParam {
+		if err := p.consume(p.currentToken.typ); err != nil {
+			return nil, err
+		}
+	}
+
 	paramTokens := []*Token{p.currentToken}
-	p.consume(Id)
+	if err := p.consume(Id); err != nil {
+		return nil, err
+	}
 	for p.currentToken.typ == Comma {
-		p.consume(Comma)
+		if err := p.consume(Comma); err != nil {
+			return nil, err
+		}
 		paramTokens = append(paramTokens, p.currentToken)
-		p.consume(Id)
+		if err := p.consume(Id); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.consume(Colon); err != nil {
+		return nil, err
+	}
+	typNode, err := p.typeIdentifier()
+	if err != nil {
+		return nil, err
 	}
-	p.consume(Colon)
-	typNode := p.typeSpec()
 
 	for _, token := range paramTokens {
 		paramNodes = append(paramNodes, &param{
@@ -227,42 +876,63 @@ func (p *Parser) formalParameters() []*param {
 				token: token,
 				value: token.value,
 			},
-			typeNode: typNode.(*typeNode),
+			typeNode: typNode,
+			mode:     mode,
 		})
 	}
-	return paramNodes
+	return paramNodes, nil
 }
 
-func (p *Parser) formalParameterList() []*param {
-	if p.currentToken.typ != Id {
-		return nil
+func (p *Parser) formalParameterList() ([]*param, error) {
+	if typ := p.currentToken.typ; typ != Id && typ != VarT && typ != Const {
+		return nil, nil
+	}
+	paramNodes, err := p.formalParameters()
+	if err != nil {
+		return nil, err
 	}
-	paramNodes := p.formalParameters()
 
 	for p.currentToken.typ == Semi {
-		p.consume(Semi)
-		paramNodes = append(paramNodes, p.formalParameters()...)
+		if err := p.consume(Semi); err != nil {
+			return nil, err
+		}
+		params, err := p.formalParameters()
+		if err != nil {
+			return nil, err
+		}
+		paramNodes = append(paramNodes, params...)
 	}
-	return paramNodes
+	return paramNodes, nil
 }
 
-func (p *Parser) variableDeclaration() []Node {
+func (p *Parser) variableDeclaration() ([]Node, error) {
 	varNodes := []Node{&Var{
 		token: p.currentToken,
 		value: p.currentToken.value,
 	}}
-	p.consume(Id)
+	if err := p.consume(Id); err != nil {
+		return nil, err
+	}
 
 	for p.currentToken.typ == Comma {
-		p.consume(Comma)
+		if err := p.consume(Comma); err != nil {
+			return nil, err
+		}
 		varNodes = append(varNodes, &Var{
 			token: p.currentToken,
 			value: p.currentToken.value,
 		})
-		p.consume(Id)
+		if err := p.consume(Id); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.consume(Colon); err != nil {
+		return nil, err
+	}
+	typNode, err := p.typeSpec()
+	if err != nil {
+		return nil, err
 	}
-	p.consume(Colon)
-	typNode := p.typeSpec()
 
 	varDecls := make([]Node, len(varNodes))
 	for i, node := range varNodes {
@@ -271,23 +941,220 @@ func (p *Parser) variableDeclaration() []Node {
 			typeNode: typNode,
 		}
 	}
-	return varDecls
+	return varDecls, nil
+}
+
+// typeSpec parses a type denoter: a type name, an enumeration or a subrange.
+func (p *Parser) typeSpec() (Node, error) {
+	switch p.currentToken.typ {
+	case Integer, Real, Boolean, Char, StringT:
+		return p.typeIdentifier()
+	case Lparen:
+		return p.enumType()
+	case Array:
+		return p.arrayType()
+	case Record:
+		return p.recordType()
+	}
+
+	lo, err := p.simpleExpr()
+	if err != nil {
+		return nil, err
+	}
+	if p.currentToken.typ != Range {
+		if v, ok := lo.(*Var); ok {
+			return &typeNode{token: v.token, value: v.token.value}, nil
+		}
+		return nil, p.error("expected type", "typeSpec")
+	}
+	if err := p.consume(Range); err != nil {
+		return nil, err
+	}
+	hi, err := p.simpleExpr()
+	if err != nil {
+		return nil, err
+	}
+	return &subrangeType{lo: lo, hi: hi}, nil
 }
 
-func (p *Parser) typeSpec() Node {
+// typeIdentifier parses the name of a type, as required for parameters and
+// function results.
+func (p *Parser) typeIdentifier() (*typeNode, error) {
 	token := p.currentToken
 
 	switch typ := p.currentToken.typ; typ {
-	case Integer:
-		p.consume(typ)
-	case Real:
-		p.consume(typ)
+	case Integer, Real, Boolean, Char, StringT, Id:
+		if err := p.consume(typ); err != nil {
+			return nil, err
+		}
 	default:
-		panic(fmt.Sprintf("unexpected token %v", typ))
+		return nil, p.error("expected type", "typeIdentifier")
 	}
 
 	return &typeNode{
 		token: token,
 		value: token.value,
+	}, nil
+}
+
+func (p *Parser) arrayType() (Node, error) {
+	node := &arrayType{token: p.currentToken}
+	if err := p.consume(Array); err != nil {
+		return nil, err
+	}
+	if p.currentToken.typ == Lbracket {
+		if err := p.consume(Lbracket); err != nil {
+			return nil, err
+		}
+		for {
+			index, err := p.typeSpec()
+			if err != nil {
+				return nil, err
+			}
+			node.indices = append(node.indices, index)
+			if p.currentToken.typ != Comma {
+				break
+			}
+			if err := p.consume(Comma); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.consume(Rbracket); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.consume(Of); err != nil {
+		return nil, err
+	}
+	elem, err := p.typeSpec()
+	if err != nil {
+		return nil, err
+	}
+	node.elem = elem
+	return node, nil
+}
+
+func (p *Parser) recordType() (Node, error) {
+	node := &recordType{token: p.currentToken}
+	if err := p.consume(Record); err != nil {
+		return nil, err
+	}
+	var err error
+	if node.fields, node.variant, err = p.fieldList(); err != nil {
+		return nil, err
+	}
+	node.end = p.currentToken
+	if err := p.consume(End); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// fieldList parses the fixed fields of a record or a variant followed by an
+// optional variant part.
+func (p *Parser) fieldList() ([]Node, *variantPart, error) {
+	var fields []Node
+	for p.currentToken.typ == Id {
+		decls, err := p.variableDeclaration()
+		if err != nil {
+			return nil, nil, err
+		}
+		fields = append(fields, decls...)
+		if p.currentToken.typ != Semi {
+			break
+		}
+		if err := p.consume(Semi); err != nil {
+			return nil, nil, err
+		}
+	}
+	if p.currentToken.typ != Case {
+		return fields, nil, nil
+	}
+	variant, err := p.variantPart()
+	if err != nil {
+		return nil, nil, err
+	}
+	return fields, variant, nil
+}
+
+// variantPart parses case [tag :] Type of labels: (fields); ...
+func (p *Parser) variantPart() (*variantPart, error) {
+	node := &variantPart{token: p.currentToken}
+	if err := p.consume(Case); err != nil {
+		return nil, err
+	}
+	var err error
+	if name := p.currentToken; name.typ == Id {
+		if err := p.consume(Id); err != nil {
+			return nil, err
+		}
+		if p.currentToken.typ == Colon {
+			if err := p.consume(Colon); err != nil {
+				return nil, err
+			}
+			node.tag = name
+		} else {
+			node.tagType = &typeNode{token: name, value: name.value}
+		}
+	}
+	if node.tagType == nil {
+		if node.tagType, err = p.typeIdentifier(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.consume(Of); err != nil {
+		return nil, err
+	}
+
+	for p.currentToken.typ != End && p.currentToken.typ != Rparen {
+		arm := &variant{}
+		if arm.labels, err = p.caseLabels(); err != nil {
+			return nil, err
+		}
+		if err := p.consume(Lparen); err != nil {
+			return nil, err
+		}
+		if arm.fields, arm.variant, err = p.fieldList(); err != nil {
+			return nil, err
+		}
+		arm.end = p.currentToken
+		if err := p.consume(Rparen); err != nil {
+			return nil, err
+		}
+		node.variants = append(node.variants, arm)
+		if p.currentToken.typ != Semi {
+			break
+		}
+		if err := p.consume(Semi); err != nil {
+			return nil, err
+		}
+	}
+	if len(node.variants) == 0 {
+		return nil, p.error("expected variant", "variantPart")
+	}
+	return node, nil
+}
+
+func (p *Parser) enumType() (Node, error) {
+	node := &enumType{token: p.currentToken}
+	if err := p.consume(Lparen); err != nil {
+		return nil, err
+	}
+	for {
+		node.names = append(node.names, p.currentToken)
+		if err := p.consume(Id); err != nil {
+			return nil, err
+		}
+		if p.currentToken.typ != Comma {
+			break
+		}
+		if err := p.consume(Comma); err != nil {
+			return nil, err
+		}
+	}
+	node.end = p.currentToken
+	if err := p.consume(Rparen); err != nil {
+		return nil, err
 	}
+	return node, nil
 }
@@ -0,0 +1,34 @@
+package calc5
+
+import (
+	"testing"
+)
+
+func TestParser_positions(t *testing.T) {
+	p := NewParser(NewLexer("program Main;\nbegin\n  x := -y + 1;\nend."))
+	node, err := p.parse()
+	if err != nil {
+		t.Fatalf("parse() error = %v", err)
+	}
+	prog := node.(*program)
+	compound := prog.block.compoundStatement
+	tests := []struct {
+		name string
+		node Node
+		want string
+	}{
+		{"program", prog, "1:1-4:5"},
+		{"block", prog.block, "2:1-4:4"},
+		{"compound", compound, "2:1-4:4"},
+		{"assign", compound.children[0], "3:3-3:14"},
+		{"unary", compound.children[0].(*assign).right.(*BinOp).left, "3:8-3:10"},
+		{"noop", compound.children[1], "4:1-4:1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.node.Pos().String(); got != tt.want {
+				t.Errorf("Pos() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package calc5
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// FprintAST writes an indented outline of the tree rooted at node to w, one
+// node per line together with its source span.
+func FprintAST(w io.Writer, node Node) error {
+	p := &astPrinter{w: w}
+	p.print(node, 0)
+	return p.err
+}
+
+type astPrinter struct {
+	w   io.Writer
+	err error
+}
+
+func (p *astPrinter) line(depth int, node Node, format string, a ...interface{}) {
+	if p.err != nil {
+		return
+	}
+	label := fmt.Sprintf(format, a...)
+	_, p.err = fmt.Fprintf(p.w, "%s%s [%s]\n", strings.Repeat("  ", depth), label, node.Pos())
+}
+
+func (p *astPrinter) print(node Node, depth int) {
+	switch v := node.(type) {
+	case *program:
+		p.line(depth, v, "Program %s", v.name)
+		p.print(v.block, depth+1)
+	case *block:
+		p.line(depth, v, "Block")
+		for _, declaration := range v.declarations {
+			p.print(declaration, depth+1)
+		}
+		p.print(v.compoundStatement, depth+1)
+	case *varDecl:
+		if t, ok := v.typeNode.(*typeNode); ok {
+			p.line(depth, v, "VarDecl %v : %v", v.varNode.Token().value, t.value)
+		} else {
+			p.line(depth, v, "VarDecl %v", v.varNode.Token().value)
+			p.print(v.typeNode, depth+1)
+		}
+	case *typeDecl:
+		p.line(depth, v, "TypeDecl %v", v.name.value)
+		p.print(v.typeNode, depth+1)
+	case *enumType:
+		names := make([]string, len(v.names))
+		for i, name := range v.names {
+			names[i] = name.value.(string)
+		}
+		p.line(depth, v, "Enum %s", strings.Join(names, ", "))
+	case *arrayType:
+		p.line(depth, v, "Array")
+		for _, index := range v.indices {
+			p.print(index, depth+1)
+		}
+		p.print(v.elem, depth+1)
+	case *recordType:
+		p.line(depth, v, "Record")
+		for _, field := range v.fields {
+			p.print(field, depth+1)
+		}
+		if v.variant != nil {
+			p.print(v.variant, depth+1)
+		}
+	case *variantPart:
+		if v.tag != nil {
+			p.line(depth, v, "VariantPart %v : %v", v.tag.value, v.tagType.value)
+		} else {
+			p.line(depth, v, "VariantPart %v", v.tagType.value)
+		}
+		for _, arm := range v.variants {
+			p.line(depth+1, arm, "Variant")
+			for _, label := range arm.labels {
+				p.line(depth+2, label, "Label")
+				p.print(label.lo, depth+3)
+				if label.hi != nil {
+					p.print(label.hi, depth+3)
+				}
+			}
+			for _, field := range arm.fields {
+				p.print(field, depth+2)
+			}
+			if arm.variant != nil {
+				p.print(arm.variant, depth+2)
+			}
+		}
+	case *subrangeType:
+		p.line(depth, v, "Subrange")
+		p.print(v.lo, depth+1)
+		p.print(v.hi, depth+1)
+	case *constDecl:
+		p.line(depth, v, "ConstDecl %v", v.name.value)
+		p.print(v.expr, depth+1)
+	case *procDecl:
+		if v.returnType != nil {
+			p.line(depth, v, "FuncDecl %s : %v", v.procName, v.returnType.value)
+		} else {
+			p.line(depth, v, "ProcDecl %s", v.procName)
+		}
+		for _, prm := range v.params {
+			if prm.mode == valueParam {
+				p.line(depth+1, prm, "Param %v : %v", prm.varNode.value, prm.typeNode.value)
+			} else {
+				p.line(depth+1, prm, "Param %v %v : %v", prm.mode, prm.varNode.value, prm.typeNode.value)
+			}
+		}
+		if v.block == nil {
+			p.line(depth+1, v, "Forward")
+		} else {
+			p.print(v.block, depth+1)
+		}
+	case *procCall:
+		p.line(depth, v, "ProcCall %s", v.procName)
+		for _, arg := range v.actualParams {
+			p.print(arg, depth+1)
+		}
+	case *formatArg:
+		p.line(depth, v, "Format")
+		p.print(v.expr, depth+1)
+		p.print(v.width, depth+1)
+		if v.precision != nil {
+			p.print(v.precision, depth+1)
+		}
+	case *funcCall:
+		p.line(depth, v, "FuncCall %s", v.procName)
+		for _, arg := range v.actualParams {
+			p.print(arg, depth+1)
+		}
+	case *ifStmt:
+		p.line(depth, v, "If")
+		p.print(v.cond, depth+1)
+		p.print(v.then, depth+1)
+		if v.elseStmt != nil {
+			p.print(v.elseStmt, depth+1)
+		}
+	case *whileStmt:
+		p.line(depth, v, "While")
+		p.print(v.cond, depth+1)
+		p.print(v.body, depth+1)
+	case *repeatStmt:
+		p.line(depth, v, "Repeat")
+		for _, child := range v.body {
+			p.print(child, depth+1)
+		}
+		p.print(v.cond, depth+1)
+	case *forStmt:
+		direction := "to"
+		if v.downto {
+			direction = "downto"
+		}
+		p.line(depth, v, "For %s", direction)
+		p.print(v.variable, depth+1)
+		p.print(v.start, depth+1)
+		p.print(v.end, depth+1)
+		p.print(v.body, depth+1)
+	case *caseStmt:
+		p.line(depth, v, "Case")
+		p.print(v.selector, depth+1)
+		for _, branch := range v.branches {
+			p.line(depth+1, branch, "Branch")
+			for _, label := range branch.labels {
+				p.line(depth+2, label, "Label")
+				p.print(label.lo, depth+3)
+				if label.hi != nil {
+					p.print(label.hi, depth+3)
+				}
+			}
+			p.print(branch.body, depth+2)
+		}
+		if v.elseBody != nil {
+			p.line(depth+1, v.elseBody[0], "Else")
+			for _, child := range v.elseBody {
+				p.print(child, depth+2)
+			}
+		}
+	case *Compound:
+		p.line(depth, v, "Compound")
+		for _, child := range v.children {
+			p.print(child, depth+1)
+		}
+	case *assign:
+		p.line(depth, v, "Assign")
+		p.print(v.left, depth+1)
+		p.print(v.right, depth+1)
+	case *BinOp:
+		p.line(depth, v, "BinOp %v", v.op.typ)
+		p.print(v.left, depth+1)
+		p.print(v.right, depth+1)
+	case *UnaryOp:
+		p.line(depth, v, "UnaryOp %v", v.op.typ)
+		p.print(v.expr, depth+1)
+	case *Num:
+		p.line(depth, v, "Num %v", v.value)
+	case *boolConst:
+		p.line(depth, v, "Bool %v", v.value)
+	case *strConst:
+		p.line(depth, v, "String %s", literal(strVal(v.value)))
+	case *Var:
+		p.line(depth, v, "Var %v", v.token.value)
+	case *indexedVar:
+		p.line(depth, v, "Index")
+		p.print(v.array, depth+1)
+		for _, index := range v.indices {
+			p.print(index, depth+1)
+		}
+	case *fieldVar:
+		p.line(depth, v, "Field %v", v.field.value)
+		p.print(v.record, depth+1)
+	case *withStmt:
+		p.line(depth, v, "With")
+		for _, record := range v.records {
+			p.print(record, depth+1)
+		}
+		p.print(v.body, depth+1)
+	case *typeNode:
+		p.line(depth, v, "Type %v", v.value)
+	case *NoOp:
+		p.line(depth, v, "NoOp")
+	default:
+		p.line(depth, v, "%T", v)
+	}
+}
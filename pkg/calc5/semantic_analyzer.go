@@ -3,6 +3,9 @@ package calc5
 import (
 	"bytes"
 	"fmt"
+	"github.com/IngvarListard/pascal-go-intepreter/pkg/calc5/errors"
+	"io"
+	"sort"
 	"strings"
 )
 
@@ -11,6 +14,8 @@ type ScopedSymbolTable struct {
 	scopeName      string
 	scopeLevel     int
 	enclosingScope *ScopedSymbolTable
+	trace          io.Writer
+	vars           []*varSymbol // variables given a slot in the frame of this scope
 }
 
 func (s *ScopedSymbolTable) String() string {
@@ -26,13 +31,11 @@ func (s *ScopedSymbolTable) String() string {
 		scopeName = s.enclosingScope.scopeName
 	}
 
-	for k, v := range map[string]interface{}{
-		"Scope name":      s.scopeName,
-		"Scope level":     s.scopeLevel,
-		"Enclosing scope": scopeName,
-	} {
-		lines = append(lines, fmt.Sprintf("%s: %v", k, v))
-	}
+	lines = append(lines,
+		fmt.Sprintf("Scope name: %v", s.scopeName),
+		fmt.Sprintf("Scope level: %v", s.scopeLevel),
+		fmt.Sprintf("Enclosing scope: %v", scopeName),
+	)
 
 	h2 := "Scope (Scoped symbol table) contents"
 	sep = bytes.Buffer{}
@@ -41,27 +44,32 @@ func (s *ScopedSymbolTable) String() string {
 	}
 	lines = append(lines, h2, sep.String())
 
-	for k, v := range s.symbols {
-		lines = append(lines, fmt.Sprintf("%s: %s", k, v))
+	names := make([]string, 0, len(s.symbols))
+	for k := range s.symbols {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		lines = append(lines, fmt.Sprintf("%s: %s", k, s.symbols[k]))
 	}
 	lines = append(lines, "\n")
 
-	values := make([]string, len(s.symbols))
-	cnt := 0
-	for _, symbol := range s.symbols {
-		values[cnt] = symbol.(fmt.Stringer).String()
-		cnt++
-	}
 	return strings.Join(lines, "\n")
 }
 
+func (s *ScopedSymbolTable) tracef(format string, a ...interface{}) {
+	if s.trace != nil {
+		fmt.Fprintf(s.trace, format, a...)
+	}
+}
+
 func (s *ScopedSymbolTable) define(symbol Symbol) {
-	fmt.Printf("Define Symbol: %s\n", symbol)
+	s.tracef("Define Symbol: %s\n", symbol)
 	s.symbols[symbol.Name()] = symbol
 }
 
 func (s *ScopedSymbolTable) lookup(name string, currentScopeOnly bool) Symbol {
-	fmt.Printf("Lookup Symbol: %s in %s Scope\n", name, s.scopeName)
+	s.tracef("Lookup Symbol: %s in %s Scope\n", name, s.scopeName)
 
 	v, ok := s.symbols[name]
 	if ok {
@@ -81,6 +89,9 @@ func (s *ScopedSymbolTable) lookup(name string, currentScopeOnly bool) Symbol {
 func (s *ScopedSymbolTable) initBuiltins() {
 	s.define(&builtinTypeSymbol{name: "integer"})
 	s.define(&builtinTypeSymbol{name: "real"})
+	s.define(&builtinTypeSymbol{name: "boolean"})
+	s.define(&builtinTypeSymbol{name: "char"})
+	s.define(&builtinTypeSymbol{name: "string"})
 }
 
 func NewScopedSymbolTable(name string, level int, enclosingScope *ScopedSymbolTable) *ScopedSymbolTable {
@@ -90,166 +101,1079 @@ func NewScopedSymbolTable(name string, level int, enclosingScope *ScopedSymbolTa
 		scopeLevel:     level,
 		enclosingScope: enclosingScope,
 	}
+	if enclosingScope != nil {
+		st.trace = enclosingScope.trace
+	}
 	st.initBuiltins()
 	return st
 }
 
 type SemanticAnalyzer struct {
 	*ScopedSymbolTable // currentScope?
+	global             *ScopedSymbolTable
+	scopes             []*ScopedSymbolTable
+	routines           []*procedureSymbol // procedures and functions whose bodies are being visited
+	controls           []*varSymbol       // control variables of the enclosing for loops
+	withs              int                // with statements seen so far, to name their hidden variables
+	trace              io.Writer
 }
 
 func NewSemanticAnalyzer() *SemanticAnalyzer {
 	return new(SemanticAnalyzer)
 }
 
-func (sb *SemanticAnalyzer) VisitBlock(node *block) {
+// Analyze checks the program rooted at node.
+func (sb *SemanticAnalyzer) Analyze(node Node) error {
+	return sb.VisitNode(node)
+}
+
+// Scopes returns every scope opened during analysis in the order they were entered.
+func (sb *SemanticAnalyzer) Scopes() []*ScopedSymbolTable {
+	return sb.scopes
+}
+
+// newScope opens a scope nested in the current one and makes it current.
+func (sb *SemanticAnalyzer) newScope(name string, level int) *ScopedSymbolTable {
+	scope := NewScopedSymbolTable(name, level, sb.ScopedSymbolTable)
+	scope.trace = sb.trace
+	sb.ScopedSymbolTable = scope
+	sb.scopes = append(sb.scopes, scope)
+	return scope
+}
+
+// allocate gives v the next slot in the activation record of the program or
+// routine being analyzed. The scopes with statements open share the frame of
+// the routine they are in.
+func (sb *SemanticAnalyzer) allocate(v *varSymbol) {
+	scope := sb.ScopedSymbolTable
+	for scope.enclosingScope != nil && scope.enclosingScope.scopeLevel == scope.scopeLevel {
+		scope = scope.enclosingScope
+	}
+	v.slot = len(scope.vars)
+	scope.vars = append(scope.vars, v)
+}
+
+func (sb *SemanticAnalyzer) tracef(format string, a ...interface{}) {
+	if sb.trace != nil {
+		fmt.Fprintf(sb.trace, format, a...)
+	}
+}
+
+func (sb *SemanticAnalyzer) VisitBlock(node *block) error {
 	for _, declaration := range node.declarations {
-		sb.VisitNode(declaration)
+		if err := sb.VisitNode(declaration); err != nil {
+			return err
+		}
+	}
+	// every forward declaration must be followed by the body in the same block
+	for _, declaration := range node.declarations {
+		decl, ok := declaration.(*procDecl)
+		if ok && decl.block == nil && sb.lookup(decl.procName, true).(*procedureSymbol).block == nil {
+			return sb.error(errors.MissingBody, decl.name, "VisitBlock")
+		}
 	}
-	sb.VisitNode(node.compoundStatement)
+	return sb.VisitNode(node.compoundStatement)
 }
 
-func (sb *SemanticAnalyzer) visitProgram(node *program) interface{} {
-	fmt.Println("Enter scope: Global")
-	globalScope := NewScopedSymbolTable("global", 1, sb.ScopedSymbolTable)
-	sb.ScopedSymbolTable = globalScope
-	sb.VisitNode(node.block)
-	fmt.Println(globalScope)
+func (sb *SemanticAnalyzer) visitProgram(node *program) error {
+	sb.tracef("Enter scope: Global\n")
+	globalScope := sb.newScope("global", 1)
+	sb.global = globalScope
+	if err := sb.VisitNode(node.block); err != nil {
+		return err
+	}
+	sb.tracef("%s\n", globalScope)
 
 	sb.ScopedSymbolTable = sb.enclosingScope
-	fmt.Println("Leave scope: Global")
+	sb.tracef("Leave scope: Global\n")
 	return nil
 }
 
-func (sb *SemanticAnalyzer) visitBinOp(node *BinOp) interface{} {
-	sb.VisitNode(node.left)
-	sb.VisitNode(node.right)
+func (sb *SemanticAnalyzer) visitBinOp(node *BinOp) error {
+	if err := sb.VisitNode(node.left); err != nil {
+		return err
+	}
+	if err := sb.VisitNode(node.right); err != nil {
+		return err
+	}
+
+	left, right := sb.exprType(node.left), sb.exprType(node.right)
+	var ok bool
+	switch op := node.op.typ; {
+	case op == And || op == Or || op == Xor:
+		ok = isBoolean(left) && isBoolean(right)
+		node.typ = sb.lookup("boolean", false)
+	case op == Plus && isText(left):
+		ok = isText(right)
+		node.typ = sb.lookup("string", false)
+	case isRelational(op):
+		ok = isNumeric(left) && isNumeric(right) || isOrdinal(left) && sameType(baseType(left), baseType(right)) ||
+			isText(left) && isText(right)
+		node.typ = sb.lookup("boolean", false)
+	case op == IntegerDiv:
+		ok = isInteger(left) && isInteger(right)
+		node.typ = sb.lookup("integer", false)
+	case op == FloatDiv:
+		ok = isNumeric(left) && isNumeric(right)
+		node.typ = sb.lookup("real", false)
+	default:
+		ok = isNumeric(left) && isNumeric(right)
+		node.typ = sb.lookup("integer", false)
+		if isReal(left) || isReal(right) {
+			node.typ = sb.lookup("real", false)
+		}
+	}
+	if !ok {
+		return sb.error(errors.IncompatibleTypes, node.op, "visitBinOp")
+	}
 	return nil
 }
 
-func (sb *SemanticAnalyzer) visitNum(_ *Num) interface{} { return nil }
+func (sb *SemanticAnalyzer) visitNum(_ *Num) error { return nil }
+
+func (sb *SemanticAnalyzer) visitBoolConst(_ *boolConst) error { return nil }
 
-func (sb *SemanticAnalyzer) VisitUnaryOp(node *UnaryOp) interface{} {
-	sb.VisitNode(node.expr)
+func (sb *SemanticAnalyzer) visitStrConst(_ *strConst) error { return nil }
+
+func (sb *SemanticAnalyzer) VisitUnaryOp(node *UnaryOp) error {
+	if err := sb.VisitNode(node.expr); err != nil {
+		return err
+	}
+	typ := sb.exprType(node.expr)
+	if node.op.typ == Not && !isBoolean(typ) || node.op.typ != Not && !isNumeric(typ) {
+		return sb.error(errors.IncompatibleTypes, node.op, "VisitUnaryOp")
+	}
+	node.typ = baseType(typ)
 	return nil
 }
 
-func (sb *SemanticAnalyzer) VisitCompound(node *Compound) interface{} {
+func isNumeric(typ Symbol) bool {
+	typ = baseType(typ)
+	return typ != nil && (typ.Name() == "integer" || typ.Name() == "real")
+}
+
+func isOrdinal(typ Symbol) bool {
+	typ = baseType(typ)
+	if _, ok := typ.(*enumSymbol); ok {
+		return true
+	}
+	return typ != nil && (typ.Name() == "integer" || typ.Name() == "boolean" || typ.Name() == "char")
+}
+
+func isBoolean(typ Symbol) bool {
+	typ = baseType(typ)
+	return typ != nil && typ.Name() == "boolean"
+}
+
+func isChar(typ Symbol) bool {
+	typ = baseType(typ)
+	return typ != nil && typ.Name() == "char"
+}
+
+func isString(typ Symbol) bool {
+	return typ != nil && typ.Name() == "string"
+}
+
+// isText reports whether typ is string or char, which mix in concatenations
+// and comparisons.
+func isText(typ Symbol) bool {
+	return isString(typ) || isChar(typ)
+}
+
+func (sb *SemanticAnalyzer) VisitCompound(node *Compound) error {
 	for _, child := range node.children {
-		sb.VisitNode(child)
+		if err := sb.VisitNode(child); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func (sb *SemanticAnalyzer) VisitNoOp(_ *NoOp) {}
+func (sb *SemanticAnalyzer) VisitNoOp(_ *NoOp) error { return nil }
 
-func (sb *SemanticAnalyzer) VisitVarDecl(node *varDecl) {
-	typeName, _ := node.typeNode.Value()
-	typeSymbol := sb.lookup(typeName.(string), false)
+func (sb *SemanticAnalyzer) VisitVarDecl(node *varDecl) error {
+	typeSymbol, err := sb.typeOf(node.typeNode, "")
+	if err != nil {
+		return err
+	}
 	varName, _ := node.varNode.Value()
 	varNameStr := varName.(string)
-	varSymbol := &varSymbol{name: varNameStr, typ: typeSymbol}
+	varSymbol := &varSymbol{name: varNameStr, typ: typeSymbol, level: sb.scopeLevel}
 
 	if sb.lookup(varNameStr, true) != nil {
-		panic(fmt.Sprintf("Error: Duplicate identifier '%s' found", varNameStr))
+		return sb.error(errors.DuplicateID, node.varNode.Token(), "VisitVarDecl")
 	}
 
 	sb.define(varSymbol)
+	sb.allocate(varSymbol)
+	node.varNode.(*Var).symbol = varSymbol
+	return nil
 }
 
-func (sb *SemanticAnalyzer) visitAssign(node *assign) {
-	varName, _ := node.left.Token().value.(string)
-	varSymbol := sb.lookup(varName, false)
-	if varSymbol == nil {
-		panic("reference before assignment")
+func (sb *SemanticAnalyzer) VisitTypeDecl(node *typeDecl) error {
+	name := node.name.value.(string)
+	if sb.lookup(name, true) != nil {
+		return sb.error(errors.DuplicateID, node.name, "VisitTypeDecl")
+	}
+	typ, err := sb.typeOf(node.typeNode, name)
+	if err != nil {
+		return err
 	}
+	if _, ok := node.typeNode.(*typeNode); ok {
+		typ = &aliasSymbol{name: name, typ: typ}
+	}
+	sb.define(typ)
+	return nil
+}
 
-	sb.VisitNode(node.right)
+// typeOf resolves a type denoter to its type symbol. Enumerations and
+// subranges declared in a type section take the declared name, others are
+// named after their source form.
+func (sb *SemanticAnalyzer) typeOf(node Node, name string) (Symbol, error) {
+	switch v := node.(type) {
+	case *typeNode:
+		symbol := sb.lookup(v.value.(string), false)
+		if symbol == nil {
+			return nil, sb.error(errors.IDNotFound, v.token, "typeOf")
+		}
+		switch t := symbol.(type) {
+		case *aliasSymbol:
+			return t.typ, nil
+		case *builtinTypeSymbol, *enumSymbol, *subrangeSymbol, *arraySymbol, *recordSymbol:
+			return t, nil
+		}
+		return nil, sb.error(errors.InvalidIdentifier, v.token, "typeOf")
+	case *enumType:
+		if v.symbol != nil {
+			return v.symbol, nil
+		}
+		enum := &enumSymbol{name: name}
+		names := make([]string, len(v.names))
+		for i, token := range v.names {
+			names[i] = token.value.(string)
+			if sb.lookup(names[i], true) != nil {
+				return nil, sb.error(errors.DuplicateID, token, "typeOf")
+			}
+			value := &constSymbol{name: names[i], typ: enum, value: intVal(i)}
+			enum.values = append(enum.values, value)
+			sb.define(value)
+		}
+		if enum.name == "" {
+			enum.name = "(" + strings.Join(names, ", ") + ")"
+		}
+		v.symbol = enum
+		return enum, nil
+	case *arrayType:
+		if v.symbol != nil {
+			return v.symbol, nil
+		}
+		elem, err := sb.typeOf(v.elem, "")
+		if err != nil {
+			return nil, err
+		}
+		if len(v.indices) == 0 {
+			elem = &arraySymbol{name: "array of " + elem.Name(), elem: elem}
+		}
+		for i := len(v.indices) - 1; i >= 0; i-- {
+			index, err := sb.typeOf(v.indices[i], "")
+			if err != nil {
+				return nil, err
+			}
+			if !isOrdinal(index) || index.Name() == "integer" {
+				return nil, sb.error(errors.IncompatibleTypes, v.indices[i].Token(), "typeOf")
+			}
+			elem = &arraySymbol{name: fmt.Sprintf("array[%s] of %s", index.Name(), elem.Name()), index: index, elem: elem}
+		}
+		v.symbol = elem.(*arraySymbol)
+		if name != "" {
+			v.symbol.name = name
+		}
+		return v.symbol, nil
+	case *recordType:
+		if v.symbol != nil {
+			return v.symbol, nil
+		}
+		record := &recordSymbol{name: name, variants: make(map[string]*variantSymbol)}
+		if record.name == "" {
+			record.name = "record"
+		}
+		for _, field := range v.fields {
+			decl := field.(*varDecl)
+			if err := sb.addField(record, decl.varNode.Token(), decl.typeNode, nil); err != nil {
+				return nil, err
+			}
+		}
+		if v.variant != nil {
+			if err := sb.addVariantPart(record, v.variant, nil); err != nil {
+				return nil, err
+			}
+		}
+		v.symbol = record
+		return record, nil
+	case *subrangeType:
+		if v.symbol != nil {
+			return v.symbol, nil
+		}
+		var bounds [2]Value
+		for i, bound := range []Node{v.lo, v.hi} {
+			if err := sb.VisitNode(bound); err != nil {
+				return nil, err
+			}
+			value, err := sb.constValue(bound)
+			if err != nil {
+				return nil, err
+			}
+			bounds[i] = value
+		}
+		lo, hi := sb.exprType(v.lo), sb.exprType(v.hi)
+		if !isOrdinal(lo) || !sameType(baseType(lo), baseType(hi)) {
+			return nil, sb.error(errors.IncompatibleTypes, v.hi.Token(), "typeOf")
+		}
+		sub := &subrangeSymbol{name: name, base: baseType(lo), low: ordinal(bounds[0]), high: ordinal(bounds[1])}
+		if sub.low > sub.high {
+			return nil, sb.error(errors.InvalidRange, v.Token(), "typeOf")
+		}
+		if sub.name == "" {
+			sub.name = literal(bounds[0]) + ".." + literal(bounds[1])
+		}
+		v.symbol = sub
+		return sub, nil
+	}
+	return nil, sb.error(errors.InvalidIdentifier, node.Token(), "typeOf")
+}
+
+// addField declares a field of record. Fields of a variant also belong to owner.
+func (sb *SemanticAnalyzer) addField(record *recordSymbol, name *Token, typeNode Node, owner *variantSymbol) error {
+	typ, err := sb.typeOf(typeNode, "")
+	if err != nil {
+		return err
+	}
+	if record.field(name.value.(string)) != nil {
+		return sb.error(errors.DuplicateID, name, "addField")
+	}
+	field := &varSymbol{name: name.value.(string), typ: typ}
+	record.fields = append(record.fields, field)
+	if owner != nil {
+		owner.fields = append(owner.fields, field)
+		record.variants[field.name] = owner
+	}
+	return nil
+}
+
+// addVariantPart lays out a variant part of record and the parts nested in
+// its variants. Every label must be a distinct constant of the tag type.
+func (sb *SemanticAnalyzer) addVariantPart(record *recordSymbol, node *variantPart, parent *variantSymbol) error {
+	part := &variantPartSymbol{parent: parent}
+	if node.tag != nil {
+		if err := sb.addField(record, node.tag, node.tagType, parent); err != nil {
+			return err
+		}
+		part.tag = record.field(node.tag.value.(string))
+	}
+	tagType, err := sb.typeOf(node.tagType, "")
+	if err != nil {
+		return err
+	}
+	if !isOrdinal(tagType) {
+		return sb.error(errors.IncompatibleTypes, node.tagType.token, "addVariantPart")
+	}
+
+	var seen []*caseLabel
+	for _, arm := range node.variants {
+		variant := &variantSymbol{labels: arm.labels, part: part}
+		for _, label := range arm.labels {
+			if err := sb.resolveLabel(label, tagType); err != nil {
+				return err
+			}
+			if overlaps(label, seen) {
+				return sb.error(errors.DuplicateCaseLabel, label.Token(), "addVariantPart")
+			}
+			seen = append(seen, label)
+		}
+		part.variants = append(part.variants, variant)
+		for _, field := range arm.fields {
+			decl := field.(*varDecl)
+			if err := sb.addField(record, decl.varNode.Token(), decl.typeNode, variant); err != nil {
+				return err
+			}
+		}
+		if arm.variant != nil {
+			if err := sb.addVariantPart(record, arm.variant, variant); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// visitAssign checks that the value can be stored in the target: reals do not
+// go into integers, and other types must match apart from the widenings
+// assignable allows.
+func (sb *SemanticAnalyzer) visitAssign(node *assign) error {
+	if err := sb.visitTarget(node.left); err != nil {
+		return err
+	}
+	if err := sb.VisitNode(node.right); err != nil {
+		return err
+	}
+	if !assignable(sb.exprType(node.left), sb.exprType(node.right)) {
+		return sb.errorAt(errors.IncompatibleTypes, node.right, "visitAssign")
+	}
+	return nil
+}
+
+// visitTarget resolves the left side of an assignment. Inside a function body
+// the function's own name stands for its result.
+func (sb *SemanticAnalyzer) visitTarget(node Node) error {
+	v, isVar := node.(*Var)
+	if isVar {
+		proc, ok := sb.lookup(v.token.value.(string), false).(*procedureSymbol)
+		if ok && proc.result != nil && sb.inside(proc) {
+			v.symbol = proc.result
+			return nil
+		}
+	}
+	if err := sb.VisitNode(node); err != nil {
+		return err
+	}
+	if root := rootVar(node); root == nil || root.call != nil {
+		return sb.error(errors.InvalidIdentifier, node.Token(), "visitTarget")
+	} else if root.constant != nil || root.symbol != nil && root.symbol.mode == constParam {
+		return sb.error(errors.AssignToConstant, root.token, "visitTarget")
+	}
+	if isVar {
+		for _, control := range sb.controls {
+			if v.symbol == control {
+				return sb.error(errors.InvalidForControl, v.token, "visitTarget")
+			}
+		}
+	}
+	return nil
+}
+
+// visitCondition visits an expression that must be boolean.
+func (sb *SemanticAnalyzer) visitCondition(node Node) error {
+	if err := sb.VisitNode(node); err != nil {
+		return err
+	}
+	if !isBoolean(sb.exprType(node)) {
+		return sb.error(errors.IncompatibleTypes, node.Token(), "visitCondition")
+	}
+	return nil
+}
+
+func (sb *SemanticAnalyzer) visitIf(node *ifStmt) error {
+	if err := sb.visitCondition(node.cond); err != nil {
+		return err
+	}
+	if err := sb.VisitNode(node.then); err != nil {
+		return err
+	}
+	if node.elseStmt != nil {
+		return sb.VisitNode(node.elseStmt)
+	}
+	return nil
+}
+
+func (sb *SemanticAnalyzer) visitWhile(node *whileStmt) error {
+	if err := sb.visitCondition(node.cond); err != nil {
+		return err
+	}
+	return sb.VisitNode(node.body)
 }
 
-func (sb *SemanticAnalyzer) visitVar(node *Var) interface{} {
+func (sb *SemanticAnalyzer) visitRepeat(node *repeatStmt) error {
+	for _, child := range node.body {
+		if err := sb.VisitNode(child); err != nil {
+			return err
+		}
+	}
+	return sb.visitCondition(node.cond)
+}
+
+func (sb *SemanticAnalyzer) VisitConstDecl(node *constDecl) error {
+	name := node.name.value.(string)
+	if sb.lookup(name, true) != nil {
+		return sb.error(errors.DuplicateID, node.name, "VisitConstDecl")
+	}
+	if err := sb.VisitNode(node.expr); err != nil {
+		return err
+	}
+	value, err := sb.constValue(node.expr)
+	if err != nil {
+		return err
+	}
+	sb.define(&constSymbol{name: name, typ: sb.exprType(node.expr), value: value})
+	return nil
+}
+
+// constValue evaluates a constant expression at analysis time. The expression
+// must already have been visited so that constant names are resolved.
+func (sb *SemanticAnalyzer) constValue(node Node) (Value, error) {
+	switch v := node.(type) {
+	case *Num:
+		value, _ := valueOf(v.value)
+		return value, nil
+	case *boolConst:
+		return boolVal(v.value), nil
+	case *strConst:
+		return textVal(v.value), nil
+	case *Var:
+		if v.constant != nil {
+			return v.constant.value, nil
+		}
+	case *BinOp:
+		left, err := sb.constValue(v.left)
+		if err != nil {
+			return Value{}, err
+		}
+		right, err := sb.constValue(v.right)
+		if err != nil {
+			return Value{}, err
+		}
+		value, err := binary(v.op.typ, left, right)
+		if err != nil {
+			code := errors.NotConstant
+			if e, ok := err.(*errors.Error); ok && e.Code() != "" {
+				code = e.Code()
+			}
+			return Value{}, sb.error(code, v.op, "constValue")
+		}
+		return value, nil
+	case *UnaryOp:
+		val, err := sb.constValue(v.expr)
+		if err != nil {
+			return Value{}, err
+		}
+		if value, err := unary(v.op.typ, val); err == nil {
+			return value, nil
+		}
+	}
+	return Value{}, sb.error(errors.NotConstant, node.Token(), "constValue")
+}
+
+// visitCase checks that every label is a constant of the selector's ordinal
+// type and that no value is covered by more than one label.
+func (sb *SemanticAnalyzer) visitCase(node *caseStmt) error {
+	if err := sb.VisitNode(node.selector); err != nil {
+		return err
+	}
+	selectorType := sb.exprType(node.selector)
+	if !isOrdinal(selectorType) {
+		return sb.error(errors.IncompatibleTypes, node.selector.Token(), "visitCase")
+	}
+
+	var seen []*caseLabel
+	for _, branch := range node.branches {
+		for _, label := range branch.labels {
+			if err := sb.resolveLabel(label, selectorType); err != nil {
+				return err
+			}
+			if overlaps(label, seen) {
+				return sb.error(errors.DuplicateCaseLabel, label.Token(), "visitCase")
+			}
+			seen = append(seen, label)
+		}
+		if err := sb.VisitNode(branch.body); err != nil {
+			return err
+		}
+	}
+
+	for _, child := range node.elseBody {
+		if err := sb.VisitNode(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveLabel checks that the bounds of a case or variant label are
+// constants of type typ and fills in their ordinals.
+func (sb *SemanticAnalyzer) resolveLabel(label *caseLabel, typ Symbol) error {
+	bounds := []Node{label.lo}
+	if label.hi != nil {
+		bounds = append(bounds, label.hi)
+	}
+	ordinals := make([]int, len(bounds))
+	for i, bound := range bounds {
+		if err := sb.VisitNode(bound); err != nil {
+			return err
+		}
+		if !sameType(baseType(sb.exprType(bound)), baseType(typ)) {
+			return sb.error(errors.IncompatibleTypes, bound.Token(), "resolveLabel")
+		}
+		v, err := sb.constValue(bound)
+		if err != nil {
+			return err
+		}
+		ordinals[i] = ordinal(v)
+	}
+	label.low, label.high = ordinals[0], ordinals[len(ordinals)-1]
+	if label.low > label.high {
+		return sb.error(errors.InvalidRange, label.Token(), "resolveLabel")
+	}
+	return nil
+}
+
+// overlaps reports whether label covers a value one of labels covers too.
+func overlaps(label *caseLabel, labels []*caseLabel) bool {
+	for _, other := range labels {
+		if label.low <= other.high && other.low <= label.high {
+			return true
+		}
+	}
+	return false
+}
+
+// visitFor checks that the control variable is an ordinal variable declared in
+// the current block and that the loop body does not assign to it.
+func (sb *SemanticAnalyzer) visitFor(node *forStmt) error {
+	if err := sb.visitTarget(node.variable); err != nil {
+		return err
+	}
+	control := node.variable.symbol
+	if control == nil || control.level != sb.scopeLevel || control.mode == varParam || !isOrdinal(control.Type()) {
+		return sb.error(errors.InvalidForControl, node.variable.token, "visitFor")
+	}
+	for _, bound := range []Node{node.start, node.end} {
+		if err := sb.VisitNode(bound); err != nil {
+			return err
+		}
+		if !assignable(control.Type(), sb.exprType(bound)) {
+			return sb.error(errors.IncompatibleTypes, bound.Token(), "visitFor")
+		}
+	}
+
+	sb.controls = append(sb.controls, control)
+	err := sb.VisitNode(node.body)
+	sb.controls = sb.controls[:len(sb.controls)-1]
+	return err
+}
+
+// inside reports whether the body of proc is being visited.
+func (sb *SemanticAnalyzer) inside(proc *procedureSymbol) bool {
+	for _, r := range sb.routines {
+		if r == proc {
+			return true
+		}
+	}
+	return false
+}
+
+func (sb *SemanticAnalyzer) visitVar(node *Var) error {
 	varName, _ := node.Token().value.(string)
-	varSymbol := sb.lookup(varName, false)
+	symbol := sb.lookup(varName, false)
 
-	if varSymbol == nil {
-		panic("reference before assignment")
+	if symbol == nil {
+		return sb.error(errors.IDNotFound, node.Token(), "visitVar")
+	}
+	if constant, ok := symbol.(*constSymbol); ok {
+		node.constant = constant
+		return nil
+	}
+	if field, ok := symbol.(*fieldSymbol); ok {
+		node.with = &fieldVar{
+			record: &Var{token: node.token, symbol: field.record},
+			field:  node.token,
+			typ:    field.Type(),
+		}
+		return nil
+	}
+	if proc, ok := symbol.(*procedureSymbol); ok && proc.typ != nil {
+		if len(proc.params) != 0 {
+			return sb.error(errors.WrongParamsNum, node.Token(), "visitVar")
+		}
+		node.call = &funcCall{procCall{
+			procName:   proc.name,
+			token:      node.token,
+			end:        node.token,
+			procSymbol: proc,
+		}}
+		return nil
+	}
+	varSymbol, ok := symbol.(*varSymbol)
+	if !ok {
+		return sb.error(errors.InvalidIdentifier, node.Token(), "visitVar")
 	}
+	node.symbol = varSymbol
 	return nil
 }
 
-func (sb *SemanticAnalyzer) visitVarDecl(node *varDecl) {
-	typeName := node.typeNode.(*typeNode).value
-	typeSymbol := sb.lookup(typeName.(string), false)
+// visitIndexedVar checks that each index selects from an array or a string
+// and fits the index type.
+func (sb *SemanticAnalyzer) visitIndexedVar(node *indexedVar) error {
+	if err := sb.VisitNode(node.array); err != nil {
+		return err
+	}
+	typ := sb.exprType(node.array)
+	for _, index := range node.indices {
+		if err := sb.VisitNode(index); err != nil {
+			return err
+		}
+		indexType := sb.lookup("integer", false)
+		switch t := typ.(type) {
+		case *arraySymbol:
+			if t.index != nil {
+				indexType = t.index
+			}
+			typ = t.elem
+		default:
+			if !isString(t) {
+				return sb.error(errors.IncompatibleTypes, node.token, "visitIndexedVar")
+			}
+			typ = sb.lookup("char", false)
+		}
+		if !assignable(indexType, sb.exprType(index)) {
+			return sb.error(errors.IncompatibleTypes, index.Token(), "visitIndexedVar")
+		}
+	}
+	node.typ = typ
+	return nil
+}
 
-	varName, _ := node.varNode.Value()
-	varSymbol := varSymbol{name: varName.(string), typ: typeSymbol}
+func (sb *SemanticAnalyzer) visitFieldVar(node *fieldVar) error {
+	if err := sb.VisitNode(node.record); err != nil {
+		return err
+	}
+	record, ok := sb.exprType(node.record).(*recordSymbol)
+	if !ok {
+		return sb.error(errors.IncompatibleTypes, node.field, "visitFieldVar")
+	}
+	field := record.field(node.field.value.(string))
+	if field == nil {
+		return sb.error(errors.IDNotFound, node.field, "visitFieldVar")
+	}
+	node.typ = field.typ
+	return nil
+}
+
+// visitWith stores each record in a hidden variable and visits the body in
+// scopes that make the record fields visible, the last record innermost.
+func (sb *SemanticAnalyzer) visitWith(node *withStmt) error {
+	enclosing := sb.ScopedSymbolTable
+	defer func() { sb.ScopedSymbolTable = enclosing }()
+
+	for _, record := range node.records {
+		if err := sb.VisitNode(record); err != nil {
+			return err
+		}
+		typ, ok := sb.exprType(record).(*recordSymbol)
+		if !ok {
+			return sb.error(errors.IncompatibleTypes, record.Token(), "visitWith")
+		}
+		sb.withs++
+		hidden := &varSymbol{name: fmt.Sprintf("$with%d", sb.withs), typ: typ, level: sb.scopeLevel}
+		node.vars = append(node.vars, hidden)
+		sb.allocate(hidden)
 
-	if sb.lookup(varName.(string), true) != nil {
-		panic(fmt.Sprintf("Error: Duplicate identifier '%s' found", varName))
+		scope := NewScopedSymbolTable(sb.scopeName, sb.scopeLevel, sb.ScopedSymbolTable)
+		scope.trace = sb.trace
+		for _, field := range typ.fields {
+			scope.define(&fieldSymbol{field: field, record: hidden})
+		}
+		sb.ScopedSymbolTable = scope
+	}
+	return sb.VisitNode(node.body)
+}
+
+func (sb *SemanticAnalyzer) visitFuncCall(node *funcCall) error {
+	if err := sb.visitProcCall(&node.procCall); err != nil {
+		return err
+	}
+	if node.resultType() == nil {
+		return sb.error(errors.InvalidIdentifier, node.Token(), "visitFuncCall")
+	}
+	return nil
+}
+
+func (sb *SemanticAnalyzer) visitProcCall(node *procCall) error {
+	symbol := sb.lookup(node.procName, false)
+	if builtin, ok := builtins[node.procName]; ok && symbol == nil {
+		return sb.visitBuiltinCall(node, builtin)
+	}
+	if symbol == nil {
+		return sb.error(errors.IDNotFound, node.Token(), "visitProcCall")
+	}
+	procSymbol, ok := symbol.(*procedureSymbol)
+	if !ok {
+		return sb.error(errors.InvalidIdentifier, node.Token(), "visitProcCall")
+	}
+	if len(node.actualParams) != len(procSymbol.params) {
+		return sb.error(errors.WrongParamsNum, node.Token(), "visitProcCall")
+	}
+
+	for i, arg := range node.actualParams {
+		param := procSymbol.params[i].(*varSymbol)
+		if param.mode == varParam {
+			if err := sb.visitVarArg(param, arg); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := sb.VisitNode(arg); err != nil {
+			return err
+		}
+		if !assignable(param.Type(), sb.exprType(arg)) {
+			return sb.error(errors.IncompatibleTypes, arg.Token(), "visitProcCall")
+		}
+	}
+	node.procSymbol = procSymbol
+	return nil
+}
+
+// visitVarArg checks the argument for a var parameter: it must be a variable
+// of exactly the parameter's type. A character of a string is not a variable
+// of its own and cannot be passed.
+func (sb *SemanticAnalyzer) visitVarArg(param *varSymbol, arg Node) error {
+	if err := sb.visitTarget(arg); err != nil {
+		return err
+	}
+	if index, ok := arg.(*indexedVar); ok {
+		// a[i, j] selects from the element a[i]
+		typ := sb.exprType(index.array)
+		for range index.indices[1:] {
+			if arr, ok := typ.(*arraySymbol); ok {
+				typ = arr.elem
+			}
+		}
+		if isString(typ) {
+			return sb.error(errors.InvalidIdentifier, arg.Token(), "visitVarArg")
+		}
+	}
+	if !sameType(param.Type(), sb.exprType(arg)) {
+		return sb.error(errors.IncompatibleTypes, arg.Token(), "visitVarArg")
+	}
+	return nil
+}
+
+// exprType infers the type of an expression that has already been visited.
+func (sb *SemanticAnalyzer) exprType(node Node) Symbol {
+	return exprType(node, sb.ScopedSymbolTable)
+}
+
+// exprType infers the type of an expression that has already been visited,
+// taking the types of literals from scope.
+func exprType(node Node, scope *ScopedSymbolTable) Symbol {
+	switch v := node.(type) {
+	case *Num:
+		if _, ok := v.value.(float64); ok {
+			return scope.lookup("real", false)
+		}
+		return scope.lookup("integer", false)
+	case *boolConst:
+		return scope.lookup("boolean", false)
+	case *strConst:
+		if len([]rune(v.value)) == 1 {
+			return scope.lookup("char", false)
+		}
+		return scope.lookup("string", false)
+	case *Var:
+		if v.constant != nil {
+			return v.constant.Type()
+		}
+		if v.with != nil {
+			return v.with.typ
+		}
+		if v.call != nil {
+			return v.call.procSymbol.Type()
+		}
+		return v.symbol.Type()
+	case *indexedVar:
+		return v.typ
+	case *fieldVar:
+		return v.typ
+	case *funcCall:
+		return v.resultType()
+	case *UnaryOp:
+		return v.typ
+	case *BinOp:
+		return v.typ
+	default:
+		return nil
 	}
+}
 
-	sb.define(&varSymbol)
+// assignable reports whether a value of type from can be stored in a variable
+// of type to. Values stored into a subrange are range checked at runtime.
+func assignable(to, from Symbol) bool {
+	to, from = baseType(to), baseType(from)
+	if to == nil || from == nil {
+		return false
+	}
+	return sameType(to, from) || to.Name() == "real" && from.Name() == "integer" || isString(to) && isChar(from)
 }
 
-func (sb *SemanticAnalyzer) VisitNode(node Node) interface{} {
+func (sb *SemanticAnalyzer) VisitNode(node Node) error {
 	switch v := node.(type) {
 	case *BinOp:
 		return sb.visitBinOp(v)
 	case *Num:
 		return sb.visitNum(v)
+	case *boolConst:
+		return sb.visitBoolConst(v)
+	case *strConst:
+		return sb.visitStrConst(v)
 	case *UnaryOp:
 		return sb.VisitUnaryOp(v)
 	case *Compound:
-		sb.VisitCompound(v)
+		return sb.VisitCompound(v)
 	case *assign:
-		sb.visitAssign(v)
+		return sb.visitAssign(v)
 	case *NoOp:
-		sb.VisitNoOp(v)
+		return sb.VisitNoOp(v)
 	case *Var:
 		return sb.visitVar(v)
+	case *indexedVar:
+		return sb.visitIndexedVar(v)
+	case *fieldVar:
+		return sb.visitFieldVar(v)
 	case *block:
-		sb.VisitBlock(v)
+		return sb.VisitBlock(v)
 	case *varDecl:
-		sb.VisitVarDecl(v)
+		return sb.VisitVarDecl(v)
+	case *constDecl:
+		return sb.VisitConstDecl(v)
+	case *typeDecl:
+		return sb.VisitTypeDecl(v)
 	case *procDecl:
-		sb.VisitProcedureDec(v)
+		return sb.VisitProcedureDec(v)
+	case *procCall:
+		return sb.visitProcCall(v)
+	case *ifStmt:
+		return sb.visitIf(v)
+	case *whileStmt:
+		return sb.visitWhile(v)
+	case *repeatStmt:
+		return sb.visitRepeat(v)
+	case *forStmt:
+		return sb.visitFor(v)
+	case *caseStmt:
+		return sb.visitCase(v)
+	case *withStmt:
+		return sb.visitWith(v)
+	case *funcCall:
+		return sb.visitFuncCall(v)
+	case *formatArg:
+		return sb.error(errors.UnexpectedToken, v.colon, "VisitNode")
 	case *typeNode:
-		sb.VisitType(v)
+		return sb.VisitType(v)
 	case *program:
 		return sb.visitProgram(v)
 	default:
-		panic(fmt.Sprintf("unexpected type occurrence %T", v))
+		return errors.NewSemanticError(fmt.Sprintf("unexpected type occurrence %T", v), "VisitNode")
 	}
-	return nil
 }
 
-func (sb *SemanticAnalyzer) VisitProcedureDec(node *procDecl) {
+// VisitProcedureDec declares a procedure or function and checks its body. The
+// body of a forward declared routine completes the symbol defined by the
+// forward declaration, so calls analyzed in between reach it.
+func (sb *SemanticAnalyzer) VisitProcedureDec(node *procDecl) error {
 	procName := node.procName
 	procSymbol := &procedureSymbol{
-		name: procName,
+		name:  procName,
+		level: sb.scopeLevel + 1,
+		block: node.block,
+	}
+	if node.returnType != nil {
+		typ, err := sb.typeOf(node.returnType, "")
+		if err != nil {
+			return err
+		}
+		procSymbol.typ = typ
+		procSymbol.result = &varSymbol{name: procName, typ: procSymbol.typ, level: procSymbol.level}
 	}
-	sb.define(procSymbol)
-	fmt.Printf("Entering scope: %s", procName)
-	procedureScope := NewScopedSymbolTable(procName, sb.scopeLevel+1, sb.ScopedSymbolTable)
-	sb.ScopedSymbolTable = procedureScope
-
 	for _, p := range node.params {
-		paramType := sb.lookup(p.typeNode.value.(string), false)
-		paramName := p.varNode.value
+		paramType, err := sb.typeOf(p.typeNode, "")
+		if err != nil {
+			return err
+		}
+		name := p.varNode.value.(string)
+		for _, other := range procSymbol.params {
+			if other.Name() == name {
+				return sb.error(errors.DuplicateID, p.varNode.Token(), "VisitProcedureDec")
+			}
+		}
+		procSymbol.params = append(procSymbol.params, &varSymbol{
+			name:  name,
+			typ:   paramType,
+			level: procSymbol.level,
+			mode:  p.mode,
+		})
+	}
 
-		varSymbol := &varSymbol{
-			name: paramName.(string),
-			typ:  paramType,
+	previous := sb.lookup(procName, true)
+	forward, ok := previous.(*procedureSymbol)
+	completes := ok && forward.block == nil && node.block != nil
+	if node.token.typ == Function && node.returnType == nil {
+		// only the body of a forward declared function may leave out the
+		// result type
+		if !completes {
+			return sb.error(errors.MissingResultType, node.name, "VisitProcedureDec")
+		}
+		if forward.typ == nil {
+			return sb.error(errors.ForwardMismatch, node.name, "VisitProcedureDec")
 		}
-		sb.define(varSymbol)
-		procSymbol.params = append(procSymbol.params, varSymbol)
+		procSymbol.typ = forward.typ
 	}
-	sb.VisitNode(node.block)
+	if completes {
+		if !forward.matches(procSymbol) {
+			return sb.error(errors.ForwardMismatch, node.name, "VisitProcedureDec")
+		}
+		forward.block = node.block
+		procSymbol = forward
+	} else if previous != nil {
+		return sb.error(errors.DuplicateID, node.name, "VisitProcedureDec")
+	} else {
+		sb.define(procSymbol)
+	}
+	if node.block == nil {
+		return nil
+	}
+
+	sb.tracef("Entering scope: %s\n", procName)
+	procedureScope := sb.newScope(procName, sb.scopeLevel+1)
+
+	for _, param := range procSymbol.params {
+		sb.define(param)
+		sb.allocate(param.(*varSymbol))
+	}
+	if procSymbol.result != nil {
+		sb.allocate(procSymbol.result)
+	}
+	sb.routines = append(sb.routines, procSymbol)
+	err := sb.VisitNode(node.block)
+	sb.routines = sb.routines[:len(sb.routines)-1]
+	if err != nil {
+		return through(err, "procedure "+procName)
+	}
+	procSymbol.vars = procedureScope.vars
 
-	fmt.Println(procedureScope)
+	sb.tracef("%s\n", procedureScope)
 
-	sb.ScopedSymbolTable = procedureScope
-	fmt.Printf("Leave scope: %s", procName)
+	sb.ScopedSymbolTable = procedureScope.enclosingScope
+	sb.tracef("Leave scope: %s\n", procName)
+	return nil
+}
+
+func (sb *SemanticAnalyzer) VisitType(_ *typeNode) error { return nil }
+
+func (sb *SemanticAnalyzer) error(code errors.Code, token *Token, context string) *errors.Error {
+	msg := fmt.Sprintf("%s in scope %s", token, sb.scopeName)
+	return errors.NewSemanticError(msg, context, errors.ErrorCode(code), at(token))
 }
 
-func (sb *SemanticAnalyzer) VisitType(_ *typeNode) {}
+// errorAt reports an error about a whole expression at the position where it
+// starts rather than at its operator.
+func (sb *SemanticAnalyzer) errorAt(code errors.Code, node Node, context string) *errors.Error {
+	err := sb.error(code, node.Token(), context)
+	atNode(node)(err)
+	return err
+}
+
+// through records that err escaped from the named scope when err is one of ours.
+func through(err error, scopeDescription string) error {
+	if e, ok := err.(*errors.Error); ok {
+		return e.Through(scopeDescription)
+	}
+	return err
+}
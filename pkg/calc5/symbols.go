@@ -17,27 +17,240 @@ func (b *builtinTypeSymbol) Type() Symbol { return nil }
 
 func (b *builtinTypeSymbol) String() string { return b.name }
 
-type varSymbol struct {
+// aliasSymbol is a type name declared as another name for an existing type.
+type aliasSymbol struct {
 	name string
 	typ  Symbol
 }
 
+func (a *aliasSymbol) Name() string { return a.name }
+
+func (a *aliasSymbol) Type() Symbol { return a.typ }
+
+func (a *aliasSymbol) String() string { return fmt.Sprintf("<alias %v = %v>", a.name, a.typ) }
+
+// enumSymbol is an enumerated type. Its values are constants whose ordinal is
+// their position in the declaration.
+type enumSymbol struct {
+	name   string
+	values []*constSymbol
+}
+
+func (e *enumSymbol) Name() string { return e.name }
+
+func (e *enumSymbol) Type() Symbol { return nil }
+
+func (e *enumSymbol) String() string { return e.name }
+
+// subrangeSymbol is the range low..high of the ordinal type base.
+type subrangeSymbol struct {
+	name      string
+	base      Symbol
+	low, high int
+}
+
+func (s *subrangeSymbol) Name() string { return s.name }
+
+func (s *subrangeSymbol) Type() Symbol { return nil }
+
+func (s *subrangeSymbol) String() string { return s.name }
+
+// arraySymbol is an array type. Multi-dimensional arrays are arrays of arrays.
+type arraySymbol struct {
+	name  string
+	index Symbol // ordinal index type, nil for a dynamic array indexed from 0
+	elem  Symbol
+}
+
+func (a *arraySymbol) Name() string { return a.name }
+
+func (a *arraySymbol) Type() Symbol { return nil }
+
+func (a *arraySymbol) String() string { return a.name }
+
+// recordSymbol is a record type with all of its fields, including the tag
+// and variant fields, in declaration order.
+type recordSymbol struct {
+	name     string
+	fields   []*varSymbol
+	variants map[string]*variantSymbol // variant each variant field belongs to
+}
+
+func (r *recordSymbol) Name() string { return r.name }
+
+func (r *recordSymbol) Type() Symbol { return nil }
+
+func (r *recordSymbol) String() string { return r.name }
+
+func (r *recordSymbol) field(name string) *varSymbol {
+	for _, f := range r.fields {
+		if f.name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// variantPartSymbol is the layout of a record's variant part.
+type variantPartSymbol struct {
+	tag      *varSymbol // nil when the variant part has no tag field
+	variants []*variantSymbol
+	parent   *variantSymbol // variant the part is nested in, nil at the top level
+}
+
+// variantSymbol is one arm of a variant part. Its fields share storage with
+// the fields of the other arms.
+type variantSymbol struct {
+	labels []*caseLabel
+	fields []*varSymbol
+	part   *variantPartSymbol
+}
+
+// selects reports whether a tag with the given ordinal selects v.
+func (v *variantSymbol) selects(tag int) bool {
+	for _, label := range v.labels {
+		if label.low <= tag && tag <= label.high {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldSymbol is a record field made visible by a with statement. record is
+// the hidden variable the with statement stores the record in.
+type fieldSymbol struct {
+	field  *varSymbol
+	record *varSymbol
+}
+
+func (f *fieldSymbol) Name() string { return f.field.name }
+
+func (f *fieldSymbol) Type() Symbol { return f.field.typ }
+
+func (f *fieldSymbol) String() string { return fmt.Sprintf("<field %v.%v>", f.record.typ, f.field) }
+
+// bounds returns the lowest and highest ordinal of an index type.
+func bounds(index Symbol) (low, high int) {
+	switch t := index.(type) {
+	case *subrangeSymbol:
+		return t.low, t.high
+	case *enumSymbol:
+		return 0, len(t.values) - 1
+	}
+	if index.Name() == "char" {
+		return 0, 255
+	}
+	return 0, 1 // boolean
+}
+
+// baseType returns the host type of a subrange and typ itself otherwise.
+func baseType(typ Symbol) Symbol {
+	if s, ok := typ.(*subrangeSymbol); ok {
+		return s.base
+	}
+	return typ
+}
+
+// sameType reports whether a and b denote the same type. Builtin types are
+// registered in every scope, so they are compared by name.
+func sameType(a, b Symbol) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	if _, ok := a.(*builtinTypeSymbol); ok {
+		return a.Name() == b.Name()
+	}
+	return a == b
+}
+
+// paramMode tells how an argument is passed to a parameter.
+type paramMode int
+
+const (
+	valueParam paramMode = iota // the parameter gets a copy of the argument
+	varParam                    // the parameter is another name for the argument variable
+	constParam                  // like valueParam, but the parameter cannot be assigned
+)
+
+func (m paramMode) String() string {
+	switch m {
+	case varParam:
+		return "var"
+	case constParam:
+		return "const"
+	default:
+		return "value"
+	}
+}
+
+type varSymbol struct {
+	name  string
+	typ   Symbol
+	level int       // scope level the variable is declared at
+	slot  int       // index of the variable in the activation record of its level
+	mode  paramMode // how a parameter is passed; valueParam for other variables
+}
+
 func (v *varSymbol) Name() string { return v.name }
 
 func (v *varSymbol) Type() Symbol { return v.typ }
 
 func (v *varSymbol) String() string { return fmt.Sprintf("<%v:%v>", v.name, v.typ) }
 
+// constSymbol is a named constant whose value is known at analysis time.
+type constSymbol struct {
+	name  string
+	typ   Symbol
+	value Value
+}
+
+func (c *constSymbol) Name() string { return c.name }
+
+func (c *constSymbol) Type() Symbol { return c.typ }
+
+func (c *constSymbol) String() string {
+	return fmt.Sprintf("<const %v:%v = %s>", c.name, c.typ, literal(c.value))
+}
+
 type procedureSymbol struct {
 	name   string
 	params []Symbol
-	typ    Symbol
+	typ    Symbol // result type, nil for procedures
+	level  int    // scope level of the procedure body
+	block  *block
+	result *varSymbol   // the function name used as an assignment target in its body
+	vars   []*varSymbol // parameters, result and locals in slot order
 }
 
 func (p *procedureSymbol) String() string {
+	if p.typ != nil {
+		return fmt.Sprintf("<functionSymbol{%s, %v, %v}>", p.name, p.params, p.typ)
+	}
 	return fmt.Sprintf("<procedureSymbol{%s, %v}>", p.name, p.params)
 }
 
 func (p *procedureSymbol) Name() string { return p.name }
 
+// matches reports whether def, the heading that comes with the body, repeats
+// the forward declaration p. def may leave out the parameter list, and the
+// analyzer fills in the result type when def leaves that out.
+func (p *procedureSymbol) matches(def *procedureSymbol) bool {
+	if (p.typ == nil) != (def.typ == nil) || p.typ != nil && !sameType(p.typ, def.typ) {
+		return false
+	}
+	if len(def.params) == 0 {
+		return true
+	}
+	if len(def.params) != len(p.params) {
+		return false
+	}
+	for i, param := range p.params {
+		want, got := param.(*varSymbol), def.params[i].(*varSymbol)
+		if want.name != got.name || want.mode != got.mode || !sameType(want.typ, got.typ) {
+			return false
+		}
+	}
+	return true
+}
+
 func (p *procedureSymbol) Type() Symbol { return p.typ }
@@ -0,0 +1,255 @@
+package calc5
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/IngvarListard/pascal-go-intepreter/pkg/calc5/errors"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// writable reports whether write and writeln can print a value of type typ.
+func writable(typ Symbol) bool {
+	return isNumeric(typ) || isOrdinal(typ) || isText(typ)
+}
+
+// readable reports whether read and readln can store input into a variable of
+// type typ.
+func readable(typ Symbol) bool {
+	return isNumeric(typ) || isText(typ)
+}
+
+// visitWriteCall checks the arguments of write and writeln. Field widths and
+// decimals must be integers, and only reals take decimals.
+func (sb *SemanticAnalyzer) visitWriteCall(node *procCall) error {
+	node.argTypes = make([]Symbol, len(node.actualParams))
+	for idx, arg := range node.actualParams {
+		format, _ := arg.(*formatArg)
+		if format != nil {
+			arg = format.expr
+		}
+		if err := sb.VisitNode(arg); err != nil {
+			return err
+		}
+		typ := sb.exprType(arg)
+		if !writable(typ) {
+			return sb.error(errors.IncompatibleTypes, arg.Token(), "visitWriteCall")
+		}
+		node.argTypes[idx] = typ
+		if format == nil {
+			continue
+		}
+		for _, n := range []Node{format.width, format.precision} {
+			if n == nil {
+				continue
+			}
+			if err := sb.VisitNode(n); err != nil {
+				return err
+			}
+			if !isInteger(sb.exprType(n)) {
+				return sb.error(errors.IncompatibleTypes, n.Token(), "visitWriteCall")
+			}
+		}
+		if format.precision != nil && !isReal(typ) {
+			return sb.error(errors.IncompatibleTypes, format.precision.Token(), "visitWriteCall")
+		}
+	}
+	return nil
+}
+
+// visitReadCall checks that every argument of read and readln is a variable
+// of a type that can be read.
+func (sb *SemanticAnalyzer) visitReadCall(node *procCall) error {
+	node.argTypes = make([]Symbol, len(node.actualParams))
+	for idx, arg := range node.actualParams {
+		if err := sb.visitTarget(arg); err != nil {
+			return err
+		}
+		typ := sb.exprType(arg)
+		if !readable(typ) {
+			return sb.error(errors.IncompatibleTypes, arg.Token(), "visitReadCall")
+		}
+		node.argTypes[idx] = typ
+	}
+	return nil
+}
+
+// write prints the arguments of write or writeln to the interpreter output.
+func (i *Interpreter) write(node *procCall) error {
+	var b strings.Builder
+	for idx, arg := range node.actualParams {
+		width, precision := 0, -1
+		if format, ok := arg.(*formatArg); ok {
+			arg = format.expr
+			w, err := i.VisitNode(format.width)
+			if err != nil {
+				return err
+			}
+			width = w.Int()
+			if format.precision != nil {
+				p, err := i.VisitNode(format.precision)
+				if err != nil {
+					return err
+				}
+				precision = p.Int()
+			}
+		}
+		v, err := i.VisitNode(arg)
+		if err != nil {
+			return err
+		}
+		if err := checkFormat(width, precision); err != nil {
+			return positioned(err, atNode(arg))
+		}
+		b.WriteString(formatValue(v, node.argTypes[idx], width, precision))
+	}
+	if node.builtin.name == "writeln" {
+		b.WriteByte('\n')
+	}
+	if _, err := io.WriteString(i.output, b.String()); err != nil {
+		return errors.NewRuntimeError(err.Error(), "write", at(node.token))
+	}
+	return nil
+}
+
+// maxFieldWidth bounds the field width and the decimals a write may ask for.
+const maxFieldWidth = 1 << 12
+
+// checkFormat reports a field width or precision above maxFieldWidth.
+func checkFormat(width, precision int) error {
+	if width > maxFieldWidth || precision > maxFieldWidth {
+		return errors.NewRuntimeError(fmt.Sprintf("field width or precision exceeds %d", maxFieldWidth), "write",
+			errors.ErrorCode(errors.OutOfRange),
+		)
+	}
+	return nil
+}
+
+// formatValue renders v of type typ right-aligned in a field of width
+// characters. A non-negative precision prints a real in fixed notation with
+// that many decimals; otherwise reals use the shortest form that reads back
+// as the same number, given a decimal point when it would look like an
+// integer.
+func formatValue(v Value, typ Symbol, width, precision int) string {
+	var s string
+	switch v.kind {
+	case kindReal:
+		if precision < 0 {
+			s = strconv.FormatFloat(v.Real(), 'g', -1, 64)
+			if !strings.ContainsAny(s, ".eIN") {
+				s += ".0"
+			}
+		} else {
+			s = strconv.FormatFloat(v.Real(), 'f', precision, 64)
+		}
+	case kindBool:
+		s = strings.ToUpper(strconv.FormatBool(v.Bool()))
+	case kindInt:
+		n := v.Int()
+		s = strconv.Itoa(n)
+		if enum, ok := baseType(typ).(*enumSymbol); ok && n >= 0 && n < len(enum.values) {
+			s = enum.values[n].name
+		}
+	default:
+		s, _ = v.text()
+	}
+	if n := utf8.RuneCountInString(s); n < width {
+		s = strings.Repeat(" ", width-n) + s
+	}
+	return s
+}
+
+// read stores values taken from the interpreter input into the arguments of
+// read or readln. readln then skips the rest of the input line.
+func (i *Interpreter) read(node *procCall) error {
+	for idx, arg := range node.actualParams {
+		v, err := readValue(i.input, node.argTypes[idx])
+		if err != nil {
+			return positioned(err, atNode(arg))
+		}
+		if err := i.assignTo(arg, v, arg.Token()); err != nil {
+			return err
+		}
+	}
+	if node.builtin.name == "readln" {
+		skipLine(i.input)
+	}
+	return nil
+}
+
+// skipLine consumes input up to and including the next line break.
+func skipLine(in *bufio.Reader) {
+	for {
+		r, _, err := in.ReadRune()
+		if err != nil || r == '\n' {
+			return
+		}
+	}
+}
+
+// readValue reads one value of type typ from in. A char takes the next
+// character, a string the rest of the line, and a number the next word after
+// skipping white space. Errors carry no position.
+func readValue(in *bufio.Reader, typ Symbol) (Value, error) {
+	if isString(typ) {
+		var b strings.Builder
+		for {
+			r, _, err := in.ReadRune()
+			if err != nil {
+				break
+			}
+			if r == '\n' {
+				_ = in.UnreadRune()
+				break
+			}
+			b.WriteRune(r)
+		}
+		return strVal(strings.TrimSuffix(b.String(), "\r")), nil
+	}
+	if isChar(typ) {
+		r, _, err := in.ReadRune()
+		if err != nil {
+			return Value{}, inputError("unexpected end of input")
+		}
+		return charVal(r), nil
+	}
+
+	var b strings.Builder
+	for {
+		r, _, err := in.ReadRune()
+		if err != nil {
+			break
+		}
+		if unicode.IsSpace(r) {
+			if b.Len() == 0 {
+				continue
+			}
+			_ = in.UnreadRune()
+			break
+		}
+		b.WriteRune(r)
+	}
+	word := b.String()
+	if word == "" {
+		return Value{}, inputError("unexpected end of input")
+	}
+	if isReal(typ) {
+		f, err := strconv.ParseFloat(word, 64)
+		if err != nil {
+			return Value{}, inputError(fmt.Sprintf("%q is not a real number", word))
+		}
+		return realVal(f), nil
+	}
+	n, err := strconv.Atoi(word)
+	if err != nil {
+		return Value{}, inputError(fmt.Sprintf("%q is not an integer", word))
+	}
+	return intVal(n), nil
+}
+
+func inputError(msg string) error {
+	return errors.NewRuntimeError(msg, "read", errors.ErrorCode(errors.InvalidInput))
+}
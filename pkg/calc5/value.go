@@ -0,0 +1,295 @@
+package calc5
+
+import (
+	"fmt"
+	"github.com/IngvarListard/pascal-go-intepreter/pkg/calc5/errors"
+	"math"
+	"strings"
+	"unicode/utf8"
+)
+
+// valueKind tells which fields of a Value are in use.
+type valueKind uint8
+
+const (
+	kindUndefined valueKind = iota // a variable that has not been assigned yet
+	kindInt                        // integers and enumeration ordinals, in bits
+	kindReal                       // the IEEE 754 bits in bits
+	kindBool                       // 0 or 1 in bits
+	kindChar                       // the character code in bits
+	kindString                     // string in obj
+	kindArray                      // *arrayValue in obj
+	kindRecord                     // *recordValue in obj
+	kindRef                        // *reference in obj, held by var parameters
+)
+
+// Value is a runtime value. Scalars are stored inline in one word, so
+// computing with them does not allocate; strings, arrays, records and
+// references are kept in obj.
+type Value struct {
+	kind valueKind
+	bits uint64
+	obj  interface{}
+}
+
+func intVal(n int) Value { return Value{kind: kindInt, bits: uint64(n)} }
+
+func realVal(f float64) Value { return Value{kind: kindReal, bits: math.Float64bits(f)} }
+
+func boolVal(b bool) Value {
+	if b {
+		return Value{kind: kindBool, bits: 1}
+	}
+	return Value{kind: kindBool}
+}
+
+func charVal(c rune) Value { return Value{kind: kindChar, bits: uint64(c)} }
+
+func strVal(s string) Value { return Value{kind: kindString, obj: s} }
+
+// textVal returns the value of a quoted literal: a char when it has exactly
+// one character and a string otherwise.
+func textVal(s string) Value {
+	if r, size := utf8.DecodeRuneInString(s); size > 0 && size == len(s) {
+		return charVal(r)
+	}
+	return strVal(s)
+}
+
+func arrayVal(a *arrayValue) Value { return Value{kind: kindArray, obj: a} }
+
+func recordVal(r *recordValue) Value { return Value{kind: kindRecord, obj: r} }
+
+func refVal(r *reference) Value { return Value{kind: kindRef, obj: r} }
+
+// valueOf converts a Go value of one of the types Interface returns.
+func valueOf(x interface{}) (Value, bool) {
+	switch v := x.(type) {
+	case int:
+		return intVal(v), true
+	case float64:
+		return realVal(v), true
+	case bool:
+		return boolVal(v), true
+	case rune:
+		return charVal(v), true
+	case string:
+		return strVal(v), true
+	case *arrayValue:
+		return arrayVal(v), true
+	case *recordValue:
+		return recordVal(v), true
+	}
+	return Value{}, false
+}
+
+// defined reports whether v has been assigned.
+func (v Value) defined() bool { return v.kind != kindUndefined }
+
+func (v Value) Int() int { return int(v.bits) }
+
+// Real returns v as a real number, converting integers.
+func (v Value) Real() float64 {
+	if v.kind == kindInt {
+		return float64(v.Int())
+	}
+	return math.Float64frombits(v.bits)
+}
+
+func (v Value) Bool() bool { return v.bits != 0 }
+
+func (v Value) Char() rune { return rune(v.bits) }
+
+// Str returns the contents of a string value.
+func (v Value) Str() string {
+	s, _ := v.obj.(string)
+	return s
+}
+
+func (v Value) array() *arrayValue { return v.obj.(*arrayValue) }
+
+func (v Value) record() *recordValue { return v.obj.(*recordValue) }
+
+func (v Value) ref() *reference { return v.obj.(*reference) }
+
+// text returns the string form of a string or char value.
+func (v Value) text() (string, bool) {
+	switch v.kind {
+	case kindString:
+		return v.Str(), true
+	case kindChar:
+		return string(v.Char()), true
+	}
+	return "", false
+}
+
+// Interface returns v as a plain Go value: int, float64, bool, rune, string,
+// or the array or record itself. An undefined value gives nil.
+func (v Value) Interface() interface{} {
+	switch v.kind {
+	case kindInt:
+		return v.Int()
+	case kindReal:
+		return v.Real()
+	case kindBool:
+		return v.Bool()
+	case kindChar:
+		return v.Char()
+	case kindString, kindArray, kindRecord:
+		return v.obj
+	case kindRef:
+		return v.ref().load().Interface()
+	}
+	return nil
+}
+
+func (v Value) String() string {
+	if v.kind == kindRef {
+		return v.ref().String()
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// literal formats a constant the way it is written in Pascal source.
+func literal(v Value) string {
+	if s, ok := v.text(); ok {
+		return "'" + strings.Replace(s, "'", "''", -1) + "'"
+	}
+	return v.String()
+}
+
+// ordinal returns the ordinal number of an integer, enumeration, boolean or
+// char value.
+func ordinal(v Value) int { return v.Int() }
+
+// fromOrdinal returns the value with ordinal n of the same type as like.
+func fromOrdinal(n int, like Value) Value { return Value{kind: like.kind, bits: uint64(n)} }
+
+// binary applies op to two evaluated operands. Strings and chars compare and
+// concatenate as text, an operation with a real operand or / is done in
+// reals, and everything else works on ordinals: integer arithmetic,
+// comparisons of ordinal values and boolean logic. Errors carry no position;
+// the caller adds the operator's.
+func binary(op TokenTyp, left, right Value) (Value, error) {
+	if l, ok := left.text(); ok {
+		if r, ok := right.text(); ok {
+			return textOp(op, l, r)
+		}
+	}
+	if left.kind == kindReal || right.kind == kindReal || op == FloatDiv {
+		return realOp(op, left.Real(), right.Real())
+	}
+	return ordinalOp(op, left.Int(), right.Int())
+}
+
+func textOp(op TokenTyp, left, right string) (Value, error) {
+	switch op {
+	case Equal:
+		return boolVal(left == right), nil
+	case NotEqual:
+		return boolVal(left != right), nil
+	case Less:
+		return boolVal(left < right), nil
+	case LessEqual:
+		return boolVal(left <= right), nil
+	case Greater:
+		return boolVal(left > right), nil
+	case GreaterEqual:
+		return boolVal(left >= right), nil
+	case Plus:
+		return strVal(left + right), nil
+	}
+	return Value{}, errors.NewRuntimeError(fmt.Sprintf("unexpected operator %v", op), "textOp")
+}
+
+func realOp(op TokenTyp, left, right float64) (Value, error) {
+	switch op {
+	case Equal:
+		return boolVal(left == right), nil
+	case NotEqual:
+		return boolVal(left != right), nil
+	case Less:
+		return boolVal(left < right), nil
+	case LessEqual:
+		return boolVal(left <= right), nil
+	case Greater:
+		return boolVal(left > right), nil
+	case GreaterEqual:
+		return boolVal(left >= right), nil
+	case Plus:
+		return realVal(left + right), nil
+	case Minus:
+		return realVal(left - right), nil
+	case Mul:
+		return realVal(left * right), nil
+	case FloatDiv:
+		if right == 0 {
+			return Value{}, divisionByZero(op, "realOp")
+		}
+		return realVal(left / right), nil
+	}
+	return Value{}, errors.NewRuntimeError(fmt.Sprintf("unexpected operator %v", op), "realOp")
+}
+
+func ordinalOp(op TokenTyp, left, right int) (Value, error) {
+	switch op {
+	case Equal:
+		return boolVal(left == right), nil
+	case NotEqual:
+		return boolVal(left != right), nil
+	case Less:
+		return boolVal(left < right), nil
+	case LessEqual:
+		return boolVal(left <= right), nil
+	case Greater:
+		return boolVal(left > right), nil
+	case GreaterEqual:
+		return boolVal(left >= right), nil
+	case Plus:
+		return intVal(left + right), nil
+	case Minus:
+		return intVal(left - right), nil
+	case Mul:
+		return intVal(left * right), nil
+	case IntegerDiv:
+		if right == 0 {
+			return Value{}, divisionByZero(op, "ordinalOp")
+		}
+		return intVal(left / right), nil
+	case And:
+		return boolVal(left != 0 && right != 0), nil
+	case Or:
+		return boolVal(left != 0 || right != 0), nil
+	case Xor:
+		return boolVal(left != right), nil
+	}
+	return Value{}, errors.NewRuntimeError(fmt.Sprintf("unexpected operator %v", op), "ordinalOp")
+}
+
+// unary applies a sign or not to v. Like binary, it leaves positioning
+// errors to the caller.
+func unary(op TokenTyp, v Value) (Value, error) {
+	switch {
+	case op == Not && v.kind == kindBool:
+		return boolVal(!v.Bool()), nil
+	case op == Plus && (v.kind == kindInt || v.kind == kindReal):
+		return v, nil
+	case op == Minus && v.kind == kindInt:
+		return intVal(-v.Int()), nil
+	case op == Minus && v.kind == kindReal:
+		return realVal(-v.Real()), nil
+	}
+	return Value{}, errors.NewRuntimeError(fmt.Sprintf("%v cannot be applied to %v", op, v), "unary")
+}
+
+func divisionByZero(op TokenTyp, context string) error {
+	return errors.NewRuntimeError(fmt.Sprintf("%v by zero", op), context, errors.ErrorCode(errors.DivisionByZero))
+}
+
+// positioned attaches a position to an error that was created without one.
+func positioned(err error, pos errors.Option) error {
+	if e, ok := err.(*errors.Error); ok && e.Line == 0 {
+		pos(e)
+	}
+	return err
+}
@@ -0,0 +1,449 @@
+package calc5
+
+import (
+	"fmt"
+	"github.com/IngvarListard/pascal-go-intepreter/pkg/calc5/errors"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// contextInterval is how many backward jumps and calls the virtual machine
+// makes between checks of the run's context.
+const contextInterval = 1024
+
+// vmFrame is a running procedure: its code, its activation record and where
+// it continues once the procedure it called returns.
+type vmFrame struct {
+	proc *procCode
+	ar   *activationRecord
+	pc   int
+	out  string // output of the write the call was made from
+}
+
+// machine runs bytecode on an operand stack. Frames use the same activation
+// records as the tree-walking interpreter, so variables, references and the
+// call stack trace look alike in both.
+type machine struct {
+	i      *Interpreter
+	prog   *bytecode
+	stack  []Value
+	frames []vmFrame
+	out    strings.Builder // output of the write or writeln the current frame is executing
+	budget int             // backward jumps and calls left until the next context check
+}
+
+// execute runs prog and then copies the assigned global variables into
+// GlobalScope, like VisitProgram does for the tree.
+func (i *Interpreter) execute(prog *bytecode) error {
+	main := prog.procs[0]
+	ar := newActivationRecord(main.name, arProgram, main.level, main.vars)
+	i.callStack = &callStack{}
+	i.callStack.push(ar)
+	i.tracef("ENTER: PROGRAM %s\n%s", main.name, i.callStack)
+
+	m := &machine{i: i, prog: prog, budget: contextInterval}
+	err := m.run(main, ar)
+
+	i.tracef("LEAVE: PROGRAM %s\n%s", main.name, i.callStack)
+	i.callStack.pop()
+	i.saveGlobals(ar)
+	return err
+}
+
+// run executes main until it returns. verify cannot tell whether an object
+// file keeps its operand stack and value kinds straight, so code that does
+// not is reported as a runtime error instead of crashing the machine.
+func (m *machine) run(main *procCode, ar *activationRecord) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.NewRuntimeError(fmt.Sprintf("malformed bytecode: %v", r), "run")
+		}
+	}()
+	m.frames = append(m.frames[:0], vmFrame{proc: main, ar: ar})
+	proc, slots := main, ar.slots
+	code, pc := main.code, 0
+	consts, types := m.prog.consts, m.prog.types
+	stack := m.stack[:0]
+
+	for err == nil {
+		in := code[pc]
+		pc++
+		switch in.op {
+		case opConst:
+			stack = append(stack, consts[in.a])
+		case opPop:
+			stack = stack[:len(stack)-1]
+		case opDup:
+			stack = append(stack, stack[len(stack)-1])
+		case opLoadLocal:
+			var v Value
+			if v, err = load(ar, int(in.a)); err == nil {
+				stack = append(stack, v)
+			}
+		case opLoad:
+			var v Value
+			if v, err = load(ar.enclosing(int(in.b)), int(in.a)); err == nil {
+				stack = append(stack, v)
+			}
+		case opStoreLocal:
+			store(slots, int(in.a), stack[len(stack)-1])
+			stack = stack[:len(stack)-1]
+		case opStore:
+			store(ar.enclosing(int(in.b)).slots, int(in.a), stack[len(stack)-1])
+			stack = stack[:len(stack)-1]
+		case opRef:
+			stack = append(stack, refVal(slotRef(ar.enclosing(int(in.b)).slots, int(in.a))))
+		case opInit:
+			if err = checkSize(types[in.b]); err == nil {
+				slots[in.a] = newValue(types[in.b])
+			}
+		case opClear:
+			slots[in.a] = Value{}
+		case opConvert:
+			top := &stack[len(stack)-1]
+			*top, err = convertValue(types[in.a], *top)
+		case opBinary:
+			left, right := &stack[len(stack)-2], stack[len(stack)-1]
+			*left, err = binary(TokenTyp(in.a), *left, right)
+			stack = stack[:len(stack)-1]
+		case opUnary:
+			top := &stack[len(stack)-1]
+			*top, err = unary(TokenTyp(in.a), *top)
+		case opAddInt, opSubInt, opMulInt, opDivInt:
+			left, right := &stack[len(stack)-2], stack[len(stack)-1].Int()
+			switch in.op {
+			case opAddInt:
+				*left = intVal(left.Int() + right)
+			case opSubInt:
+				*left = intVal(left.Int() - right)
+			case opMulInt:
+				*left = intVal(left.Int() * right)
+			case opDivInt:
+				if right == 0 {
+					err = divisionByZero(IntegerDiv, "run")
+					break
+				}
+				*left = intVal(left.Int() / right)
+			}
+			stack = stack[:len(stack)-1]
+		case opEqual, opNotEqual, opLess, opLessEqual, opGreater, opGreaterEqual:
+			left, right := &stack[len(stack)-2], stack[len(stack)-1].Int()
+			*left = boolVal(compare(in.op, left.Int(), right))
+			stack = stack[:len(stack)-1]
+		case opJump:
+			if int(in.a) < pc {
+				err = m.tick()
+			}
+			pc = int(in.a)
+		case opJumpFalse:
+			cond := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if cond.kind != kindBool {
+				err = errors.NewRuntimeError(fmt.Sprintf("condition evaluated to %v", cond), "condition")
+				break
+			}
+			if !cond.Bool() {
+				if int(in.a) < pc {
+					err = m.tick()
+				}
+				pc = int(in.a)
+			}
+		case opAndJump, opOrJump:
+			if stack[len(stack)-1].Bool() == (in.op == opOrJump) {
+				pc = int(in.a)
+			} else {
+				stack = stack[:len(stack)-1]
+			}
+		case opIndex:
+			index := ordinal(stack[len(stack)-1])
+			stack = stack[:len(stack)-1]
+			top := &stack[len(stack)-1]
+			*top, err = element(*top, index)
+		case opDefined:
+			if !stack[len(stack)-1].defined() {
+				err = errors.NewRuntimeError("array element is read before it is assigned", "run",
+					errors.ErrorCode(errors.UninitializedVar),
+				)
+			}
+		case opStoreElem:
+			n := len(stack)
+			arr, index := stack[n-2].array(), ordinal(stack[n-1])
+			if err = arrayBounds(arr, index); err == nil {
+				arr.elems[index-arr.low] = overwrite(arr.elems[index-arr.low], stack[n-3])
+			}
+			stack = stack[:n-3]
+		case opSetChar:
+			n := len(stack)
+			runes, index := []rune(stack[n-2].Str()), ordinal(stack[n-1])
+			if index < 1 || index > len(runes) {
+				err = boundsError(index, 1, len(runes))
+				break
+			}
+			runes[index-1] = stack[n-3].Char()
+			stack[n-3] = strVal(string(runes))
+			stack = stack[:n-2]
+		case opRefElem:
+			n := len(stack)
+			arr, index := stack[n-2].array(), ordinal(stack[n-1])
+			if err = arrayBounds(arr, index); err == nil {
+				stack[n-2] = refVal(elemRef(arr, index-arr.low))
+			}
+			stack = stack[:n-1]
+		case opField:
+			top := &stack[len(stack)-1]
+			*top, err = m.field(top.record(), consts[in.a].Str())
+		case opStoreField:
+			n := len(stack)
+			record, name := stack[n-1].record(), consts[in.a].Str()
+			record.fields[name] = overwrite(record.fields[name], stack[n-2])
+			record.selectVariant(record.typ.variants[name])
+			stack = stack[:n-2]
+		case opRefField:
+			top := &stack[len(stack)-1]
+			*top = refVal(fieldRef(top.record(), consts[in.a].Str()))
+		case opCall:
+			callee := m.prog.procs[in.a]
+			if err = m.tick(); err != nil {
+				break
+			}
+			if limit := m.i.maxCallDepth; limit > 0 && m.i.callStack.depth() >= limit {
+				err = errors.NewRuntimeError(fmt.Sprintf("call depth exceeds %d", limit), "run",
+					errors.ErrorCode(errors.StackOverflow),
+				)
+				break
+			}
+			calleeAR := newActivationRecord(callee.name, arProcedure, callee.level, callee.vars)
+			calleeAR.accessLink = ar.enclosing(callee.level - 1)
+			args := stack[len(stack)-len(callee.params):]
+			for idx, slot := range callee.params {
+				calleeAR.slots[slot] = args[idx]
+			}
+			stack = stack[:len(stack)-len(callee.params)]
+
+			// a write of the callee goes out before the one its result is
+			// an argument of, as with the tree
+			m.frames[len(m.frames)-1].pc = pc
+			m.frames[len(m.frames)-1].out = m.out.String()
+			m.out.Reset()
+			m.frames = append(m.frames, vmFrame{proc: callee, ar: calleeAR})
+			m.i.callStack.push(calleeAR)
+			if m.i.trace != nil {
+				m.i.tracef("ENTER: PROCEDURE %s\n%s", callee.name, m.i.callStack)
+			}
+			proc, ar, slots = callee, calleeAR, calleeAR.slots
+			code, pc = callee.code, 0
+		case opReturn:
+			if len(m.frames) == 1 {
+				m.stack = stack
+				return nil
+			}
+			if m.i.trace != nil {
+				m.i.tracef("LEAVE: PROCEDURE %s\n%s", proc.name, m.i.callStack)
+			}
+			m.i.callStack.pop()
+			m.frames = m.frames[:len(m.frames)-1]
+			done := proc
+			result := Value{}
+			if done.result >= 0 {
+				result = slots[done.result]
+			}
+			caller := m.frames[len(m.frames)-1]
+			proc, ar, slots = caller.proc, caller.ar, caller.ar.slots
+			code, pc = proc.code, caller.pc
+			m.out.Reset()
+			m.out.WriteString(caller.out)
+			if done.result < 0 {
+				break
+			}
+			if !result.defined() {
+				err = errors.NewRuntimeError(fmt.Sprintf("function %s returned without a result", done.name), "run",
+					errors.ErrorCode(errors.UninitializedVar),
+				)
+				break
+			}
+			stack = append(stack, result)
+		case opBuiltin:
+			n := len(stack) - int(in.b)
+			var v Value
+			v, err = applyBuiltin(consts[in.a].Str(), stack[n:])
+			stack = append(stack[:n], v)
+		case opWrite:
+			width, precision := 0, -1
+			v := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if in.b&2 != 0 {
+				precision = stack[len(stack)-1].Int()
+				stack = stack[:len(stack)-1]
+			}
+			if in.b&1 != 0 {
+				width = stack[len(stack)-1].Int()
+				stack = stack[:len(stack)-1]
+			}
+			if err = checkFormat(width, precision); err == nil {
+				m.out.WriteString(formatValue(v, types[in.a], width, precision))
+			}
+		case opFlush:
+			if in.a == 1 {
+				m.out.WriteByte('\n')
+			}
+			if _, werr := io.WriteString(m.i.output, m.out.String()); werr != nil {
+				err = errors.NewRuntimeError(werr.Error(), "write")
+			}
+			m.out.Reset()
+		case opRead:
+			var v Value
+			if v, err = readValue(m.i.input, types[in.a]); err == nil {
+				stack = append(stack, v)
+			}
+		case opReadln:
+			skipLine(m.i.input)
+		case opForPrep:
+			n := len(stack)
+			from, to := ordinal(stack[n-2]), ordinal(stack[n-1])
+			if in.b == 0 && from > to || in.b == 1 && from < to {
+				stack = stack[:n-2]
+				pc = int(in.a)
+				break
+			}
+			// the last ordinal goes below the current value
+			stack[n-2], stack[n-1] = intVal(to), stack[n-2]
+		case opForNext:
+			n := len(stack)
+			current := stack[n-1]
+			if ordinal(current) == stack[n-2].Int() {
+				stack = stack[:n-2]
+				break
+			}
+			step := 1
+			if in.b == 1 {
+				step = -1
+			}
+			stack[n-1] = fromOrdinal(ordinal(current)+step, current)
+			err = m.tick()
+			pc = int(in.a)
+		case opCase:
+			selector := ordinal(stack[len(stack)-1])
+			stack = stack[:len(stack)-1]
+			table := &m.prog.cases[in.a]
+			pc = table.other
+			for _, r := range table.ranges {
+				if r.low <= selector && selector <= r.high {
+					pc = r.target
+					break
+				}
+			}
+		default:
+			err = errors.NewRuntimeError(fmt.Sprintf("unknown instruction %v", in.op), "run")
+		}
+	}
+	m.frames[len(m.frames)-1].pc = pc
+	m.stack = stack
+	return m.fail(err)
+}
+
+// tick counts a backward jump or a call and checks the context every
+// contextInterval of them.
+func (m *machine) tick() error {
+	m.budget--
+	if m.budget > 0 {
+		return nil
+	}
+	m.budget = contextInterval
+	return m.i.checkContext("run")
+}
+
+// fail positions err at the instruction that raised it and adds the
+// procedures it passed through on the way out.
+func (m *machine) fail(err error) error {
+	top := m.frames[len(m.frames)-1]
+	if e, ok := err.(*errors.Error); ok && e.Code() != errors.Canceled {
+		pos := top.proc.pos[top.pc-1]
+		err = positioned(err, errors.Pos(pos.Line, pos.Column))
+	}
+	for k := len(m.frames) - 1; k > 0; k-- {
+		err = through(err, "procedure "+m.frames[k].proc.name)
+	}
+	return err
+}
+
+// load reads variable slot of ar, following the reference of a var
+// parameter.
+func load(ar *activationRecord, slot int) (Value, error) {
+	v := ar.slots[slot]
+	if v.kind == kindRef {
+		v = v.ref().load()
+	}
+	if !v.defined() {
+		return Value{}, errors.NewRuntimeError(fmt.Sprintf("%s is read before it is assigned", ar.vars[slot].name), "load",
+			errors.ErrorCode(errors.UninitializedVar),
+		)
+	}
+	return v, nil
+}
+
+// store sets variable slot, passing the value on to the variable a var
+// parameter stands for.
+func store(slots []Value, slot int, v Value) {
+	if slots[slot].kind == kindRef {
+		slots[slot].ref().store(v)
+		return
+	}
+	slots[slot] = overwrite(slots[slot], v)
+}
+
+func compare(op opcode, left, right int) bool {
+	switch op {
+	case opEqual:
+		return left == right
+	case opNotEqual:
+		return left != right
+	case opLess:
+		return left < right
+	case opLessEqual:
+		return left <= right
+	case opGreater:
+		return left > right
+	default:
+		return left >= right
+	}
+}
+
+// element returns the element of an array or the character of a string with
+// the given index.
+func element(container Value, index int) (Value, error) {
+	if container.kind == kindArray {
+		arr := container.array()
+		if err := arrayBounds(arr, index); err != nil {
+			return Value{}, err
+		}
+		return arr.elems[index-arr.low], nil
+	}
+	s := container.Str()
+	if n := utf8.RuneCountInString(s); index < 1 || index > n {
+		return Value{}, boundsError(index, 1, n)
+	}
+	return charVal([]rune(s)[index-1]), nil
+}
+
+func arrayBounds(arr *arrayValue, index int) error {
+	if high := arr.low + len(arr.elems) - 1; index < arr.low || index > high {
+		return boundsError(index, arr.low, high)
+	}
+	return nil
+}
+
+func (m *machine) field(record *recordValue, name string) (Value, error) {
+	if variant := record.typ.variants[name]; m.i.checked && variant != nil && !record.active(variant) {
+		return Value{}, errors.NewRuntimeError(fmt.Sprintf("field %s belongs to an inactive variant", name), "field",
+			errors.ErrorCode(errors.InactiveVariant),
+		)
+	}
+	v := record.fields[name]
+	if !v.defined() {
+		return Value{}, errors.NewRuntimeError(fmt.Sprintf("field %v is read before it is assigned", name), "field",
+			errors.ErrorCode(errors.UninitializedVar),
+		)
+	}
+	return v, nil
+}